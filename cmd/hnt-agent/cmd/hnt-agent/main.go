@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -12,6 +14,8 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/veilm/hinata/cmd/hnt-agent/pkg/agent"
 	"github.com/veilm/hinata/cmd/hnt-agent/pkg/spinner"
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/llm"
+	"github.com/veilm/hinata/pkg/paramflags"
 	"github.com/veilm/hinata/pkg/prompt"
 	"github.com/veilm/hinata/pkg/terminal"
 )
@@ -33,7 +37,9 @@ var (
 	useEditor       bool
 	useStdin        bool
 	autoExit        bool
+	prewarm         bool
 	theme           string
+	paramFlags      *paramflags.ParamFlags
 )
 
 func main() {
@@ -56,7 +62,7 @@ func main() {
 	rootCmd.Flags().StringVarP(&message, "message", "m", "", "User instruction message")
 	rootCmd.Flags().StringVarP(&session, "session", "s", "", "Path to conversation directory to resume a session")
 	rootCmd.Flags().StringVar(&pwd, "pwd", "", "Set the initial working directory")
-	rootCmd.Flags().StringVar(&model, "model", "", "LLM model to use")
+	rootCmd.Flags().StringVar(&model, "model", "", "LLM model to use (comma-separated for a fallback chain)")
 	rootCmd.Flags().BoolVar(&ignoreReasoning, "ignore-reasoning", false, "Do not display or save LLM reasoning")
 	rootCmd.Flags().BoolVar(&noConfirm, "no-confirm", false, "Skip confirmation steps")
 	rootCmd.Flags().BoolVarP(&noConfirm, "yes", "y", false, "Skip confirmation steps (alias for --no-confirm)")
@@ -68,9 +74,15 @@ func main() {
 	rootCmd.Flags().BoolVar(&useEditor, "use-editor", false, "Use an external editor ($EDITOR) for the user instruction message")
 	rootCmd.Flags().BoolVar(&useStdin, "stdin", false, "Read message from stdin")
 	rootCmd.Flags().BoolVar(&autoExit, "auto-exit", false, "Automatically exit if no shell block is provided")
+	rootCmd.Flags().BoolVar(&prewarm, "prewarm", false, "Connect to the LLM provider while the message is being typed")
+	paramFlags = paramflags.Add(rootCmd.Flags())
 	rootCmd.Flags().StringVar(&theme, "theme", "snow", "Color theme: snow (default, true color) or ansi (terminal colors)")
 
 	if err := rootCmd.Execute(); err != nil {
+		if errors.Is(err, context.Canceled) {
+			fmt.Fprintln(os.Stderr, "hnt-agent: interrupted")
+			os.Exit(130)
+		}
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
@@ -117,6 +129,9 @@ func run(cmd *cobra.Command, args []string) error {
 	} else if useStdin {
 		userMessage = stdinContent
 	} else {
+		if prewarm {
+			go llm.Prewarm(context.Background(), agent.ResolveModel(model))
+		}
 		msg, err := promptForMessage(useEditor)
 		if err != nil {
 			return err
@@ -124,6 +139,11 @@ func run(cmd *cobra.Command, args []string) error {
 		userMessage = msg
 	}
 
+	params, err := paramFlags.Params()
+	if err != nil {
+		return err
+	}
+
 	var spinnerPtr *int
 	if spinnerIndex >= 0 {
 		spinnerPtr = &spinnerIndex
@@ -133,6 +153,7 @@ func run(cmd *cobra.Command, args []string) error {
 		ConversationDir: session,
 		SystemPrompt:    sysPrompt,
 		Model:           model,
+		Params:          params,
 		PWD:             pwd,
 		IgnoreReasoning: ignoreReasoning,
 		NoConfirm:       noConfirm,
@@ -144,6 +165,7 @@ func run(cmd *cobra.Command, args []string) error {
 		UseEditor:       useEditor,
 		AutoExit:        autoExit,
 		Theme:           theme,
+		Prewarm:         prewarm,
 	}
 
 	ag, err := agent.New(cfg)
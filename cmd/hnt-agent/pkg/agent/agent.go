@@ -1,7 +1,6 @@
 package agent
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -18,6 +17,7 @@ import (
 	"github.com/veilm/hinata/cmd/hnt-agent/pkg/cursor"
 	"github.com/veilm/hinata/cmd/hnt-agent/pkg/spinner"
 	"github.com/veilm/hinata/cmd/hnt-chat/pkg/chat"
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/escaping"
 	"github.com/veilm/hinata/cmd/hnt-llm/pkg/llm"
 	"github.com/veilm/hinata/cmd/shell-exec/pkg/shell"
 	"github.com/veilm/hinata/cmd/tui-select/pkg/selector"
@@ -31,6 +31,7 @@ type Agent struct {
 	ConversationDir string
 	SystemPrompt    string
 	Model           string
+	Params          llm.Params
 	IgnoreReasoning bool
 	NoConfirm       bool
 	NoEscape        bool
@@ -40,6 +41,7 @@ type Agent struct {
 	SpinnerFile     string
 	UseEditor       bool
 	AutoExit        bool
+	Prewarm         bool
 
 	shellExecutor    *shell.Executor
 	turnCounter      int
@@ -53,6 +55,9 @@ type Config struct {
 	ConversationDir string
 	SystemPrompt    string
 	Model           string
+	// Params override the generation parameters saved with a resumed
+	// session.
+	Params          llm.Params
 	PWD             string
 	IgnoreReasoning bool
 	NoConfirm       bool
@@ -64,6 +69,24 @@ type Config struct {
 	UseEditor       bool
 	AutoExit        bool
 	Theme           string
+	// Prewarm opens a connection to the provider while the user is typing
+	// a follow-up instruction.
+	Prewarm bool
+}
+
+// ResolveModel returns model, or the default from HINATA_AGENT_MODEL or
+// HINATA_MODEL if it is empty.
+func ResolveModel(model string) string {
+	if model == "" {
+		model = os.Getenv("HINATA_AGENT_MODEL")
+		if model == "" {
+			model = os.Getenv("HINATA_MODEL")
+			if model == "" {
+				model = llm.DefaultModel("openrouter/google/gemini-2.5-pro")
+			}
+		}
+	}
+	return model
 }
 
 func New(cfg Config) (*Agent, error) {
@@ -90,14 +113,11 @@ func New(cfg Config) (*Agent, error) {
 		}
 	}
 
-	if cfg.Model == "" {
-		cfg.Model = os.Getenv("HINATA_AGENT_MODEL")
-		if cfg.Model == "" {
-			cfg.Model = os.Getenv("HINATA_MODEL")
-			if cfg.Model == "" {
-				cfg.Model = "openrouter/google/gemini-2.5-pro"
-			}
-		}
+	cfg.Model = ResolveModel(cfg.Model)
+
+	params, err := chat.ResolveParams(cfg.ConversationDir, cfg.Params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load generation parameters: %w", err)
 	}
 
 	executor := shell.NewExecutor(pwd)
@@ -152,6 +172,7 @@ func New(cfg Config) (*Agent, error) {
 		ConversationDir:  cfg.ConversationDir,
 		SystemPrompt:     cfg.SystemPrompt,
 		Model:            cfg.Model,
+		Params:           params,
 		IgnoreReasoning:  cfg.IgnoreReasoning,
 		NoConfirm:        cfg.NoConfirm,
 		NoEscape:         cfg.NoEscape,
@@ -161,6 +182,7 @@ func New(cfg Config) (*Agent, error) {
 		SpinnerFile:      cfg.SpinnerFile,
 		UseEditor:        cfg.UseEditor,
 		AutoExit:         cfg.AutoExit,
+		Prewarm:          cfg.Prewarm,
 		shellExecutor:    executor,
 		turnCounter:      1,
 		humanTurnCounter: 1,
@@ -223,7 +245,7 @@ func (a *Agent) Run(userMessage string) error {
 	for {
 		a.turnCounter++
 
-		llmContent, llmReasoning, err := a.streamLLMResponse()
+		llmContent, llmReasoning, meta, err := a.streamLLMResponse()
 		if err != nil {
 			return fmt.Errorf("failed to generate LLM response: %w", err)
 		}
@@ -238,9 +260,16 @@ func (a *Agent) Run(userMessage string) error {
 			}
 		}
 
-		// Save only content to assistant file
-		if err := a.writeMessage("assistant", llmContent); err != nil {
-			return err
+		// Save only content to assistant file. Nothing is saved when the
+		// response was interrupted before any of it arrived.
+		if !meta.Interrupted || llmContent != "" || llmReasoning != "" {
+			assistantFile, err := chat.WriteMessageFile(a.ConversationDir, chat.RoleAssistant, llmContent)
+			if err != nil {
+				return fmt.Errorf("failed to write message: %w", err)
+			}
+			if err := chat.WriteMessageMeta(a.ConversationDir, assistantFile, meta); err != nil {
+				return err
+			}
 		}
 
 		// Combine for shell command extraction
@@ -249,13 +278,25 @@ func (a *Agent) Run(userMessage string) error {
 			llmResponse = fmt.Sprintf("<think>%s</think>\n%s", llmReasoning, llmContent)
 		}
 
-		shellCommands := extractShellCommands(llmResponse)
+		// A shell block in an interrupted response may be incomplete, so
+		// it is never run.
+		var shellCommands []string
+		if !meta.Interrupted {
+			shellCommands = extractShellCommands(llmResponse)
+		}
 		if len(shellCommands) == 0 {
 			fmt.Fprint(os.Stderr, "\n")
 			fmt.Fprint(os.Stderr, marginStr())
-			a.theme.StatusMessage.Fprint(os.Stderr, "◦ Hinata did not suggest a shell block.\n")
+			if meta.Interrupted {
+				a.theme.StatusMessage.Fprint(os.Stderr, "◦ Interrupted.\n")
+			} else {
+				a.theme.StatusMessage.Fprint(os.Stderr, "◦ Hinata did not suggest a shell block.\n")
+			}
 
 			if a.AutoExit {
+				if meta.Interrupted {
+					return context.Canceled
+				}
 				return nil
 			}
 
@@ -342,7 +383,8 @@ func (a *Agent) Run(userMessage string) error {
 				resultMessage = formatShellResults(result)
 			}
 
-			if err := a.writeMessage("user", resultMessage); err != nil {
+			// Image references in the output are text, not attachments.
+			if err := a.writeMessage("user", escaping.EscapeImages(resultMessage)); err != nil {
 				return err
 			}
 
@@ -389,23 +431,29 @@ func (a *Agent) Run(userMessage string) error {
 	}
 }
 
-func (a *Agent) streamLLMResponse() (string, string, error) {
-	var packedBuf bytes.Buffer
-	err := chat.PackConversation(a.ConversationDir, &packedBuf, false)
+func (a *Agent) streamLLMResponse() (string, string, chat.MessageMeta, error) {
+	messages, err := chat.LoadMessages(a.ConversationDir)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to pack conversation: %w", err)
+		return "", "", chat.MessageMeta{}, fmt.Errorf("failed to load conversation: %w", err)
 	}
 
 	config := llm.Config{
 		Model:            a.Model,
 		IncludeReasoning: !a.IgnoreReasoning,
+		Params:           a.Params,
 	}
 
-	ctx := context.Background()
-	eventChan, errChan := llm.StreamLLMResponse(ctx, config, packedBuf.String())
+	// Ctrl-C stops the generation and keeps the partial response.
+	defer cursor.HandleInterrupts()()
+	ctx, stop := llm.InterruptContext(context.Background())
+	defer stop()
+	stream := llm.NewMessageStream(ctx, config, messages)
 
 	var response strings.Builder
 	var reasoningBuffer strings.Builder
+	var usage *llm.Usage
+	answeredModel := a.Model
+	usedKey := ""
 	termWidth := getTerminalWidth()
 	wrapAt := termWidth - (MARGIN * 2)
 	if wrapAt < 20 {
@@ -427,109 +475,169 @@ func (a *Agent) streamLLMResponse() (string, string, error) {
 	cursor.Hide()
 	defer cursor.Show()
 
-	for {
-		select {
-		case event, ok := <-eventChan:
-			if !ok {
-				// Flush any remaining buffered content
-				if contentBuffer.Len() > 0 {
-					a.printWrappedText(contentBuffer.String(), &currentColumn, wrapAt, a.theme.DefaultText)
-					contentBuffer.Reset()
-				}
-				if reasoningChunkBuffer.Len() > 0 {
-					a.printWrappedText(reasoningChunkBuffer.String(), &currentColumn, wrapAt, a.theme.Reasoning)
-					reasoningChunkBuffer.Reset()
-				}
-				return response.String(), reasoningBuffer.String(), nil
+	for stream.Next() {
+		event := stream.Event()
+
+		if event.Content != "" {
+			if a.logger != nil {
+				a.logger.Printf("Received content chunk: %q (len=%d)", event.Content, len(event.Content))
 			}
 
-			if event.Content != "" {
-				if a.logger != nil {
-					a.logger.Printf("Received content chunk: %q (len=%d)", event.Content, len(event.Content))
-				}
+			// Always accumulate to response
+			response.WriteString(event.Content)
 
-				// Always accumulate to response
-				response.WriteString(event.Content)
+			// Parse content for shell blocks
+			results := tagParser.Parse(event.Content)
 
-				// Parse content for shell blocks
-				results := tagParser.Parse(event.Content)
+			if a.logger != nil {
+				a.logger.Printf("Streaming: Got %d parse results from chunk", len(results))
+			}
 
+			for i, result := range results {
 				if a.logger != nil {
-					a.logger.Printf("Streaming: Got %d parse results from chunk", len(results))
+					a.logger.Printf("  Result %d: BeforeTag=%q, HasOpenTag=%v, HasCloseTag=%v, AfterTag=%q",
+						i, result.BeforeTag, result.HasOpenTag, result.HasCloseTag, result.AfterTag)
 				}
+				// Initialize if first token
+				if isFirstToken && result.BeforeTag != "" {
+					fmt.Print(marginStr())
+					currentColumn = 0
+					isFirstToken = false
+				}
+
+				// Print content before tag (using appropriate color)
+				if result.BeforeTag != "" {
+					// Determine color based on context
+					colorFunc := a.theme.DefaultText
+					colorName := "default"
+
+					if result.HasCloseTag {
+						// For closing tag, the content before tag is shell content
+						colorFunc = a.theme.ShellBlockCode
+						colorName = "shell"
+					} else if !result.HasOpenTag && tagParser.IsInShellBlock() {
+						// We're in a shell block and this result doesn't change that
+						colorFunc = a.theme.ShellBlockCode
+						colorName = "shell"
+					}
 
-				for i, result := range results {
 					if a.logger != nil {
-						a.logger.Printf("  Result %d: BeforeTag=%q, HasOpenTag=%v, HasCloseTag=%v, AfterTag=%q",
-							i, result.BeforeTag, result.HasOpenTag, result.HasCloseTag, result.AfterTag)
+						a.logger.Printf("    Printing BeforeTag with %s color: %q", colorName, result.BeforeTag)
 					}
-					// Initialize if first token
-					if isFirstToken && result.BeforeTag != "" {
+					a.printWrappedText(result.BeforeTag, &currentColumn, wrapAt, colorFunc)
+				}
+
+				// Don't print AfterTag for opening tag - it will be processed in next iteration
+				// Only print AfterTag for closing tag
+				if result.HasCloseTag && result.AfterTag != "" {
+					// If we just closed a shell block, use default color for after tag
+					if isFirstToken {
 						fmt.Print(marginStr())
 						currentColumn = 0
 						isFirstToken = false
 					}
-
-					// Print content before tag (using appropriate color)
-					if result.BeforeTag != "" {
-						// Determine color based on context
-						colorFunc := a.theme.DefaultText
-						colorName := "default"
-
-						if result.HasCloseTag {
-							// For closing tag, the content before tag is shell content
-							colorFunc = a.theme.ShellBlockCode
-							colorName = "shell"
-						} else if !result.HasOpenTag && tagParser.IsInShellBlock() {
-							// We're in a shell block and this result doesn't change that
-							colorFunc = a.theme.ShellBlockCode
-							colorName = "shell"
-						}
-
-						if a.logger != nil {
-							a.logger.Printf("    Printing BeforeTag with %s color: %q", colorName, result.BeforeTag)
-						}
-						a.printWrappedText(result.BeforeTag, &currentColumn, wrapAt, colorFunc)
-					}
-
-					// Don't print AfterTag for opening tag - it will be processed in next iteration
-					// Only print AfterTag for closing tag
-					if result.HasCloseTag && result.AfterTag != "" {
-						// If we just closed a shell block, use default color for after tag
-						if isFirstToken {
-							fmt.Print(marginStr())
-							currentColumn = 0
-							isFirstToken = false
-						}
-						if a.logger != nil {
-							a.logger.Printf("    Printing AfterTag (after close) with default color: %q", result.AfterTag)
-						}
-						a.printWrappedText(result.AfterTag, &currentColumn, wrapAt, a.theme.DefaultText)
+					if a.logger != nil {
+						a.logger.Printf("    Printing AfterTag (after close) with default color: %q", result.AfterTag)
 					}
+					a.printWrappedText(result.AfterTag, &currentColumn, wrapAt, a.theme.DefaultText)
 				}
 			}
+		}
 
-			if event.Reasoning != "" && !a.IgnoreReasoning {
-				if isFirstToken {
-					fmt.Print(marginStr())
-					currentColumn = 0
-					isFirstToken = false
-				}
+		if event.Reasoning != "" && !a.IgnoreReasoning {
+			if isFirstToken {
+				fmt.Print(marginStr())
+				currentColumn = 0
+				isFirstToken = false
+			}
 
-				if !inReasoning {
-					inReasoning = true
-				}
+			if !inReasoning {
+				inReasoning = true
+			}
 
-				// Print reasoning directly without buffering
-				a.printWrappedText(event.Reasoning, &currentColumn, wrapAt, a.theme.Reasoning)
-				reasoningBuffer.WriteString(event.Reasoning)
+			// Print reasoning directly without buffering
+			a.printWrappedText(event.Reasoning, &currentColumn, wrapAt, a.theme.Reasoning)
+			reasoningBuffer.WriteString(event.Reasoning)
+		}
+
+		if event.Usage != nil {
+			usage = event.Usage
+		}
+
+		if event.Model != "" {
+			answeredModel = event.Model
+			usedKey = event.Key
+		}
+
+		if event.Fallback != nil {
+			if !isFirstToken {
+				fmt.Println()
 			}
-		case err := <-errChan:
-			if err != nil {
-				return "", "", fmt.Errorf("LLM request failed: %w\nModel: %s", err, a.Model)
+			fmt.Print(marginStr())
+			a.theme.StatusMessage.Printf("◦ %s\n", event.Fallback)
+			isFirstToken = true
+			currentColumn = 0
+		}
+
+		if event.Retry != nil {
+			if !isFirstToken {
+				fmt.Println()
+			}
+			fmt.Print(marginStr())
+			a.theme.StatusMessage.Printf("◦ LLM request failed, retrying (%s)\n", event.Retry)
+			if event.Retry.DiscardPartial {
+				response.Reset()
+				reasoningBuffer.Reset()
+				contentBuffer.Reset()
+				reasoningChunkBuffer.Reset()
+				tagParser = NewTagParser(a.logger)
 			}
+			isFirstToken = true
+			currentColumn = 0
+		}
+
+		if event.Continuation != nil {
+			if !isFirstToken {
+				fmt.Println()
+			}
+			fmt.Print(marginStr())
+			a.theme.StatusMessage.Printf("◦ The response hit the token limit, continuing (%d/%d)\n", event.Continuation.Number, event.Continuation.Max)
+			isFirstToken = true
+			currentColumn = 0
+		}
+	}
+
+	// Flush any remaining buffered content
+	if contentBuffer.Len() > 0 {
+		a.printWrappedText(contentBuffer.String(), &currentColumn, wrapAt, a.theme.DefaultText)
+		contentBuffer.Reset()
+	}
+	if reasoningChunkBuffer.Len() > 0 {
+		a.printWrappedText(reasoningChunkBuffer.String(), &currentColumn, wrapAt, a.theme.Reasoning)
+		reasoningChunkBuffer.Reset()
+	}
+
+	err = stream.Err()
+	interrupted := llm.Interrupted(ctx, err)
+	if err != nil && !interrupted {
+		return "", "", chat.MessageMeta{}, fmt.Errorf("LLM request failed: %w\nModel: %s", err, a.Model)
+	}
+
+	finishReason := stream.FinishReason()
+	if finishReason == llm.FinishLength || finishReason == llm.FinishContentFilter {
+		if !isFirstToken {
+			fmt.Println()
+		}
+		fmt.Print(marginStr())
+		if finishReason == llm.FinishLength {
+			a.theme.StatusMessage.Print("◦ The response was cut off by the token limit.\n")
+		} else {
+			a.theme.StatusMessage.Print("◦ The response was stopped by the provider's content filter.\n")
 		}
 	}
+
+	meta := chat.MessageMeta{Model: answeredModel, Key: usedKey, Usage: usage, FinishReason: finishReason, Interrupted: interrupted}
+	return response.String(), reasoningBuffer.String(), meta, nil
 }
 
 func (a *Agent) executeShellCommands(commands string) (*shell.ExecutionResult, error) {
@@ -781,6 +889,8 @@ func (a *Agent) promptExecute() executeChoice {
 }
 
 func (a *Agent) promptForMessage() string {
+	a.prewarm()
+
 	// Print a blank line before showing the textarea during conversation
 	fmt.Println()
 
@@ -812,6 +922,19 @@ func (a *Agent) promptForMessage() string {
 	return instruction
 }
 
+// prewarm connects to the provider in the background, so that the request
+// after the prompt skips the TCP and TLS handshakes.
+func (a *Agent) prewarm() {
+	if !a.Prewarm {
+		return
+	}
+	go func() {
+		if err := llm.Prewarm(context.Background(), a.Model); err != nil && a.logger != nil {
+			a.logger.Printf("Prewarm failed: %v", err)
+		}
+	}()
+}
+
 func extractShellCommands(text string) []string {
 	re := regexp.MustCompile(`(?s)<hnt-shell>(.*?)</hnt-shell>`)
 	matches := re.FindAllStringSubmatch(text, -1)
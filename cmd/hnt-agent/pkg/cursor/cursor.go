@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 )
 
@@ -12,6 +13,9 @@ var (
 	cursorHidden bool
 	cursorMutex  sync.Mutex
 	once         sync.Once
+
+	// interruptHandlers counts the callers that handle Ctrl-C themselves.
+	interruptHandlers atomic.Int32
 )
 
 func init() {
@@ -21,14 +25,25 @@ func init() {
 		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
 		go func() {
-			<-sigChan
-			// Restore cursor before exiting
-			Show()
-			os.Exit(1)
+			for sig := range sigChan {
+				if sig == os.Interrupt && interruptHandlers.Load() > 0 {
+					continue
+				}
+				// Restore cursor before exiting
+				Show()
+				os.Exit(1)
+			}
 		}()
 	})
 }
 
+// HandleInterrupts keeps Ctrl-C from exiting the process until release is
+// called, for callers that stop their work on it instead.
+func HandleInterrupts() (release func()) {
+	interruptHandlers.Add(1)
+	return func() { interruptHandlers.Add(-1) }
+}
+
 // Hide hides the terminal cursor
 func Hide() {
 	cursorMutex.Lock()
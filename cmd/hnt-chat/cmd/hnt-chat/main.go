@@ -1,8 +1,8 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -12,6 +12,8 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/veilm/hinata/cmd/hnt-chat/pkg/chat"
 	"github.com/veilm/hinata/cmd/hnt-llm/pkg/llm"
+	"github.com/veilm/hinata/pkg/paramflags"
+	"golang.org/x/term"
 )
 
 var (
@@ -23,6 +25,11 @@ var (
 	separateReasoning bool
 	model             string
 	debugUnsafe       bool
+	allConversations  bool
+	attachments       []string
+	paramFlags        *paramflags.ParamFlags
+	jsonSchemaPath    string
+	keyProfile        string
 )
 
 func main() {
@@ -51,6 +58,7 @@ func main() {
 	}
 	addCmd.Flags().StringVarP(&conversationPath, "conversation", "c", "", "Path to conversation directory")
 	addCmd.Flags().BoolVar(&separateReasoning, "separate-reasoning", false, "For assistant role, save <think> content separately")
+	addCmd.Flags().StringArrayVar(&attachments, "attach", nil, "Attach an image to the message (repeatable)")
 
 	var packCmd = &cobra.Command{
 		Use:          "pack",
@@ -73,12 +81,28 @@ func main() {
 	genCmd.Flags().BoolVar(&outputFilename, "output-filename", false, "Print filename of created message")
 	genCmd.Flags().BoolVar(&includeReasoning, "include-reasoning", false, "Include reasoning in output")
 	genCmd.Flags().BoolVar(&merge, "merge", false, "Merge consecutive messages from same author")
-	genCmd.Flags().StringVar(&model, "model", "", "Model to use for LLM")
+	genCmd.Flags().StringVar(&model, "model", "", "Model to use for LLM (comma-separated for a fallback chain)")
 	genCmd.Flags().BoolVar(&debugUnsafe, "debug-unsafe", false, "Enable unsafe debugging options")
+	paramFlags = paramflags.Add(genCmd.Flags())
+	genCmd.Flags().StringVar(&jsonSchemaPath, "json-schema", "", "Require a JSON response matching the schema in this file")
+	genCmd.Flags().StringVar(&keyProfile, "key", "", "Use the saved key PROVIDER:NAME for each provider (or a single PROVIDER:NAME)")
+
+	var usageCmd = &cobra.Command{
+		Use:          "usage",
+		Short:        "Show token usage and estimated cost of conversations",
+		RunE:         handleUsageCommand,
+		SilenceUsage: true,
+	}
+	usageCmd.Flags().StringVarP(&conversationPath, "conversation", "c", "", "Path to conversation directory")
+	usageCmd.Flags().BoolVar(&allConversations, "all", false, "Include every saved conversation")
 
-	rootCmd.AddCommand(newCmd, addCmd, packCmd, genCmd)
+	rootCmd.AddCommand(newCmd, addCmd, packCmd, genCmd, usageCmd)
 
 	if err := rootCmd.Execute(); err != nil {
+		if errors.Is(err, context.Canceled) {
+			fmt.Fprintln(os.Stderr, "\nhnt-chat: interrupted")
+			os.Exit(130)
+		}
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
@@ -115,12 +139,26 @@ func handleAddCommand(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to determine conversation directory: %w", err)
 	}
 
-	content, err := io.ReadAll(os.Stdin)
-	if err != nil {
-		return fmt.Errorf("failed to read from stdin: %w", err)
+	// With attachments the text is optional, so don't wait on a terminal.
+	var content []byte
+	if len(attachments) == 0 || !term.IsTerminal(int(os.Stdin.Fd())) {
+		content, err = io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read from stdin: %w", err)
+		}
 	}
 
 	contentStr := string(content)
+	for _, path := range attachments {
+		ref, err := chat.AddAttachment(convDir, path)
+		if err != nil {
+			return err
+		}
+		if contentStr != "" && !strings.HasSuffix(contentStr, "\n") {
+			contentStr += "\n"
+		}
+		contentStr += ref + "\n"
+	}
 
 	if role == chat.RoleAssistant && separateReasoning && strings.HasPrefix(contentStr, "<think>") {
 		if endPos := strings.Index(contentStr, "</think>"); endPos != -1 {
@@ -176,81 +214,142 @@ func handleGenCommand(cmd *cobra.Command, args []string) error {
 		if model == "" {
 			model = os.Getenv("HINATA_MODEL")
 			if model == "" {
-				model = "openrouter/google/gemini-2.5-pro"
+				model = llm.DefaultModel("openrouter/google/gemini-2.5-pro")
 			}
 		}
 	}
 
 	shouldWrite := write || outputFilename
 
-	if model != "" && cmd.Flags().Changed("model") {
-		modelPath := filepath.Join(convDir, "model.txt")
-		if err := os.WriteFile(modelPath, []byte(model), 0644); err != nil {
-			return fmt.Errorf("failed to write model file: %w", err)
-		}
+	loadMessages := chat.LoadMessages
+	if merge {
+		loadMessages = chat.LoadMergedMessages
+	}
+	messages, err := loadMessages(convDir)
+	if err != nil {
+		return fmt.Errorf("failed to load conversation: %w", err)
 	}
 
-	var buf bytes.Buffer
-	if err := chat.PackConversation(convDir, &buf, merge); err != nil {
-		return fmt.Errorf("failed to pack conversation: %w", err)
+	// Parameters given on the command line are saved with the
+	// conversation and reused by later generations.
+	override, err := paramFlags.Params()
+	if err != nil {
+		return err
+	}
+	params, err := chat.ResolveParams(convDir, override)
+	if err != nil {
+		return err
+	}
+
+	// The model or chain asked for is kept with the conversation; the one
+	// that answered is recorded with each message.
+	if model != "" && cmd.Flags().Changed("model") {
+		if err := chat.WriteModel(convDir, model); err != nil {
+			return err
+		}
 	}
 
 	config := llm.Config{
 		Model:            model,
 		SystemPrompt:     "",
 		IncludeReasoning: debugUnsafe || includeReasoning,
+		Params:           params,
+		KeyProfile:       keyProfile,
+	}
+
+	// Ctrl-C stops the generation but keeps what was generated so far.
+	ctx, stop := llm.InterruptContext(context.Background())
+	defer stop()
+
+	if jsonSchemaPath != "" {
+		return generateStructured(ctx, convDir, config, messages, shouldWrite)
 	}
 
-	ctx := context.Background()
-	eventChan, errChan := llm.StreamLLMResponse(ctx, config, buf.String())
+	stream := llm.NewMessageStream(ctx, config, messages)
 
 	var contentBuffer strings.Builder
 	var reasoningBuffer strings.Builder
+	var usage *llm.Usage
+	answeredModel := model
+	usedKey := ""
 	hasThinkTag := false
 
-	for {
-		select {
-		case event, ok := <-eventChan:
-			if !ok {
-				goto done
-			}
+	for stream.Next() {
+		event := stream.Event()
 
-			if event.Content != "" {
-				if !outputFilename {
-					if hasThinkTag {
-						fmt.Print("</think>\n")
-						hasThinkTag = false
-					}
-					fmt.Print(event.Content)
+		if event.Content != "" {
+			if !outputFilename {
+				if hasThinkTag {
+					fmt.Print("</think>\n")
+					hasThinkTag = false
 				}
-				contentBuffer.WriteString(event.Content)
+				fmt.Print(event.Content)
 			}
+			contentBuffer.WriteString(event.Content)
+		}
 
-			if event.Reasoning != "" && (includeReasoning || debugUnsafe) {
-				if !outputFilename {
-					if !hasThinkTag {
-						fmt.Print("<think>")
-						hasThinkTag = true
-					}
-					fmt.Print(event.Reasoning)
+		if event.Reasoning != "" && (includeReasoning || debugUnsafe) {
+			if !outputFilename {
+				if !hasThinkTag {
+					fmt.Print("<think>")
+					hasThinkTag = true
 				}
-				reasoningBuffer.WriteString(event.Reasoning)
+				fmt.Print(event.Reasoning)
 			}
+			reasoningBuffer.WriteString(event.Reasoning)
+		}
 
-		case err := <-errChan:
-			if err != nil {
-				return fmt.Errorf("error from LLM stream: %w", err)
+		if event.Usage != nil {
+			usage = event.Usage
+		}
+
+		if event.Model != "" {
+			answeredModel = event.Model
+			usedKey = event.Key
+		}
+
+		if event.Fallback != nil {
+			fmt.Fprintf(os.Stderr, "hnt-chat: %s\n", event.Fallback)
+		}
+
+		if event.Retry != nil {
+			fmt.Fprintf(os.Stderr, "hnt-chat: retrying, %s\n", event.Retry)
+			if event.Retry.DiscardPartial {
+				contentBuffer.Reset()
+				reasoningBuffer.Reset()
 			}
 		}
+
+		if event.Continuation != nil {
+			fmt.Fprintf(os.Stderr, "\nhnt-chat: %s\n", event.Continuation)
+		}
 	}
 
-done:
 	if !outputFilename && hasThinkTag {
 		fmt.Print("</think>\n")
 	}
 
+	streamErr := stream.Err()
+	interrupted := llm.Interrupted(ctx, streamErr)
+	if streamErr != nil && !interrupted {
+		return fmt.Errorf("error from LLM stream: %w", streamErr)
+	}
+
+	finishReason := stream.FinishReason()
+	if finishReason == llm.FinishLength {
+		fmt.Fprintln(os.Stderr, "hnt-chat: the response was cut off by the token limit")
+	} else if finishReason == llm.FinishContentFilter {
+		fmt.Fprintln(os.Stderr, "hnt-chat: the response was stopped by the provider's content filter")
+	}
+
 	var assistantFilePath string
 
+	// Nothing is saved when the generation was interrupted before any of
+	// the response arrived.
+	if interrupted && contentBuffer.Len() == 0 && reasoningBuffer.Len() == 0 {
+		shouldWrite = false
+	}
+
 	if shouldWrite {
 		if includeReasoning {
 			if reasoningBuffer.Len() > 0 {
@@ -280,10 +379,59 @@ done:
 		}
 	}
 
+	if assistantFilePath != "" {
+		meta := chat.MessageMeta{Model: answeredModel, Key: usedKey, Usage: usage, FinishReason: finishReason, Interrupted: interrupted}
+		if err := chat.WriteMessageMeta(convDir, assistantFilePath, meta); err != nil {
+			return err
+		}
+	}
+
 	if outputFilename && assistantFilePath != "" {
 		fmt.Println(assistantFilePath)
 	}
 
+	if interrupted {
+		return streamErr
+	}
+	return nil
+}
+
+// generateStructured handles gen --json-schema. Nothing is printed or
+// written until the response has passed validation.
+func generateStructured(ctx context.Context, convDir string, config llm.Config, messages []llm.Message, shouldWrite bool) error {
+	schema, err := os.ReadFile(jsonSchemaPath)
+	if err != nil {
+		return fmt.Errorf("failed to read JSON schema: %w", err)
+	}
+	config.ResponseSchema = schema
+
+	result, err := llm.GenerateStructured(ctx, config, messages, func(event llm.StreamEvent) {
+		if event.Fallback != nil {
+			fmt.Fprintf(os.Stderr, "hnt-chat: %s\n", event.Fallback)
+		}
+		if event.Retry != nil {
+			fmt.Fprintf(os.Stderr, "hnt-chat: retrying, %s\n", event.Retry)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if shouldWrite {
+		path, err := chat.WriteMessageFile(convDir, chat.RoleAssistant, result.JSON)
+		if err != nil {
+			return fmt.Errorf("failed to write assistant message: %w", err)
+		}
+		if err := chat.WriteMessageMeta(convDir, path, chat.MessageMeta{Model: result.Model, Key: result.Key, Usage: result.Usage}); err != nil {
+			return err
+		}
+		if outputFilename {
+			fmt.Println(path)
+			return nil
+		}
+	}
+
+	fmt.Println(result.JSON)
 	return nil
 }
 
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/veilm/hinata/cmd/hnt-chat/pkg/chat"
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/llm"
+)
+
+type usageTotal struct {
+	messages int
+	usage    llm.Usage
+	cost     float64
+	// unpriced counts messages whose model is missing from the price table,
+	// and noUsage those saved without any usage to price.
+	unpriced int
+	noUsage  int
+}
+
+func (t *usageTotal) add(meta chat.MessageMeta) {
+	t.messages++
+	if meta.Usage == nil {
+		t.noUsage++
+		return
+	}
+	t.usage.Add(*meta.Usage)
+	if price, ok := llm.LookupPrice(meta.Model); ok {
+		t.cost += price.Cost(*meta.Usage)
+	} else {
+		t.unpriced++
+	}
+}
+
+func (t *usageTotal) merge(other usageTotal) {
+	t.messages += other.messages
+	t.usage.Add(other.usage)
+	t.cost += other.cost
+	t.unpriced += other.unpriced
+	t.noUsage += other.noUsage
+}
+
+func (t usageTotal) costString() string {
+	s := fmt.Sprintf("$%.4f", t.cost)
+	if t.unpriced > 0 {
+		s += fmt.Sprintf(" (+%d unpriced)", t.unpriced)
+	}
+	if t.noUsage > 0 {
+		s += fmt.Sprintf(" (+%d no usage recorded)", t.noUsage)
+	}
+	return s
+}
+
+func handleUsageCommand(cmd *cobra.Command, args []string) error {
+	var convDirs []string
+	if allConversations {
+		baseDir, err := chat.GetConversationsDir()
+		if err != nil {
+			return fmt.Errorf("failed to determine conversations directory: %w", err)
+		}
+		entries, err := os.ReadDir(baseDir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				convDirs = append(convDirs, filepath.Join(baseDir, entry.Name()))
+			}
+		}
+	} else {
+		convDir, err := determineConversationDir(conversationPath)
+		if err != nil {
+			return fmt.Errorf("failed to determine conversation directory: %w", err)
+		}
+		convDirs = []string{convDir}
+	}
+
+	perModel := make(map[string]*usageTotal)
+	var grand usageTotal
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONVERSATION\tMESSAGES\tPROMPT\tCOMPLETION\tREASONING\tCOST")
+
+	for _, convDir := range convDirs {
+		metas, err := chat.ListMessageMeta(convDir)
+		if err != nil {
+			return fmt.Errorf("failed to read usage for %s: %w", convDir, err)
+		}
+		if len(metas) == 0 {
+			continue
+		}
+
+		var total usageTotal
+		for _, meta := range metas {
+			total.add(meta)
+
+			key := meta.Model
+			if key == "" {
+				key = "(unknown)"
+			}
+			if perModel[key] == nil {
+				perModel[key] = &usageTotal{}
+			}
+			perModel[key].add(meta)
+		}
+		grand.merge(total)
+
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\n", filepath.Base(convDir), total.messages,
+			total.usage.PromptTokens, total.usage.CompletionTokens, total.usage.ReasoningTokens, total.costString())
+	}
+	w.Flush()
+
+	if grand.messages == 0 {
+		fmt.Println("\nNo usage recorded.")
+		return nil
+	}
+
+	models := make([]string, 0, len(perModel))
+	for m := range perModel {
+		models = append(models, m)
+	}
+	sort.Strings(models)
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MODEL\tMESSAGES\tPROMPT\tCOMPLETION\tREASONING\tCOST")
+	for _, m := range models {
+		t := perModel[m]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\n", m, t.messages,
+			t.usage.PromptTokens, t.usage.CompletionTokens, t.usage.ReasoningTokens, t.costString())
+	}
+	fmt.Fprintf(w, "TOTAL\t%d\t%d\t%d\t%d\t%s\n", grand.messages,
+		grand.usage.PromptTokens, grand.usage.CompletionTokens, grand.usage.ReasoningTokens, grand.costString())
+	return w.Flush()
+}
@@ -3,6 +3,7 @@ package chat
 import (
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"sort"
@@ -11,6 +12,7 @@ import (
 	"time"
 
 	"github.com/veilm/hinata/cmd/hnt-llm/pkg/escaping"
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/llm"
 )
 
 func GetConversationsDir() (string, error) {
@@ -132,83 +134,157 @@ func ListMessages(convDir string) ([]ChatMessage, error) {
 	return messages, nil
 }
 
-func PackConversation(convDir string, writer io.Writer, merge bool) error {
+// groupMessages lists the messages sent to the model, without reasoning.
+// With merge, consecutive messages from the same author form one group;
+// otherwise every group has a single message.
+func groupMessages(convDir string, merge bool) ([][]ChatMessage, error) {
 	messages, err := ListMessages(convDir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Filter out assistant-reasoning messages - they're internal only
-	var filteredMessages []ChatMessage
+	var groups [][]ChatMessage
 	for _, msg := range messages {
-		if msg.Role != RoleAssistantReasoning {
-			filteredMessages = append(filteredMessages, msg)
+		// Reasoning messages are internal only
+		if msg.Role == RoleAssistantReasoning {
+			continue
 		}
+		if n := len(groups); merge && n > 0 && groups[n-1][0].Role == msg.Role {
+			groups[n-1] = append(groups[n-1], msg)
+			continue
+		}
+		groups = append(groups, []ChatMessage{msg})
 	}
-	messages = filteredMessages
-
-	if merge {
-		i := 0
-		for i < len(messages) {
-			msg := messages[i]
-			role := msg.Role
+	return groups, nil
+}
 
-			if _, err := fmt.Fprintf(writer, "<hnt-%s>", role); err != nil {
-				return err
-			}
+func PackConversation(convDir string, writer io.Writer, merge bool) error {
+	groups, err := groupMessages(convDir, merge)
+	if err != nil {
+		return err
+	}
 
-			file, err := os.Open(msg.Path)
-			if err != nil {
-				return fmt.Errorf("failed to open message file %s: %w", msg.Path, err)
-			}
-			if err := escaping.Escape(file, writer); err != nil {
-				file.Close()
-				return err
-			}
-			file.Close()
+	for _, group := range groups {
+		role := group[0].Role
+		if _, err := fmt.Fprintf(writer, "<hnt-%s>", role); err != nil {
+			return err
+		}
 
-			for i+1 < len(messages) && messages[i+1].Role == role {
-				i++
+		for i, msg := range group {
+			if i > 0 {
 				if _, err := writer.Write([]byte("\n")); err != nil {
 					return err
 				}
-				file, err := os.Open(messages[i].Path)
-				if err != nil {
-					return fmt.Errorf("failed to open message file %s: %w", messages[i].Path, err)
-				}
-				if err := escaping.Escape(file, writer); err != nil {
-					file.Close()
-					return err
-				}
-				file.Close()
 			}
-
-			if _, err := fmt.Fprintf(writer, "</hnt-%s>\n", role); err != nil {
+			if err := writeMessageContent(writer, convDir, msg.Path); err != nil {
 				return err
 			}
-			i++
 		}
-	} else {
-		for _, msg := range messages {
-			if _, err := fmt.Fprintf(writer, "<hnt-%s>", msg.Role); err != nil {
-				return err
+
+		if _, err := fmt.Fprintf(writer, "</hnt-%s>\n", role); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeMessageContent writes an escaped message. Attachment references are
+// relative to the conversation directory, so they are made absolute for
+// readers in other directories.
+func writeMessageContent(writer io.Writer, convDir string, path string) error {
+	content, err := readMessageContent(convDir, path)
+	if err != nil {
+		return err
+	}
+	return escaping.Escape(strings.NewReader(content), writer)
+}
+
+func readMessageContent(convDir string, path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open message file %s: %w", path, err)
+	}
+
+	absDir, err := filepath.Abs(convDir)
+	if err != nil {
+		return "", err
+	}
+
+	return llm.ResolveImagePaths(string(content), absDir), nil
+}
+
+// LoadMessages returns a conversation as messages for llm.NewMessageStream.
+// It is equivalent to packing the conversation and parsing it with
+// llm.BuildMessages, without the round trip through the tag format: only
+// the first system message is kept and image attachments are loaded.
+func LoadMessages(convDir string) ([]llm.Message, error) {
+	return loadMessages(convDir, false)
+}
+
+// LoadMergedMessages is LoadMessages with consecutive messages from the
+// same author joined by newlines, like PackConversation with merge.
+func LoadMergedMessages(convDir string) ([]llm.Message, error) {
+	return loadMessages(convDir, true)
+}
+
+func loadMessages(convDir string, merge bool) ([]llm.Message, error) {
+	groups, err := groupMessages(convDir, merge)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []llm.Message
+	hasSystem := false
+	for _, group := range groups {
+		role := group[0].Role
+		if role == RoleSystem {
+			if hasSystem {
+				log.Printf("WARNING: conversation %s has more than one system message. Only the first is used.", convDir)
+				continue
 			}
+			hasSystem = true
+		}
 
-			file, err := os.Open(msg.Path)
+		contents := make([]string, len(group))
+		for i, msg := range group {
+			content, err := readMessageContent(convDir, msg.Path)
 			if err != nil {
-				return fmt.Errorf("failed to open message file %s: %w", msg.Path, err)
+				return nil, err
 			}
-			if err := escaping.Escape(file, writer); err != nil {
-				file.Close()
-				return err
-			}
-			file.Close()
+			contents[i] = content
+		}
 
-			if _, err := fmt.Fprintf(writer, "</hnt-%s>\n", msg.Role); err != nil {
-				return err
-			}
+		message, err := llm.NewMessage(string(role), strings.Join(contents, "\n"))
+		if err != nil {
+			return nil, err
 		}
+		messages = append(messages, message)
 	}
 
-	return nil
+	return messages, nil
+}
+
+// AddAttachment copies a file into the conversation's attachments directory
+// and returns an <hnt-image> reference to it.
+func AddAttachment(convDir string, srcPath string) (string, error) {
+	data, err := os.ReadFile(srcPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read attachment: %w", err)
+	}
+	if len(data) > llm.MaxImageBytes {
+		return "", fmt.Errorf("attachment %s is %d bytes, larger than the %d byte limit", srcPath, len(data), llm.MaxImageBytes)
+	}
+
+	attachDir := filepath.Join(convDir, "attachments")
+	if err := os.MkdirAll(attachDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create attachments directory: %w", err)
+	}
+
+	name := fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(srcPath))
+	if err := os.WriteFile(filepath.Join(attachDir, name), data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write attachment: %w", err)
+	}
+
+	return fmt.Sprintf(`<hnt-image path="%s">`, filepath.Join("attachments", name)), nil
 }
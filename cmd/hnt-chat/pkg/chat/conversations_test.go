@@ -0,0 +1,105 @@
+package chat
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/llm"
+)
+
+func writeTestConversation(t *testing.T) string {
+	t.Helper()
+	convDir := t.TempDir()
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	imgPath := filepath.Join(t.TempDir(), "shot.png")
+	if err := os.WriteFile(imgPath, img.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ref, err := AddAttachment(convDir, imgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"100-system.md", "Be brief."},
+		{"200-user.md", "Why does </hnt-user> break things?"},
+		{"300-user.md", "Also see " + ref},
+		{"400-assistant-reasoning.md", "<think>hmm</think>"},
+		{"500-assistant.md", "It does not.\n"},
+		{"600-system.md", "A second system prompt."},
+		{"700-user.md", ""},
+	}
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(convDir, f.name), []byte(f.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return convDir
+}
+
+// LoadMessages must give the same result as the pack-then-parse path it
+// replaces.
+func TestLoadMessagesMatchesPack(t *testing.T) {
+	convDir := writeTestConversation(t)
+
+	for _, merge := range []bool{false, true} {
+		var packed bytes.Buffer
+		if err := PackConversation(convDir, &packed, merge); err != nil {
+			t.Fatal(err)
+		}
+		want, err := llm.BuildMessages(packed.String(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		load := LoadMessages
+		if merge {
+			load = LoadMergedMessages
+		}
+		got, err := load(convDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("merge=%v: expected %+v, got %+v", merge, want, got)
+		}
+	}
+}
+
+func TestLoadMessages(t *testing.T) {
+	convDir := writeTestConversation(t)
+
+	messages, err := LoadMergedMessages(convDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roles := make([]string, len(messages))
+	for i, m := range messages {
+		roles[i] = m.Role
+	}
+	if want := []string{"system", "user", "assistant", "user"}; !reflect.DeepEqual(roles, want) {
+		t.Fatalf("Expected roles %v, got %v", want, roles)
+	}
+
+	user := messages[1]
+	if len(user.Parts) != 2 || user.Parts[1].ImageURL == nil {
+		t.Errorf("Expected merged text and an image part, got %+v", user.Parts)
+	}
+	if user.Parts[0].Text != "Why does </hnt-user> break things?\nAlso see " {
+		t.Errorf("Expected unescaped merged text, got %q", user.Parts[0].Text)
+	}
+}
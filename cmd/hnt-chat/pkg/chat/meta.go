@@ -0,0 +1,141 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/llm"
+)
+
+const metaSuffix = ".meta.json"
+
+// MessageMeta is the sidecar written next to a generated message, e.g.
+// 1752...-assistant.md -> 1752...-assistant.meta.json.
+type MessageMeta struct {
+	Model string `json:"model,omitempty"`
+	// Key names the API key that was used, e.g. "openrouter:work".
+	Key   string     `json:"key,omitempty"`
+	Usage *llm.Usage `json:"usage,omitempty"`
+	// FinishReason is set when the provider reported why the generation
+	// ended, e.g. "length" for a truncated answer.
+	FinishReason string `json:"finish_reason,omitempty"`
+	// Interrupted is set when the user stopped the generation, so that the
+	// message is only the start of an answer.
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
+// MetaPath returns the sidecar path for a message file name or path.
+func MetaPath(convDir, messageFile string) string {
+	return filepath.Join(convDir, strings.TrimSuffix(filepath.Base(messageFile), ".md")+metaSuffix)
+}
+
+func WriteMessageMeta(convDir, messageFile string, meta MessageMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(MetaPath(convDir, messageFile), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write message metadata: %w", err)
+	}
+	return nil
+}
+
+// WriteModel records the model, alias or fallback chain requested for the
+// conversation in its model.txt.
+func WriteModel(convDir, model string) error {
+	if err := os.WriteFile(filepath.Join(convDir, "model.txt"), []byte(model), 0644); err != nil {
+		return fmt.Errorf("failed to write model file: %w", err)
+	}
+	return nil
+}
+
+// ListMessageMeta reads every sidecar in a conversation, oldest first. This
+// includes sidecars of archived messages, since those generations were
+// still paid for.
+func ListMessageMeta(convDir string) ([]MessageMeta, error) {
+	entries, err := os.ReadDir(convDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), metaSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var metas []MessageMeta
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(convDir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		var meta MessageMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+		metas = append(metas, meta)
+	}
+
+	return metas, nil
+}
+
+const paramsFile = "params.json"
+
+// ReadParams loads the generation parameters saved with a conversation. A
+// conversation without params.json has none.
+func ReadParams(convDir string) (llm.Params, error) {
+	var params llm.Params
+
+	data, err := os.ReadFile(filepath.Join(convDir, paramsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return params, nil
+		}
+		return params, err
+	}
+
+	if err := json.Unmarshal(data, &params); err != nil {
+		return params, fmt.Errorf("failed to parse %s: %w", paramsFile, err)
+	}
+	return params, params.Validate()
+}
+
+func WriteParams(convDir string, params llm.Params) error {
+	data, err := json.MarshalIndent(params, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filepath.Join(convDir, paramsFile), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write params file: %w", err)
+	}
+	return nil
+}
+
+// ResolveParams merges the parameters given on the command line over the
+// saved ones and saves the result when anything was given, so that later
+// generations in the conversation reuse them.
+func ResolveParams(convDir string, override llm.Params) (llm.Params, error) {
+	saved, err := ReadParams(convDir)
+	if err != nil {
+		return saved, err
+	}
+	if override.IsZero() {
+		return saved, nil
+	}
+
+	params := saved.Merge(override)
+	if err := WriteParams(convDir, params); err != nil {
+		return params, err
+	}
+	return params, nil
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/veilm/hinata/cmd/hnt-edit/pkg/edit"
+	"github.com/veilm/hinata/pkg/paramflags"
 	"github.com/veilm/hinata/pkg/terminal"
 )
 
@@ -14,6 +15,7 @@ func main() {
 	terminal.EnsureCompatibleTerm()
 
 	var opts edit.Options
+	var paramFlags *paramflags.ParamFlags
 
 	var rootCmd = &cobra.Command{
 		Use:   "hnt-edit [source files...]",
@@ -23,6 +25,11 @@ func main() {
 Example: hnt-edit -m 'Refactor foo function' src/main.py src/utils.py`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			opts.SourceFiles = args
+			params, err := paramFlags.Params()
+			if err != nil {
+				return err
+			}
+			opts.Params = params
 			return edit.Run(opts)
 		},
 		SilenceUsage:  true,
@@ -31,13 +38,15 @@ Example: hnt-edit -m 'Refactor foo function' src/main.py src/utils.py`,
 
 	rootCmd.Flags().StringVarP(&opts.System, "system", "s", "", "System message string or path to system message file")
 	rootCmd.Flags().StringVarP(&opts.Message, "message", "m", "", "User instruction message. If not provided, $EDITOR will be opened")
-	rootCmd.Flags().StringVar(&opts.Model, "model", "", "Model to use for LLM")
+	rootCmd.Flags().StringVar(&opts.Model, "model", "", "Model to use for LLM (comma-separated for a fallback chain)")
 	rootCmd.Flags().StringVar(&opts.ContinueDir, "continue-dir", "", "Path to an existing hnt-chat conversation directory to continue from a failed edit")
 	rootCmd.Flags().BoolVar(&opts.UseEditor, "use-editor", false, "Use an external editor ($EDITOR) for the user instruction message")
 	rootCmd.Flags().BoolVar(&opts.Stdin, "stdin", false, "Read user instruction message from stdin")
 	rootCmd.Flags().BoolVar(&opts.IgnoreReasoning, "ignore-reasoning", false, "Do not ask the LLM for reasoning")
 	rootCmd.Flags().BoolVarP(&opts.Verbose, "verbose", "v", false, "Enable verbose logging")
 	rootCmd.Flags().BoolVar(&opts.DebugUnsafe, "debug-unsafe", false, "Enable unsafe debugging options")
+	rootCmd.Flags().IntVar(&opts.MaxContinuations, "max-continuations", 0, "Continue a response cut off by the token limit up to this many times (default from the config file, -1 to disable)")
+	paramFlags = paramflags.Add(rootCmd.Flags())
 
 	// Note: --use-pane is not implemented as requested
 
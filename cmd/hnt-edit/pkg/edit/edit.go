@@ -12,22 +12,29 @@ import (
 	"github.com/charmbracelet/lipgloss"
 	"github.com/veilm/hinata/cmd/hnt-apply/pkg/apply"
 	"github.com/veilm/hinata/cmd/hnt-chat/pkg/chat"
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/escaping"
 	"github.com/veilm/hinata/cmd/hnt-llm/pkg/llm"
 	"github.com/veilm/hinata/cmd/llm-pack/pkg/pack"
 	"github.com/veilm/hinata/pkg/prompt"
 )
 
 type Options struct {
-	System          string
-	Message         string
-	SourceFiles     []string
-	Model           string
+	System      string
+	Message     string
+	SourceFiles []string
+	Model       string
+	// Params override the generation parameters saved with the
+	// conversation.
+	Params          llm.Params
 	ContinueDir     string
 	UseEditor       bool
 	Stdin           bool
 	IgnoreReasoning bool
 	Verbose         bool
 	DebugUnsafe     bool
+	// MaxContinuations overrides how often a response cut off by the token
+	// limit is continued, see llm.Config.
+	MaxContinuations int
 }
 
 type CreatedFilesGuard struct {
@@ -365,15 +372,19 @@ func Run(opts Options) error {
 		if model == "" {
 			model = os.Getenv("HINATA_MODEL")
 			if model == "" {
-				model = "openrouter/google/gemini-2.5-pro"
+				model = llm.DefaultModel("openrouter/google/gemini-2.5-pro")
 			}
 		}
 	}
 
-	// Pack conversation for LLM
-	var packedConv strings.Builder
-	if err := chat.PackConversation(conversationDir, &packedConv, true); err != nil {
-		return fmt.Errorf("failed to pack conversation: %w", err)
+	messages, err := chat.LoadMergedMessages(conversationDir)
+	if err != nil {
+		return fmt.Errorf("failed to load conversation: %w", err)
+	}
+
+	params, err := chat.ResolveParams(conversationDir, opts.Params)
+	if err != nil {
+		return err
 	}
 
 	// Stream LLM response
@@ -381,53 +392,82 @@ func Run(opts Options) error {
 		Model:            model,
 		SystemPrompt:     "",
 		IncludeReasoning: !opts.IgnoreReasoning || opts.DebugUnsafe,
+		Params:           params,
+		MaxContinuations: opts.MaxContinuations,
 	}
 
-	ctx := context.Background()
-	eventChan, errChan := llm.StreamLLMResponse(ctx, config, packedConv.String())
+	// Ctrl-C stops the generation. The partial answer is saved, but its
+	// edits are not applied.
+	ctx, stop := llm.InterruptContext(context.Background())
+	defer stop()
+	stream := llm.NewMessageStream(ctx, config, messages)
 
 	var contentBuffer strings.Builder
 	var reasoningBuffer strings.Builder
+	var usage *llm.Usage
+	answeredModel := model
+	usedKey := ""
 	inReasoningBlock := false
 
-	for {
-		select {
-		case event, ok := <-eventChan:
-			if !ok {
-				goto done
-			}
+	for stream.Next() {
+		event := stream.Event()
 
-			if event.Content != "" {
-				if inReasoningBlock {
-					// End reasoning block with proper spacing
-					trailing := 0
-					for i := len(reasoningBuffer.String()) - 1; i >= 0 && reasoningBuffer.String()[i] == '\n'; i-- {
-						trailing++
-					}
-					for i := 0; i < 2-trailing; i++ {
-						fmt.Println()
-					}
-					inReasoningBlock = false
+		if event.Content != "" {
+			if inReasoningBlock {
+				// End reasoning block with proper spacing
+				trailing := 0
+				for i := len(reasoningBuffer.String()) - 1; i >= 0 && reasoningBuffer.String()[i] == '\n'; i-- {
+					trailing++
+				}
+				for i := 0; i < 2-trailing; i++ {
+					fmt.Println()
 				}
-				fmt.Print(event.Content)
-				contentBuffer.WriteString(event.Content)
+				inReasoningBlock = false
 			}
+			fmt.Print(event.Content)
+			contentBuffer.WriteString(event.Content)
+		}
 
-			if event.Reasoning != "" && !opts.IgnoreReasoning {
-				inReasoningBlock = true
-				// Print reasoning with yellow color without lipgloss padding
-				fmt.Print("\033[33m" + event.Reasoning + "\033[0m")
-				reasoningBuffer.WriteString(event.Reasoning)
-			}
+		if event.Reasoning != "" && !opts.IgnoreReasoning {
+			inReasoningBlock = true
+			// Print reasoning with yellow color without lipgloss padding
+			fmt.Print("\033[33m" + event.Reasoning + "\033[0m")
+			reasoningBuffer.WriteString(event.Reasoning)
+		}
 
-		case err := <-errChan:
-			if err != nil {
-				return fmt.Errorf("LLM stream error: %w", err)
+		if event.Usage != nil {
+			usage = event.Usage
+		}
+
+		if event.Model != "" {
+			answeredModel = event.Model
+			usedKey = event.Key
+		}
+
+		if event.Fallback != nil {
+			fmt.Fprintf(os.Stderr, "\n%s\n", event.Fallback)
+		}
+
+		if event.Retry != nil {
+			fmt.Fprintf(os.Stderr, "\nRetrying LLM request, %s\n", event.Retry)
+			if event.Retry.DiscardPartial {
+				contentBuffer.Reset()
+				reasoningBuffer.Reset()
+				inReasoningBlock = false
 			}
 		}
+
+		if event.Continuation != nil {
+			fmt.Fprintf(os.Stderr, "\n%s\n", event.Continuation)
+		}
+	}
+
+	streamErr := stream.Err()
+	interrupted := llm.Interrupted(ctx, streamErr)
+	if streamErr != nil && !interrupted {
+		return fmt.Errorf("LLM stream error: %w", streamErr)
 	}
 
-done:
 	if inReasoningBlock {
 		trailing := 0
 		for i := len(reasoningBuffer.String()) - 1; i >= 0 && reasoningBuffer.String()[i] == '\n'; i-- {
@@ -439,6 +479,18 @@ done:
 	}
 	fmt.Println()
 
+	finishReason := stream.FinishReason()
+	switch finishReason {
+	case llm.FinishLength:
+		fmt.Fprintln(os.Stderr, "Warning: the response was cut off by the token limit, so the last edit may be incomplete")
+	case llm.FinishContentFilter:
+		fmt.Fprintln(os.Stderr, "Warning: the response was stopped by the provider's content filter")
+	}
+
+	if interrupted && contentBuffer.Len() == 0 && reasoningBuffer.Len() == 0 {
+		return fmt.Errorf("interrupted before the model answered")
+	}
+
 	// Save messages
 	if !opts.IgnoreReasoning && reasoningBuffer.Len() > 0 {
 		reasoningMessage := fmt.Sprintf("<think>%s</think>", reasoningBuffer.String())
@@ -447,10 +499,17 @@ done:
 		}
 	}
 
-	if _, err := chat.WriteMessageFile(conversationDir, chat.RoleAssistant, contentBuffer.String()); err != nil {
+	assistantFile, err := chat.WriteMessageFile(conversationDir, chat.RoleAssistant, contentBuffer.String())
+	if err != nil {
 		return fmt.Errorf("failed to write assistant message: %w", err)
 	}
+	if err := chat.WriteMessageMeta(conversationDir, assistantFile, chat.MessageMeta{Model: answeredModel, Key: usedKey, Usage: usage, FinishReason: finishReason, Interrupted: interrupted}); err != nil {
+		return err
+	}
 
+	if interrupted {
+		return fmt.Errorf("interrupted; the partial response was saved to %s without applying it", conversationDir)
+	}
 	if strings.TrimSpace(contentBuffer.String()) == "" {
 		return fmt.Errorf("LLM produced no output. Aborting before running hnt-apply")
 	}
@@ -459,7 +518,7 @@ done:
 
 	// Run hnt-apply
 	if err := apply.ApplyChanges(sourceFiles, false, opts.IgnoreReasoning, opts.Verbose, contentBuffer.String()); err != nil {
-		failureMessage := fmt.Sprintf("<hnt_apply_error>\n%s</hnt_apply_error>", err)
+		failureMessage := fmt.Sprintf("<hnt_apply_error>\n%s</hnt_apply_error>", escaping.EscapeImages(err.Error()))
 		chat.WriteMessageFile(conversationDir, chat.RoleUser, failureMessage)
 		return fmt.Errorf("hnt-apply failed: %w", err)
 	}
@@ -478,6 +537,7 @@ func packFiles(paths []string) (string, error) {
 		return "", err
 	}
 
-	// Wrap in code fences
-	return fmt.Sprintf("```\n%s\n```", packed), nil
+	// Wrap in code fences. Image references in the sources are text, not
+	// attachments.
+	return fmt.Sprintf("```\n%s\n```", escaping.EscapeImages(packed)), nil
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/llm"
+)
+
+type batchFlags struct {
+	output      string
+	resume      bool
+	concurrency int
+	rates       []string
+}
+
+func handleBatch(args []string, flags batchFlags) error {
+	resolveModelFlag()
+
+	params, err := paramFlags.Params()
+	if err != nil {
+		return err
+	}
+
+	rates := make(map[string]float64)
+	for _, r := range flags.rates {
+		provider, value, ok := strings.Cut(r, "=")
+		perMinute, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil || perMinute <= 0 {
+			return fmt.Errorf("invalid --rate %q, expected provider=requests-per-minute", r)
+		}
+		rates[provider] = perMinute
+	}
+
+	in := io.Reader(os.Stdin)
+	if len(args) == 1 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	opts := llm.BatchOptions{
+		Config: llm.Config{
+			Model:            model,
+			SystemPrompt:     systemPrompt,
+			IncludeReasoning: includeReasoning,
+			Params:           params,
+			NoCache:          noCache,
+			KeyProfile:       keyProfile,
+			MaxContinuations: maxContinuations,
+		},
+		Concurrency: flags.concurrency,
+		RateLimits:  rates,
+	}
+
+	out := io.Writer(os.Stdout)
+	if flags.output != "" {
+		fileFlags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if flags.resume {
+			if opts.After, err = llm.ResumeBatchOutput(flags.output); err != nil {
+				return err
+			}
+			fileFlags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		f, err := os.OpenFile(flags.output, fileFlags, 0644)
+		if os.IsExist(err) {
+			return fmt.Errorf("%s already exists; pass --resume to continue it", flags.output)
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	} else if flags.resume {
+		return fmt.Errorf("--resume needs --output")
+	}
+
+	// After Ctrl-C, the results written so far are complete, so the batch
+	// can be continued with --resume.
+	ctx, stop := llm.InterruptContext(context.Background())
+	defer stop()
+
+	summary, err := llm.RunBatch(ctx, in, out, opts)
+	fmt.Fprintf(os.Stderr, "hnt-llm: %d succeeded, %d failed", summary.Succeeded, summary.Failed)
+	if summary.Skipped > 0 {
+		fmt.Fprintf(os.Stderr, ", %d already done", summary.Skipped)
+	}
+	fmt.Fprintf(os.Stderr, "; %d prompt and %d completion tokens\n", summary.Usage.PromptTokens, summary.Usage.CompletionTokens)
+	return err
+}
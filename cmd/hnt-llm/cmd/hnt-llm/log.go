@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/llm"
+)
+
+// lastRecords returns the last n records of the call log that match, oldest
+// first. n <= 0 returns all of them.
+func lastRecords(n int, match func(llm.LogRecord) bool) ([]llm.LogRecord, error) {
+	var records []llm.LogRecord
+	err := llm.ScanLog(func(r llm.LogRecord) error {
+		if match == nil || match(r) {
+			records = append(records, r)
+			if n > 0 && len(records) > n {
+				records = records[1:]
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
+func printRecords(records []llm.LogRecord) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tMODEL\tTOKENS\tLATENCY\tRESULT\tPROMPT")
+	for _, r := range records {
+		model := r.Model
+		if model == "" {
+			model = r.Requested
+		}
+		tokens := "-"
+		if r.Usage != nil {
+			tokens = fmt.Sprintf("%d/%d", r.Usage.PromptTokens, r.Usage.CompletionTokens)
+		}
+		result := r.FinishReason
+		if r.Error != "" {
+			result = "error: " + r.Error
+		}
+		latency := (time.Duration(r.LatencyMs) * time.Millisecond).Round(100 * time.Millisecond)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.ID, r.Time.Local().Format("2006-01-02 15:04:05"), model, tokens, latency, preview(result, 40), preview(lastUserMessage(r), 50))
+	}
+	return w.Flush()
+}
+
+func lastUserMessage(r llm.LogRecord) string {
+	for i := len(r.Messages) - 1; i >= 0; i-- {
+		if r.Messages[i].Role == "user" {
+			return r.Messages[i].Content
+		}
+	}
+	return ""
+}
+
+// preview is the start of s on one line.
+func preview(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len([]rune(s)) > n {
+		return string([]rune(s)[:n-1]) + "…"
+	}
+	return s
+}
+
+func handleLogList(n int) error {
+	records, err := lastRecords(n, nil)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		path, err := llm.LogPath()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "hnt-llm: no calls in %s; enable the log with %s=1 or \"log\": {\"enabled\": true} in the config file\n", path, llm.LogEnv)
+		return nil
+	}
+	return printRecords(records)
+}
+
+// handleLogShow prints the record whose ID starts with prefix, or the last
+// one, as indented JSON.
+func handleLogShow(args []string) error {
+	var found *llm.LogRecord
+	var matches int
+	err := llm.ScanLog(func(r llm.LogRecord) error {
+		if len(args) == 0 || strings.HasPrefix(r.ID, args[0]) {
+			found = &r
+			matches++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	switch {
+	case found == nil && len(args) == 0:
+		return fmt.Errorf("the call log is empty")
+	case found == nil:
+		return fmt.Errorf("no call with ID %s", args[0])
+	case matches > 1 && len(args) > 0:
+		return fmt.Errorf("%d calls have IDs starting with %s", matches, args[0])
+	}
+
+	data, err := json.MarshalIndent(found, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// handleLogGrep lists the calls whose messages, output, reasoning or error
+// match pattern.
+func handleLogGrep(pattern string, ignoreCase bool, n int) error {
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+
+	records, err := lastRecords(n, func(r llm.LogRecord) bool {
+		for _, m := range r.Messages {
+			if re.MatchString(m.Content) {
+				return true
+			}
+		}
+		return re.MatchString(r.Output) || re.MatchString(r.Reasoning) || re.MatchString(r.Error)
+	})
+	if err != nil {
+		return err
+	}
+	return printRecords(records)
+}
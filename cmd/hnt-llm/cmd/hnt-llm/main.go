@@ -1,15 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/veilm/hinata/cmd/hnt-llm/pkg/keymanagement"
 	"github.com/veilm/hinata/cmd/hnt-llm/pkg/llm"
+	"github.com/veilm/hinata/pkg/paramflags"
+	"golang.org/x/term"
 )
 
 type OutputPhase int
@@ -25,79 +33,222 @@ var (
 	model            string
 	includeReasoning bool
 	debugUnsafe      bool
+	paramFlags       *paramflags.ParamFlags
+	noCache          bool
+	jsonSchemaPath   string
+	keyProfile       string
+	inputFormat      string
+	outputFormat     string
+	maxContinuations int
 )
 
-func doGenerate(cmd *cobra.Command, args []string) error {
+// resolveModelFlag falls back to the environment and then the default
+// when --model is not given.
+func resolveModelFlag() {
 	if model == "" {
 		model = os.Getenv("HINATA_LLM_MODEL")
 		if model == "" {
 			model = os.Getenv("HINATA_MODEL")
 			if model == "" {
-				model = "openrouter/google/gemini-2.5-flash"
+				model = llm.DefaultModel("openrouter/google/gemini-2.5-flash")
 			}
 		}
 	}
+}
+
+func doGenerate(cmd *cobra.Command, args []string) error {
+	resolveModelFlag()
+
+	if outputFormat != "text" && outputFormat != "ndjson" {
+		return fmt.Errorf("invalid --output-format %q, expected text or ndjson", outputFormat)
+	}
 
 	stdinContent, err := io.ReadAll(os.Stdin)
 	if err != nil {
 		return err
 	}
 
+	// --system takes precedence over a system message in the input.
+	var messages []llm.Message
+	switch inputFormat {
+	case "text":
+		messages, err = llm.BuildMessages(string(stdinContent), systemPrompt)
+	case "json":
+		messages, err = llm.ParseMessagesJSON(stdinContent)
+		if err == nil && systemPrompt != "" {
+			messages = llm.ReplaceSystemPrompt(messages, systemPrompt)
+		}
+	default:
+		err = fmt.Errorf("invalid --input-format %q, expected text or json", inputFormat)
+	}
+	if err != nil {
+		return err
+	}
+
+	params, err := paramFlags.Params()
+	if err != nil {
+		return err
+	}
+
 	config := llm.Config{
 		Model:            model,
-		SystemPrompt:     systemPrompt,
 		IncludeReasoning: includeReasoning,
+		Params:           params,
+		NoCache:          noCache,
+		KeyProfile:       keyProfile,
+		MaxContinuations: maxContinuations,
 	}
 
-	ctx := context.Background()
-	eventChan, errChan := llm.StreamLLMResponse(ctx, config, string(stdinContent))
+	// Ctrl-C stops the request; what was printed so far stays printed.
+	ctx, stop := llm.InterruptContext(context.Background())
+	defer stop()
+
+	if jsonSchemaPath != "" {
+		return generateStructured(ctx, config, messages)
+	}
+
+	stream := llm.NewMessageStream(ctx, config, messages)
+	if outputFormat == "ndjson" {
+		return writeNDJSON(stream)
+	}
+
+	// A restarted attempt generates the whole answer again. That is fine
+	// on a terminal, where a note explains it, but a pipe would receive
+	// the partial text and then the full answer, so each attempt is held
+	// back until it is known not to be restarted.
+	policy, err := config.RetryPolicy()
+	if err != nil {
+		return err
+	}
+	restartable := policy.OnPartial == llm.PartialRestart && !term.IsTerminal(int(os.Stdout.Fd()))
+	if err := writeText(stream, os.Stdout, restartable); err != nil {
+		return err
+	}
+
+	warnIfTruncated(stream.FinishReason())
+	return nil
+}
+
+// writeText prints the content of stream, and its reasoning with
+// --include-reasoning. With bufferAttempts, nothing is written until the
+// stream ends, and the output of attempts that are restarted is dropped.
+func writeText(stream *llm.Stream, w io.Writer, bufferAttempts bool) error {
+	out := w
+	var attempt bytes.Buffer
+	if bufferAttempts {
+		out = &attempt
+	}
 
 	phase := PhaseInit
 	thinkTagPrinted := false
 
-	for {
-		select {
-		case event, ok := <-eventChan:
-			if !ok {
+	for stream.Next() {
+		event := stream.Event()
+
+		if event.Content != "" {
+			if phase == PhaseInit {
+				phase = PhaseResponding
+			}
+			if phase == PhaseThinking {
+				phase = PhaseResponding
 				if thinkTagPrinted {
-					fmt.Print("</think>\n")
+					fmt.Fprint(out, "</think>\n")
+					thinkTagPrinted = false
 				}
-				return nil
 			}
+			fmt.Fprint(out, event.Content)
+		}
 
-			if event.Content != "" {
-				if phase == PhaseInit {
-					phase = PhaseResponding
-				}
-				if phase == PhaseThinking {
-					phase = PhaseResponding
-					if thinkTagPrinted {
-						fmt.Print("</think>\n")
-						thinkTagPrinted = false
-					}
+		if event.Fallback != nil {
+			fmt.Fprintf(os.Stderr, "hnt-llm: %s\n", event.Fallback)
+		}
+
+		if event.Retry != nil {
+			fmt.Fprintf(os.Stderr, "hnt-llm: retrying, %s\n", event.Retry)
+			if event.Retry.DiscardPartial {
+				if bufferAttempts {
+					attempt.Reset()
+					phase, thinkTagPrinted = PhaseInit, false
+				} else {
+					fmt.Fprintln(os.Stderr, "hnt-llm: the partial output above will be generated again")
 				}
-				fmt.Print(event.Content)
 			}
+		}
 
-			if event.Reasoning != "" && includeReasoning {
-				if phase == PhaseInit {
-					phase = PhaseThinking
-					if !thinkTagPrinted {
-						fmt.Print("<think>")
-						thinkTagPrinted = true
-					}
-				}
-				if phase == PhaseThinking {
-					fmt.Print(event.Reasoning)
+		if event.Continuation != nil {
+			fmt.Fprintf(os.Stderr, "\nhnt-llm: %s\n", event.Continuation)
+		}
+
+		if event.Reasoning != "" && includeReasoning {
+			if phase == PhaseInit {
+				phase = PhaseThinking
+				if !thinkTagPrinted {
+					fmt.Fprint(out, "<think>")
+					thinkTagPrinted = true
 				}
 			}
-
-		case err := <-errChan:
-			if err != nil {
-				return err
+			if phase == PhaseThinking {
+				fmt.Fprint(out, event.Reasoning)
 			}
 		}
 	}
+
+	if thinkTagPrinted {
+		fmt.Fprint(out, "</think>\n")
+	}
+	// The last attempt is kept even if it failed, as without buffering.
+	if bufferAttempts {
+		if _, err := w.Write(attempt.Bytes()); err != nil {
+			return err
+		}
+	}
+	return stream.Err()
+}
+
+// warnIfTruncated tells the user on stderr when the answer did not end
+// normally, since the output itself looks complete.
+func warnIfTruncated(finishReason string) {
+	switch finishReason {
+	case llm.FinishLength:
+		fmt.Fprintln(os.Stderr, "hnt-llm: the response was cut off by the token limit")
+	case llm.FinishContentFilter:
+		fmt.Fprintln(os.Stderr, "hnt-llm: the response was stopped by the provider's content filter")
+	}
+}
+
+// generateStructured prints the response only once it has been validated
+// against the --json-schema schema, so that it can be piped into jq.
+func generateStructured(ctx context.Context, config llm.Config, messages []llm.Message) error {
+	schema, err := os.ReadFile(jsonSchemaPath)
+	if err != nil {
+		return fmt.Errorf("failed to read JSON schema: %w", err)
+	}
+	config.ResponseSchema = schema
+
+	result, err := llm.GenerateStructured(ctx, config, messages, func(event llm.StreamEvent) {
+		if event.Fallback != nil {
+			fmt.Fprintf(os.Stderr, "hnt-llm: %s\n", event.Fallback)
+		}
+		if event.Retry != nil {
+			fmt.Fprintf(os.Stderr, "hnt-llm: retrying, %s\n", event.Retry)
+		}
+	})
+	if err != nil {
+		if outputFormat == "ndjson" {
+			return writeError(err)
+		}
+		return err
+	}
+
+	if result.Attempts > 1 {
+		fmt.Fprintf(os.Stderr, "hnt-llm: valid JSON after %d attempts\n", result.Attempts)
+	}
+	if outputFormat == "ndjson" {
+		writeStructuredNDJSON(result)
+		return nil
+	}
+	fmt.Println(result.JSON)
+	return nil
 }
 
 func main() {
@@ -116,8 +267,13 @@ func main() {
 		SilenceErrors: true,
 	}
 
-	rootCmd.PersistentFlags().StringVarP(&model, "model", "m", "", "The model to use for the LLM")
+	rootCmd.PersistentFlags().StringVarP(&model, "model", "m", "", "The model to use for the LLM (comma-separated for a fallback chain)")
 	rootCmd.PersistentFlags().BoolVar(&debugUnsafe, "debug-unsafe", false, "Enable unsafe debugging options")
+	paramFlags = paramflags.Add(rootCmd.PersistentFlags())
+	rootCmd.PersistentFlags().BoolVar(&noCache, "no-cache", false, "Bypass the response cache")
+	rootCmd.PersistentFlags().StringVar(&jsonSchemaPath, "json-schema", "", "Require a JSON response matching the schema in this file")
+	rootCmd.PersistentFlags().IntVar(&maxContinuations, "max-continuations", 0, "Continue a response cut off by the token limit up to this many times (default from the config file, -1 to disable)")
+	rootCmd.PersistentFlags().StringVar(&keyProfile, "key", "", "Use the saved key PROVIDER:NAME for each provider (or a single PROVIDER:NAME)")
 
 	rootCmd.Flags().StringVarP(&systemPrompt, "system", "s", "", "The system prompt to use")
 	rootCmd.Flags().BoolVar(&includeReasoning, "include-reasoning", false, "Include reasoning in the output")
@@ -131,15 +287,22 @@ func main() {
 	genCmd.Flags().StringVarP(&systemPrompt, "system", "s", "", "The system prompt to use")
 	genCmd.Flags().BoolVar(&includeReasoning, "include-reasoning", false, "Include reasoning in the output")
 
+	for _, c := range []*cobra.Command{rootCmd, genCmd} {
+		c.Flags().StringVar(&inputFormat, "input-format", "text", "Format of stdin: text (hnt tags) or json (an OpenAI messages array, or JSONL of messages)")
+		c.Flags().StringVar(&outputFormat, "output-format", "text", "Format of stdout: text, or ndjson for one typed JSON event per line")
+	}
+
+	var keyCommand string
 	var saveKeyCmd = &cobra.Command{
-		Use:          "save-key [provider]",
+		Use:          "save-key [provider[:name]]",
 		Short:        "Save an API key for a service",
 		Args:         cobra.ExactArgs(1),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return keymanagement.HandleSaveKey(args[0])
+			return keymanagement.HandleSaveKey(args[0], keyCommand)
 		},
 	}
+	saveKeyCmd.Flags().StringVar(&keyCommand, "command", "", "Get the key from this shell command's output instead (e.g. 'pass show openrouter')")
 
 	var listKeysCmd = &cobra.Command{
 		Use:          "list-keys",
@@ -151,7 +314,7 @@ func main() {
 	}
 
 	var deleteKeyCmd = &cobra.Command{
-		Use:          "delete-key [provider]",
+		Use:          "delete-key [provider[:name]]",
 		Short:        "Delete a saved API key",
 		Args:         cobra.ExactArgs(1),
 		SilenceUsage: true,
@@ -160,10 +323,261 @@ func main() {
 		},
 	}
 
-	rootCmd.AddCommand(genCmd, saveKeyCmd, listKeysCmd, deleteKeyCmd)
+	var unlockTimeout time.Duration
+	var unlockCmd = &cobra.Command{
+		Use:          "unlock",
+		Short:        "Unlock passphrase-protected API keys for a while",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return keymanagement.HandleUnlock(unlockTimeout)
+		},
+	}
+	unlockCmd.Flags().DurationVar(&unlockTimeout, "timeout", keymanagement.DefaultUnlockTimeout, "How long the keys stay unlocked")
+
+	var lockCmd = &cobra.Command{
+		Use:          "lock",
+		Short:        "Lock passphrase-protected API keys again",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return keymanagement.HandleLock()
+		},
+	}
+
+	var removePassphrase bool
+	var setPassphraseCmd = &cobra.Command{
+		Use:          "set-passphrase",
+		Short:        "Protect saved API keys with a passphrase",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return keymanagement.HandleSetPassphrase(removePassphrase)
+		},
+	}
+	setPassphraseCmd.Flags().BoolVar(&removePassphrase, "remove", false, "Remove the passphrase and go back to the local key")
+
+	var cacheCmd = &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the response cache",
+	}
+
+	var cacheStatsCmd = &cobra.Command{
+		Use:          "stats",
+		Short:        "Show the size of the response cache",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return handleCacheStats()
+		},
+	}
+
+	var cacheClearCmd = &cobra.Command{
+		Use:          "clear",
+		Short:        "Delete all cached responses",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			removed, err := llm.ClearCache()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Removed %d cached responses\n", removed)
+			return nil
+		},
+	}
+
+	cacheCmd.AddCommand(cacheStatsCmd, cacheClearCmd)
+
+	var refreshModels bool
+	var modelsCmd = &cobra.Command{
+		Use:          "models [provider]",
+		Short:        "List the models of a provider, or of all providers, and the aliases",
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return handleModels(args, refreshModels)
+		},
+	}
+	modelsCmd.Flags().BoolVar(&refreshModels, "refresh", false, "Fetch the lists again instead of using the cached ones")
+
+	var batchOpts batchFlags
+	var batchCmd = &cobra.Command{
+		Use:          "batch [input.jsonl]",
+		Short:        "Run one request per line of a JSONL file and write JSONL results in order",
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return handleBatch(args, batchOpts)
+		},
+	}
+	batchCmd.Flags().StringVarP(&batchOpts.output, "output", "o", "", "Write results to this file instead of stdout")
+	batchCmd.Flags().BoolVar(&batchOpts.resume, "resume", false, "Continue an interrupted batch, skipping the rows already in --output")
+	batchCmd.Flags().IntVarP(&batchOpts.concurrency, "concurrency", "j", 4, "Number of requests in flight")
+	batchCmd.Flags().StringArrayVar(&batchOpts.rates, "rate", nil, "Requests per minute for a provider, as provider=N (repeatable)")
+	batchCmd.Flags().StringVarP(&systemPrompt, "system", "s", "", "The default system prompt")
+	batchCmd.Flags().BoolVar(&includeReasoning, "include-reasoning", false, "Include reasoning in the results")
+
+	var serveOpts serveFlags
+	var serveCmd = &cobra.Command{
+		Use:          "serve",
+		Short:        "Serve an OpenAI-compatible API that uses the saved keys and providers",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return handleServe(serveOpts)
+		},
+	}
+	serveCmd.Flags().StringVar(&serveOpts.listen, "listen", "127.0.0.1:8741", "Address to listen on")
+	serveCmd.Flags().StringVar(&serveOpts.token, "token", "", "Bearer token clients must send (default $"+serveTokenEnv+", or a generated one)")
+	serveCmd.Flags().StringVar(&serveOpts.auditLog, "audit-log", "", "Append a JSON line per request to this file, or - for none (default $XDG_DATA_HOME/hinata/llm/serve.jsonl)")
+
+	var logLimit int
+	var logCmd = &cobra.Command{
+		Use:          "log",
+		Short:        "Inspect the call log",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return handleLogList(logLimit)
+		},
+	}
+	logCmd.PersistentFlags().IntVarP(&logLimit, "limit", "n", 20, "Show at most this many calls, the most recent (0 for all)")
+
+	var logListCmd = &cobra.Command{
+		Use:          "list",
+		Short:        "List the most recent calls",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return handleLogList(logLimit)
+		},
+	}
+
+	var logShowCmd = &cobra.Command{
+		Use:          "show [id]",
+		Short:        "Print a call in full, by ID prefix, or the last call",
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return handleLogShow(args)
+		},
+	}
+
+	var grepIgnoreCase bool
+	var logGrepCmd = &cobra.Command{
+		Use:          "grep <pattern>",
+		Short:        "List the calls whose messages, output or error match a regular expression",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return handleLogGrep(args[0], grepIgnoreCase, logLimit)
+		},
+	}
+	logGrepCmd.Flags().BoolVarP(&grepIgnoreCase, "ignore-case", "i", false, "Match case-insensitively")
+
+	logCmd.AddCommand(logListCmd, logShowCmd, logGrepCmd)
+
+	rootCmd.AddCommand(genCmd, saveKeyCmd, listKeysCmd, deleteKeyCmd, unlockCmd, lockCmd, setPassphraseCmd, cacheCmd, modelsCmd, batchCmd, serveCmd, logCmd)
 
 	if err := rootCmd.Execute(); err != nil {
+		if errors.Is(err, context.Canceled) {
+			fmt.Fprintln(os.Stderr, "\nhnt-llm: interrupted")
+			os.Exit(130)
+		}
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
+
+// handleModels prints a table of models. Without a provider, providers
+// whose list cannot be fetched (usually for lack of a key) are skipped.
+func handleModels(args []string, refresh bool) error {
+	var providers []string
+	if len(args) == 1 {
+		providers = args
+	} else {
+		all, err := llm.AllProviders()
+		if err != nil {
+			return err
+		}
+		for _, p := range all {
+			providers = append(providers, p.Name)
+		}
+	}
+
+	config := llm.Config{KeyProfile: keyProfile}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODEL\tCONTEXT\tPROMPT $/M\tCOMPLETION $/M")
+	for _, name := range providers {
+		models, err := llm.FetchModels(context.Background(), config, name, refresh)
+		if err != nil {
+			if len(args) == 1 {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "hnt-llm: skipping %s: %v\n", name, err)
+			continue
+		}
+
+		for _, m := range models {
+			id := name + "/" + m.ID
+			contextLength, prompt, completion := "-", "-", "-"
+			if m.ContextLength > 0 {
+				contextLength = strconv.Itoa(m.ContextLength)
+			}
+			price := m.Price
+			if price == nil {
+				if p, ok := llm.LookupPrice(id); ok {
+					price = &p
+				}
+			}
+			if price != nil {
+				prompt = strconv.FormatFloat(price.Prompt, 'f', -1, 64)
+				completion = strconv.FormatFloat(price.Completion, 'f', -1, 64)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", id, contextLength, prompt, completion)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		s, err := llm.LoadSettings()
+		if err != nil {
+			return err
+		}
+		if len(s.Aliases) > 0 {
+			fmt.Println("\nAliases:")
+			names := make([]string, 0, len(s.Aliases))
+			for alias := range s.Aliases {
+				names = append(names, alias)
+			}
+			sort.Strings(names)
+			for _, alias := range names {
+				fmt.Printf("  %s = %s\n", alias, s.Aliases[alias])
+			}
+		}
+	}
+	return nil
+}
+
+func handleCacheStats() error {
+	stats, err := llm.GetCacheStats()
+	if err != nil {
+		return err
+	}
+
+	enabled := "no"
+	if stats.Enabled {
+		enabled = "yes"
+	}
+
+	fmt.Printf("Directory: %s\n", stats.Dir)
+	fmt.Printf("Enabled:   %s\n", enabled)
+	fmt.Printf("Entries:   %d (%d expired)\n", stats.Entries, stats.Expired)
+	fmt.Printf("Size:      %.1f KiB\n", float64(stats.Bytes)/1024)
+	if stats.Entries > 0 {
+		fmt.Printf("Oldest:    %s\n", stats.Oldest.Format("2006-01-02 15:04:05"))
+		fmt.Printf("Newest:    %s\n", stats.Newest.Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
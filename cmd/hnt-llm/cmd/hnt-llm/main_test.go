@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/llm"
+)
+
+// TestWriteTextRestartPiped checks that output which is not a terminal
+// gets the restarted answer once, without the partial text before it.
+func TestWriteTextRestartPiped(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv("HINATA_LLM_CONFIG", filepath.Join(t.TempDir(), "none.json"))
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Content-Length", "1000")
+			fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\n")
+			return
+		}
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	saved := llm.Providers
+	llm.Providers = append(append([]llm.Provider{}, llm.Providers...), llm.Provider{Name: "testmain", ApiURL: server.URL, NoAuth: true})
+	t.Cleanup(func() { llm.Providers = saved })
+
+	config := llm.Config{
+		Model:   "testmain/m",
+		NoCache: true,
+		Retry: &llm.RetryPolicy{
+			MaxAttempts:  2,
+			InitialDelay: time.Millisecond,
+			MaxDelay:     time.Millisecond,
+			OnPartial:    llm.PartialRestart,
+		},
+	}
+	stream := llm.NewMessageStream(context.Background(), config, []llm.Message{{Role: "user", Content: "hi"}})
+	defer stream.Close()
+
+	var out bytes.Buffer
+	if err := writeText(stream, &out, true); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Hello" || calls != 2 {
+		t.Errorf("Expected %q after 2 calls, got %q after %d calls", "Hello", out.String(), calls)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/llm"
+)
+
+// outputEvent is one line of --output-format ndjson. Type is model,
+// content, reasoning, retry, fallback, continuation, usage, finish or
+// error.
+type outputEvent struct {
+	Type  string `json:"type"`
+	Text  string `json:"text,omitempty"`
+	Model string `json:"model,omitempty"`
+	Key   string `json:"key,omitempty"`
+	// DiscardPartial is set on retry events when the text received so far
+	// will be generated again and must be dropped.
+	DiscardPartial bool `json:"discard_partial,omitempty"`
+	// Continuation counts the continuations of a response cut off by the
+	// token limit; the content that follows carries on from the last.
+	Continuation int        `json:"continuation,omitempty"`
+	Usage        *llm.Usage `json:"usage,omitempty"`
+	FinishReason string     `json:"finish_reason,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+var ndjsonEncoder = json.NewEncoder(os.Stdout)
+
+func writeEvent(ev outputEvent) {
+	ndjsonEncoder.Encode(ev)
+}
+
+// writeError reports err as an event and returns it, so that the exit
+// status still shows the failure.
+func writeError(err error) error {
+	msg := err.Error()
+	if errors.Is(err, context.Canceled) {
+		msg = "interrupted"
+	}
+	writeEvent(outputEvent{Type: "error", Error: msg})
+	return err
+}
+
+// writeNDJSON prints the events of stream as JSON lines. Reasoning is only
+// present with --include-reasoning.
+func writeNDJSON(stream *llm.Stream) error {
+	var usage *llm.Usage
+	for stream.Next() {
+		event := stream.Event()
+		switch {
+		case event.Model != "":
+			writeEvent(outputEvent{Type: "model", Model: event.Model, Key: event.Key})
+		case event.Retry != nil:
+			writeEvent(outputEvent{Type: "retry", Error: event.Retry.Err.Error(), DiscardPartial: event.Retry.DiscardPartial})
+		case event.Fallback != nil:
+			writeEvent(outputEvent{Type: "fallback", Model: event.Fallback.To, Error: event.Fallback.Err.Error()})
+		case event.Continuation != nil:
+			writeEvent(outputEvent{Type: "continuation", Continuation: event.Continuation.Number})
+		}
+		if event.Reasoning != "" && includeReasoning {
+			writeEvent(outputEvent{Type: "reasoning", Text: event.Reasoning})
+		}
+		if event.Content != "" {
+			writeEvent(outputEvent{Type: "content", Text: event.Content})
+		}
+		if event.Usage != nil {
+			usage = event.Usage
+		}
+	}
+
+	if err := stream.Err(); err != nil {
+		return writeError(err)
+	}
+	if usage != nil {
+		writeEvent(outputEvent{Type: "usage", Usage: usage})
+	}
+	writeEvent(outputEvent{Type: "finish", FinishReason: stream.FinishReason()})
+	return nil
+}
+
+// writeStructuredNDJSON prints a validated --json-schema result as events.
+func writeStructuredNDJSON(result *llm.StructuredResult) {
+	writeEvent(outputEvent{Type: "model", Model: result.Model, Key: result.Key})
+	writeEvent(outputEvent{Type: "content", Text: result.JSON})
+	if result.Usage != nil {
+		writeEvent(outputEvent{Type: "usage", Usage: result.Usage})
+	}
+	writeEvent(outputEvent{Type: "finish", FinishReason: llm.FinishStop})
+}
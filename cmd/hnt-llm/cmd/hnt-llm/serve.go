@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/llm"
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/proxy"
+)
+
+const serveTokenEnv = "HINATA_SERVE_TOKEN"
+
+type serveFlags struct {
+	listen   string
+	token    string
+	auditLog string
+}
+
+// defaultAuditLog returns $XDG_DATA_HOME/hinata/llm/serve.jsonl.
+func defaultAuditLog() (string, error) {
+	baseDir := os.Getenv("XDG_DATA_HOME")
+	if baseDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		baseDir = filepath.Join(homeDir, ".local", "share")
+	}
+	return filepath.Join(baseDir, "hinata", "llm", "serve.jsonl"), nil
+}
+
+func handleServe(flags serveFlags) error {
+	resolveModelFlag()
+
+	params, err := paramFlags.Params()
+	if err != nil {
+		return err
+	}
+
+	token := flags.token
+	if token == "" {
+		token = os.Getenv(serveTokenEnv)
+	}
+	if token == "" {
+		// Without a token any local program could use the keys.
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		token = hex.EncodeToString(b)
+		fmt.Fprintf(os.Stderr, "hnt-llm: no --token or $%s set, clients must use the generated token %s\n", serveTokenEnv, token)
+	}
+
+	// Clients may name the listen host in the Host header.
+	var hosts []string
+	if host, _, err := net.SplitHostPort(flags.listen); err == nil && host != "" {
+		hosts = append(hosts, host)
+	}
+
+	var audit io.Writer
+	if flags.auditLog != "-" {
+		path := flags.auditLog
+		if path == "" {
+			if path, err = defaultAuditLog(); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		audit = f
+	}
+
+	handler := proxy.NewHandler(proxy.Options{
+		Config: llm.Config{
+			Model:            model,
+			Params:           params,
+			NoCache:          noCache,
+			KeyProfile:       keyProfile,
+			MaxContinuations: maxContinuations,
+		},
+		Token:    token,
+		Hosts:    hosts,
+		AuditLog: audit,
+	})
+
+	// Ctrl-C cancels the requests in flight, which closes their upstream
+	// requests, and then stops the server.
+	ctx, stop := llm.InterruptContext(context.Background())
+	defer stop()
+	// Only the headers are timed: responses stream for as long as the
+	// model takes.
+	server := &http.Server{
+		Addr:              flags.listen,
+		Handler:           handler,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	shutdown := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+		close(shutdown)
+	}()
+
+	fmt.Fprintf(os.Stderr, "hnt-llm: serving an OpenAI-compatible API at http://%s/v1\n", flags.listen)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-shutdown
+	return nil
+}
@@ -10,6 +10,9 @@ import (
 var (
 	escapeRegex   = regexp.MustCompile(`<(/?)(_*)(hnt-(user|assistant|system))>`)
 	unescapeRegex = regexp.MustCompile(`<(/?)(_+)(hnt-(user|assistant|system))>`)
+
+	imageEscapeRegex   = regexp.MustCompile(`<(_*)hnt-image\b`)
+	imageUnescapeRegex = regexp.MustCompile(`<_(_*)hnt-image\b`)
 )
 
 func Escape(reader io.Reader, writer io.Writer) error {
@@ -70,3 +73,14 @@ func EscapeString(input string) string {
 	}
 	return buf.String()
 }
+
+// EscapeImages escapes <hnt-image> references in text that is not meant to
+// attach anything, such as file contents or command output. Messages
+// unescape them again once attachments have been loaded.
+func EscapeImages(input string) string {
+	return imageEscapeRegex.ReplaceAllString(input, "<_${1}hnt-image")
+}
+
+func UnescapeImages(input string) string {
+	return imageUnescapeRegex.ReplaceAllString(input, "<${1}hnt-image")
+}
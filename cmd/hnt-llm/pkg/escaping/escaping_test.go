@@ -115,3 +115,14 @@ func TestUnescape(t *testing.T) {
 		})
 	}
 }
+
+func TestEscapeImages(t *testing.T) {
+	input := `<hnt-image path="a.png"> <_hnt-image path="b.png"> <hnt-images>`
+	escaped := EscapeImages(input)
+	if escaped != `<_hnt-image path="a.png"> <__hnt-image path="b.png"> <hnt-images>` {
+		t.Errorf("Unexpected escape: %q", escaped)
+	}
+	if got := UnescapeImages(escaped); got != input {
+		t.Errorf("Round trip failed: %q", got)
+	}
+}
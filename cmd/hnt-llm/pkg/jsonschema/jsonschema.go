@@ -0,0 +1,458 @@
+// Package jsonschema validates JSON values against the subset of JSON Schema
+// that is useful for model output: types, object properties, arrays, enums,
+// string and number bounds, patterns, the anyOf/oneOf/allOf combinators and
+// local $ref references to $defs or definitions. Annotations such as title,
+// description and format are ignored; any other keyword is an error, so that
+// a schema is never enforced only in part.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+type Schema struct {
+	Type                 typeList           `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *additional        `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	Const                *any               `json:"const,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Defs                 map[string]*Schema `json:"$defs,omitempty"`
+	Definitions          map[string]*Schema `json:"definitions,omitempty"`
+
+	pattern *regexp.Regexp
+	ref     *Schema
+}
+
+// annotations are keywords that do not constrain the value.
+var annotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true,
+	"description": true, "default": true, "examples": true, "format": true,
+	"deprecated": true, "readOnly": true, "writeOnly": true,
+}
+
+var keywords = map[string]bool{
+	"type": true, "properties": true, "required": true,
+	"additionalProperties": true, "items": true, "enum": true, "const": true,
+	"minimum": true, "maximum": true, "minLength": true, "maxLength": true,
+	"pattern": true, "minItems": true, "maxItems": true, "anyOf": true,
+	"oneOf": true, "allOf": true, "$ref": true, "$defs": true,
+	"definitions": true,
+}
+
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for k := range fields {
+		if !keywords[k] && !annotations[k] {
+			return fmt.Errorf("unsupported keyword %q", k)
+		}
+	}
+	type plain Schema
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+// typeList accepts "type": "string" as well as "type": ["string", "null"].
+type typeList []string
+
+func (t *typeList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = typeList{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("type must be a string or an array of strings")
+	}
+	*t = list
+	return nil
+}
+
+// additional is additionalProperties, which is either a boolean or a
+// schema.
+type additional struct {
+	allowed bool
+	schema  *Schema
+}
+
+func (a *additional) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &a.allowed); err == nil {
+		return nil
+	}
+	a.allowed = true
+	return json.Unmarshal(data, &a.schema)
+}
+
+// Parse reads a schema document.
+func Parse(data []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %w", err)
+	}
+	if err := s.compile(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *Schema) compile(root *Schema) error {
+	if s == nil {
+		return nil
+	}
+	if s.Ref != "" {
+		target, err := root.resolve(s.Ref)
+		if err != nil {
+			return err
+		}
+		s.ref = target
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", s.Pattern, err)
+		}
+		s.pattern = re
+	}
+
+	children := []*Schema{s.Items}
+	for _, p := range s.Properties {
+		children = append(children, p)
+	}
+	if s.AdditionalProperties != nil {
+		children = append(children, s.AdditionalProperties.schema)
+	}
+	children = append(children, s.AnyOf...)
+	children = append(children, s.OneOf...)
+	children = append(children, s.AllOf...)
+	for _, d := range s.Defs {
+		children = append(children, d)
+	}
+	for _, d := range s.Definitions {
+		children = append(children, d)
+	}
+
+	for _, c := range children {
+		if err := c.compile(root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve finds a local reference and makes sure that following it does
+// not lead back to itself, which would never validate anything.
+func (root *Schema) resolve(ref string) (*Schema, error) {
+	target, err := root.lookup(ref)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[*Schema]bool{}
+	for t := target; t.Ref != ""; {
+		if seen[t] {
+			return nil, fmt.Errorf("$ref %q refers to itself", ref)
+		}
+		seen[t] = true
+		if t, err = root.lookup(t.Ref); err != nil {
+			return nil, err
+		}
+	}
+	return target, nil
+}
+
+// lookup finds "#", "#/$defs/name" or "#/definitions/name".
+func (root *Schema) lookup(ref string) (*Schema, error) {
+	if ref == "#" {
+		return root, nil
+	}
+	name, ok := strings.CutPrefix(ref, "#/$defs/")
+	defs := root.Defs
+	if !ok {
+		name, ok = strings.CutPrefix(ref, "#/definitions/")
+		defs = root.Definitions
+	}
+	name = strings.NewReplacer("~1", "/", "~0", "~").Replace(name)
+	if !ok || defs[name] == nil {
+		return nil, fmt.Errorf("unsupported $ref %q (only local #/$defs/... references are supported)", ref)
+	}
+	return defs[name], nil
+}
+
+// ValidationError describes the first mismatch found, with a JSON
+// Pointer-like path to the offending value.
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	path := e.Path
+	if path == "" {
+		path = "/"
+	}
+	return fmt.Sprintf("%s: %s", path, e.Message)
+}
+
+// ValidateJSON parses data and validates it.
+func (s *Schema) ValidateJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	if dec.More() {
+		return fmt.Errorf("invalid JSON: unexpected data after the top-level value")
+	}
+	return s.Validate(value)
+}
+
+// Validate checks a value decoded with encoding/json. Numbers may be
+// float64 or json.Number.
+func (s *Schema) Validate(value any) error {
+	return s.validate(value, "")
+}
+
+func (s *Schema) validate(value any, path string) error {
+	if s == nil {
+		return nil
+	}
+	fail := func(format string, args ...any) error {
+		return &ValidationError{Path: path, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if err := s.ref.validate(value, path); err != nil {
+		return err
+	}
+
+	if len(s.Type) > 0 {
+		matched := false
+		for _, t := range s.Type {
+			if hasType(value, t) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fail("expected %s, got %s", strings.Join(s.Type, " or "), typeName(value))
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if equal(value, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fail("value is not one of the allowed values")
+		}
+	}
+	if s.Const != nil && !equal(value, *s.Const) {
+		return fail("value does not match the required constant")
+	}
+
+	switch v := value.(type) {
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			return fail("string is shorter than %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fail("string is longer than %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fail("string does not match pattern %q", s.Pattern)
+		}
+	case json.Number, float64:
+		f, _ := toFloat(v)
+		if s.Minimum != nil && f < *s.Minimum {
+			return fail("%v is less than the minimum %v", f, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fail("%v is greater than the maximum %v", f, *s.Maximum)
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fail("array has fewer than %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fail("array has more than %d items", *s.MaxItems)
+		}
+		for i, item := range v {
+			if err := s.Items.validate(item, fmt.Sprintf("%s/%d", path, i)); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fail("missing required property %q", name)
+			}
+		}
+
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			childPath := path + "/" + k
+			if prop, ok := s.Properties[k]; ok {
+				if err := prop.validate(v[k], childPath); err != nil {
+					return err
+				}
+				continue
+			}
+			if s.AdditionalProperties != nil {
+				if !s.AdditionalProperties.allowed {
+					return fail("unexpected property %q", k)
+				}
+				if err := s.AdditionalProperties.schema.validate(v[k], childPath); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, sub := range s.AllOf {
+		if err := sub.validate(value, path); err != nil {
+			return err
+		}
+	}
+
+	if len(s.AnyOf) > 0 {
+		var firstErr error
+		for _, sub := range s.AnyOf {
+			err := sub.validate(value, path)
+			if err == nil {
+				firstErr = nil
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return fail("value matches none of anyOf (first mismatch: %v)", firstErr)
+		}
+	}
+
+	if len(s.OneOf) > 0 {
+		matches := 0
+		for _, sub := range s.OneOf {
+			if sub.validate(value, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fail("value matches %d of oneOf, expected exactly 1", matches)
+		}
+	}
+
+	return nil
+}
+
+func hasType(value any, t string) bool {
+	switch t {
+	case "null":
+		return value == nil
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := toFloat(value)
+		return ok
+	case "integer":
+		f, ok := toFloat(value)
+		return ok && f == math.Trunc(f)
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	}
+	return false
+}
+
+func typeName(value any) string {
+	for _, t := range []string{"null", "boolean", "string", "integer", "number", "array", "object"} {
+		if hasType(value, t) {
+			return t
+		}
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func toFloat(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// equal compares JSON values, treating numbers by value.
+func equal(a, b any) bool {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		return ok && fa == fb
+	}
+
+	switch av := a.(type) {
+	case []any:
+		bv, ok := b.([]any)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !equal(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		bv, ok := b.(map[string]any)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, v := range av {
+			if !equal(v, bv[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
@@ -0,0 +1,145 @@
+package jsonschema
+
+import (
+	"testing"
+)
+
+const personSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 0},
+		"email": {"type": ["string", "null"], "pattern": "@"},
+		"role": {"enum": ["admin", "user"]},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2}
+	},
+	"required": ["name", "age"],
+	"additionalProperties": false
+}`
+
+func TestValidate(t *testing.T) {
+	schema, err := Parse([]byte(personSchema))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		valid bool
+	}{
+		{"minimal", `{"name": "Ann", "age": 30}`, true},
+		{"all fields", `{"name": "Ann", "age": 30, "email": "a@b.c", "role": "admin", "tags": ["x"]}`, true},
+		{"nullable", `{"name": "Ann", "age": 30, "email": null}`, true},
+		{"missing required", `{"name": "Ann"}`, false},
+		{"wrong type", `{"name": "Ann", "age": "30"}`, false},
+		{"not an integer", `{"name": "Ann", "age": 30.5}`, false},
+		{"below minimum", `{"name": "Ann", "age": -1}`, false},
+		{"empty string", `{"name": "", "age": 1}`, false},
+		{"pattern", `{"name": "Ann", "age": 1, "email": "nope"}`, false},
+		{"enum", `{"name": "Ann", "age": 1, "role": "root"}`, false},
+		{"item type", `{"name": "Ann", "age": 1, "tags": [1]}`, false},
+		{"too many items", `{"name": "Ann", "age": 1, "tags": ["a", "b", "c"]}`, false},
+		{"additional property", `{"name": "Ann", "age": 1, "extra": true}`, false},
+		{"not an object", `["Ann", 1]`, false},
+		{"invalid JSON", `{"name": "Ann", "age": 1`, false},
+		{"trailing data", `{"name": "Ann", "age": 1} and more`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := schema.ValidateJSON([]byte(tt.input))
+			if tt.valid && err != nil {
+				t.Errorf("Expected valid, got %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("Expected a validation error")
+			}
+		})
+	}
+}
+
+func TestValidationErrorPath(t *testing.T) {
+	schema, err := Parse([]byte(`{"type": "object", "properties": {"items": {"type": "array", "items": {"type": "object", "required": ["id"]}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = schema.ValidateJSON([]byte(`{"items": [{"id": 1}, {}]}`))
+	verr, ok := err.(*ValidationError)
+	if !ok || verr.Path != "/items/1" {
+		t.Errorf("Expected an error at /items/1, got %v", err)
+	}
+}
+
+func TestCombinators(t *testing.T) {
+	schema, err := Parse([]byte(`{"anyOf": [{"type": "string"}, {"type": "number", "maximum": 10}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for input, valid := range map[string]bool{`"x"`: true, `5`: true, `50`: false, `true`: false} {
+		if err := schema.ValidateJSON([]byte(input)); (err == nil) != valid {
+			t.Errorf("anyOf %s: expected valid=%v, got %v", input, valid, err)
+		}
+	}
+
+	schema, err = Parse([]byte(`{"oneOf": [{"type": "integer"}, {"type": "number"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.ValidateJSON([]byte(`1`)); err == nil {
+		t.Error("Expected 1 to match both oneOf branches and fail")
+	}
+	if err := schema.ValidateJSON([]byte(`1.5`)); err != nil {
+		t.Errorf("Expected 1.5 to match exactly one branch, got %v", err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, input := range []string{`not json`, `{"type": 5}`, `{"pattern": "("}`} {
+		if _, err := Parse([]byte(input)); err == nil {
+			t.Errorf("Expected Parse(%s) to fail", input)
+		}
+	}
+}
+
+func TestRef(t *testing.T) {
+	schema, err := Parse([]byte(`{
+		"$defs": {"item": {"type": "object", "properties": {"id": {"type": "integer"}}, "required": ["id"]}},
+		"type": "array",
+		"items": {"$ref": "#/$defs/item"}
+	}`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if err := schema.ValidateJSON([]byte(`[{"id": 1}]`)); err != nil {
+		t.Errorf("Expected a match, got %v", err)
+	}
+	if err := schema.ValidateJSON([]byte(`[{"id": "one"}]`)); err == nil {
+		t.Error("Expected output that does not match the referenced schema to be rejected")
+	}
+
+	tree, err := Parse([]byte(`{"type": "object", "properties": {"children": {"type": "array", "items": {"$ref": "#"}}}, "additionalProperties": false}`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if err := tree.ValidateJSON([]byte(`{"children": [{"children": []}, {"name": "x"}]}`)); err == nil {
+		t.Error("Expected a recursive reference to be enforced")
+	}
+}
+
+func TestParseUnsupported(t *testing.T) {
+	for _, schema := range []string{
+		`{"type": "string", "not": {"enum": ["x"]}}`,
+		`{"items": {"$ref": "other.json#/item"}}`,
+		`{"$ref": "#/$defs/missing"}`,
+		`{"$defs": {"a": {"$ref": "#/$defs/b"}, "b": {"$ref": "#/$defs/a"}}, "$ref": "#/$defs/a"}`,
+	} {
+		if _, err := Parse([]byte(schema)); err == nil {
+			t.Errorf("Expected %s to be refused", schema)
+		}
+	}
+	if _, err := Parse([]byte(`{"$schema": "https://json-schema.org/draft/2020-12/schema", "title": "T", "type": "string", "format": "email"}`)); err != nil {
+		t.Errorf("Expected annotations to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package keymanagement
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Scheme is how a saved key is encrypted.
+type Scheme string
+
+const (
+	// SchemeXOR is the original format, a XOR with .local_key. It is
+	// re-encrypted the first time the key is read.
+	SchemeXOR Scheme = "xor"
+	// SchemeAESGCM is AES-256-GCM with the random .local_key. It protects
+	// against tampering, but anyone who can read both files can decrypt.
+	SchemeAESGCM Scheme = "aes-gcm"
+	// SchemePassphrase is AES-256-GCM with a key derived from a
+	// passphrase with Argon2id.
+	SchemePassphrase Scheme = "aes-gcm+passphrase"
+)
+
+// Value prefixes in the keys file. Legacy XOR values have none.
+var schemePrefixes = map[Scheme]string{
+	SchemeAESGCM:     "aes-gcm:",
+	SchemePassphrase: "aes-gcm-pass:",
+}
+
+func parseScheme(value string) (Scheme, string) {
+	for scheme, prefix := range schemePrefixes {
+		if strings.HasPrefix(value, prefix) {
+			return scheme, strings.TrimPrefix(value, prefix)
+		}
+	}
+	return SchemeXOR, value
+}
+
+// encryptValue encrypts apiKey for the keys file. The entry name is
+// authenticated, so a value cannot be moved to another entry.
+func encryptValue(scheme Scheme, key []byte, name string, apiKey string) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(apiKey), []byte(name))
+	return schemePrefixes[scheme] + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptValue(scheme Scheme, key []byte, name string, encoded string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+
+	if scheme == SchemeXOR {
+		xorCrypt(key, data)
+		return string(data), nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("encrypted key is truncated")
+	}
+
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt key '%s': it was modified or the passphrase changed", name)
+	}
+	return string(plain), nil
+}
+
+func xorCrypt(key []byte, data []byte) {
+	for i := range data {
+		data[i] ^= key[i%len(key)]
+	}
+}
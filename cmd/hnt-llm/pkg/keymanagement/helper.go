@@ -0,0 +1,135 @@
+package keymanagement
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HelperTimeout bounds how long a key command may run. It is generous
+// because helpers such as pass may wait for a pinentry prompt.
+const HelperTimeout = 30 * time.Second
+
+// SchemeCommand marks a key that is fetched by running a command instead
+// of being stored.
+const SchemeCommand Scheme = "command"
+
+var (
+	helperMu    sync.Mutex
+	helperCache = map[string]string{}
+)
+
+func commandsPath(configDir string) string {
+	return filepath.Join(configDir, "key-commands")
+}
+
+// readCommands returns the provider=command lines of the key-commands file.
+func readCommands(configDir string) ([]entry, error) {
+	content, err := os.ReadFile(commandsPath(configDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var commands []entry
+	for _, line := range strings.Split(string(content), "\n") {
+		name, command, ok := strings.Cut(line, "=")
+		if line != "" && ok {
+			commands = append(commands, entry{name: name, value: command})
+		}
+	}
+	return commands, nil
+}
+
+func writeCommands(configDir string, commands []entry) error {
+	var content strings.Builder
+	for _, c := range commands {
+		fmt.Fprintf(&content, "%s=%s\n", c.name, c.value)
+	}
+	path := commandsPath(configDir)
+	if err := writeFileAtomic(path, []byte(content.String())); err != nil {
+		return err
+	}
+	return setPermissions(path)
+}
+
+func lookupCommand(configDir, provider string) (string, error) {
+	commands, err := readCommands(configDir)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range commands {
+		if c.name == provider {
+			return c.value, nil
+		}
+	}
+	return "", nil
+}
+
+// SaveKeyCommand registers a command whose output is the key for provider,
+// like a git credential helper. It takes priority over a saved key.
+func SaveKeyCommand(provider, command string) error {
+	if err := ValidateName(provider); err != nil {
+		return err
+	}
+	if strings.ContainsAny(command, "\r\n") {
+		return errors.New("key command must be a single line")
+	}
+	configDir, err := getHinataDir("config")
+	if err != nil {
+		return err
+	}
+
+	commands, err := readCommands(configDir)
+	if err != nil {
+		return err
+	}
+	var kept []entry
+	for _, c := range commands {
+		if c.name != provider {
+			kept = append(kept, c)
+		}
+	}
+	return writeCommands(configDir, append(kept, entry{name: provider, value: command}))
+}
+
+// runKeyCommand runs command with sh and returns the first line of its
+// output. Results are cached for the life of the process, so a helper that
+// prompts only does so once.
+func runKeyCommand(command string) (string, error) {
+	helperMu.Lock()
+	defer helperMu.Unlock()
+	if apiKey, ok := helperCache[command]; ok {
+		return apiKey, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HelperTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	// Stdin may be the prompt, so the helper must not read it. Its stderr
+	// is left visible for any messages it prints.
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("key command `%s` timed out after %s", command, HelperTimeout)
+	}
+	if err != nil {
+		return "", fmt.Errorf("key command `%s` failed: %w", command, err)
+	}
+
+	line, _, _ := strings.Cut(string(out), "\n")
+	apiKey := strings.TrimSpace(line)
+	if apiKey == "" {
+		return "", fmt.Errorf("key command `%s` printed nothing", command)
+	}
+	helperCache[command] = apiKey
+	return apiKey, nil
+}
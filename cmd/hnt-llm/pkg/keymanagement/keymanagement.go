@@ -2,12 +2,13 @@ package keymanagement
 
 import (
 	"crypto/rand"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/term"
 )
@@ -66,181 +67,299 @@ func readLocalKey(dataDir string) ([]byte, error) {
 	return os.ReadFile(keyPath)
 }
 
-func xorCrypt(key []byte, data []byte) {
-	for i := range data {
-		data[i] ^= key[i%len(key)]
+func setPermissions(path string) error {
+	return os.Chmod(path, 0600)
+}
+
+// entry is one line of the keys file.
+type entry struct {
+	name  string
+	value string
+}
+
+// store is the keys file together with what is needed to decrypt it.
+type store struct {
+	keysPath string
+	localKey []byte
+	params   *kdfParams
+	passKey  []byte
+	entries  []entry
+}
+
+func openStore(configDir, dataDir string) (*store, error) {
+	s := &store{keysPath: filepath.Join(configDir, "keys")}
+
+	content, err := os.ReadFile(s.keysPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
 	}
+	for _, line := range strings.Split(string(content), "\n") {
+		name, value, ok := strings.Cut(line, "=")
+		if line != "" && ok {
+			s.entries = append(s.entries, entry{name: name, value: value})
+		}
+	}
+
+	s.localKey, err = readLocalKey(dataDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if s.params, err = readKDFParams(dataDir); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
-func setPermissions(path string) error {
-	return os.Chmod(path, 0600)
+func (s *store) find(name string) int {
+	for i, e := range s.entries {
+		if e.name == name {
+			return i
+		}
+	}
+	return -1
 }
 
-func SaveAPIKey(provider, apiKey string) error {
-	configDir, err := getHinataDir("config")
+func (s *store) unlock() ([]byte, error) {
+	if s.passKey != nil {
+		return s.passKey, nil
+	}
+	if s.params == nil {
+		return nil, errors.New("key is passphrase-protected, but no passphrase is set")
+	}
+	key, err := passphraseKey(s.params)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	s.passKey = key
+	return key, nil
+}
 
-	dataDir, err := getHinataDir("data")
+func (s *store) decrypt(e entry) (string, error) {
+	scheme, encoded := parseScheme(e.value)
+	key := s.localKey
+	if scheme == SchemePassphrase {
+		var err error
+		if key, err = s.unlock(); err != nil {
+			return "", err
+		}
+	} else if len(key) == 0 {
+		return "", errors.New("local key is missing, saved keys cannot be decrypted")
+	}
+	return decryptValue(scheme, key, e.name, encoded)
+}
+
+// encrypt uses the passphrase if one is set.
+func (s *store) encrypt(name, apiKey string) (string, error) {
+	if s.params == nil {
+		return encryptValue(SchemeAESGCM, s.localKey, name, apiKey)
+	}
+	key, err := s.unlock()
 	if err != nil {
-		return err
+		return "", err
 	}
+	return encryptValue(SchemePassphrase, key, name, apiKey)
+}
 
-	if err := ensureLocalKey(dataDir); err != nil {
+func (s *store) save() error {
+	var content strings.Builder
+	for _, e := range s.entries {
+		fmt.Fprintf(&content, "%s=%s\n", e.name, e.value)
+	}
+	if err := writeFileAtomic(s.keysPath, []byte(content.String())); err != nil {
 		return err
 	}
+	return setPermissions(s.keysPath)
+}
 
-	keysPath := filepath.Join(configDir, "keys")
+// writeFileAtomic replaces path with data by renaming a temporary file over
+// it, so that a crash leaves either the old or the new content. The file
+// is created with mode 0600.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
 
-	var lines []string
-	if content, err := os.ReadFile(keysPath); err == nil {
-		lines = strings.Split(string(content), "\n")
+func openDefaultStore() (*store, error) {
+	configDir, err := getHinataDir("config")
+	if err != nil {
+		return nil, err
+	}
+	dataDir, err := getHinataDir("data")
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureLocalKey(dataDir); err != nil {
+		return nil, err
 	}
+	return openStore(configDir, dataDir)
+}
 
-	keyPrefix := provider + "="
-	var newLines []string
-	for _, line := range lines {
-		if line != "" && !strings.HasPrefix(line, keyPrefix) {
-			newLines = append(newLines, line)
-		}
+// ValidateName checks a key name: a provider, optionally followed by
+// ":name" for one of several keys of the same provider.
+func ValidateName(name string) error {
+	provider, profile, named := strings.Cut(name, ":")
+	if provider == "" || (named && (profile == "" || strings.Contains(profile, ":"))) ||
+		strings.ContainsAny(name, "= \t\r\n") {
+		return fmt.Errorf("invalid key name '%s', expected provider or provider:name", name)
 	}
+	return nil
+}
 
-	localKey, err := readLocalKey(dataDir)
+func SaveAPIKey(provider, apiKey string) error {
+	if err := ValidateName(provider); err != nil {
+		return err
+	}
+	s, err := openDefaultStore()
 	if err != nil {
 		return err
 	}
 
-	dataToEncrypt := []byte(apiKey)
-	xorCrypt(localKey, dataToEncrypt)
-
-	encodedKey := base64.StdEncoding.EncodeToString(dataToEncrypt)
-	newLines = append(newLines, fmt.Sprintf("%s=%s", provider, encodedKey))
-
-	content := strings.Join(newLines, "\n") + "\n"
-	if err := os.WriteFile(keysPath, []byte(content), 0600); err != nil {
+	value, err := s.encrypt(provider, apiKey)
+	if err != nil {
 		return err
 	}
-
-	return setPermissions(keysPath)
+	if i := s.find(provider); i >= 0 {
+		s.entries = append(s.entries[:i], s.entries[i+1:]...)
+	}
+	s.entries = append(s.entries, entry{name: provider, value: value})
+	return s.save()
 }
 
+// GetAPIKeyFromStore returns "" if no key is saved for provider. A key
+// command registered with SaveKeyCommand wins over a saved key. Keys in
+// the old XOR format are re-encrypted on the way.
 func GetAPIKeyFromStore(provider string) (string, error) {
 	configDir, err := getHinataDir("config")
 	if err != nil {
 		return "", err
 	}
-
-	keysPath := filepath.Join(configDir, "keys")
-	content, err := os.ReadFile(keysPath)
+	command, err := lookupCommand(configDir, provider)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return "", nil
-		}
 		return "", err
 	}
+	if command != "" {
+		return runKeyCommand(command)
+	}
 
-	keyPrefix := provider + "="
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(line, keyPrefix) {
-			encodedKey := strings.TrimPrefix(line, keyPrefix)
-
-			dataDir, err := getHinataDir("data")
-			if err != nil {
-				return "", err
-			}
-
-			localKey, err := readLocalKey(dataDir)
-			if err != nil {
-				return "", err
-			}
+	s, err := openDefaultStore()
+	if err != nil {
+		return "", err
+	}
 
-			encryptedData, err := base64.StdEncoding.DecodeString(encodedKey)
-			if err != nil {
-				return "", err
-			}
+	i := s.find(provider)
+	if i < 0 {
+		return "", nil
+	}
+	apiKey, err := s.decrypt(s.entries[i])
+	if err != nil {
+		return "", err
+	}
 
-			xorCrypt(localKey, encryptedData)
-			return string(encryptedData), nil
+	// Migration is best effort: a locked passphrase only delays it.
+	if scheme, _ := parseScheme(s.entries[i].value); scheme == SchemeXOR {
+		if value, err := s.encrypt(provider, apiKey); err == nil {
+			s.entries[i].value = value
+			s.save()
 		}
 	}
+	return apiKey, nil
+}
 
-	return "", nil
+// KeyInfo describes a saved key without decrypting it.
+type KeyInfo struct {
+	Name   string
+	Scheme Scheme
 }
 
-func ListKeys() ([]string, error) {
-	configDir, err := getHinataDir("config")
+func ListKeys() ([]KeyInfo, error) {
+	s, err := openDefaultStore()
 	if err != nil {
 		return nil, err
 	}
 
-	keysPath := filepath.Join(configDir, "keys")
-	content, err := os.ReadFile(keysPath)
+	commands, err := readCommands(filepath.Dir(s.keysPath))
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
 		return nil, err
 	}
 
-	var providers []string
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		if line != "" && strings.Contains(line, "=") {
-			provider := strings.Split(line, "=")[0]
-			providers = append(providers, provider)
-		}
+	var keys []KeyInfo
+	for _, c := range commands {
+		keys = append(keys, KeyInfo{Name: c.name, Scheme: SchemeCommand})
 	}
-
-	return providers, nil
+	for _, e := range s.entries {
+		scheme, _ := parseScheme(e.value)
+		keys = append(keys, KeyInfo{Name: e.name, Scheme: scheme})
+	}
+	return keys, nil
 }
 
 func DeleteKey(provider string) error {
-	configDir, err := getHinataDir("config")
+	s, err := openDefaultStore()
 	if err != nil {
 		return err
 	}
 
-	keysPath := filepath.Join(configDir, "keys")
-	content, err := os.ReadFile(keysPath)
+	// A provider can have both a key command and a saved key.
+	configDir := filepath.Dir(s.keysPath)
+	commands, err := readCommands(configDir)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return fmt.Errorf("key '%s' not found", provider)
-		}
 		return err
 	}
-
-	keyPrefix := provider + "="
-	lines := strings.Split(string(content), "\n")
-	var newLines []string
-	found := false
-
-	for _, line := range lines {
-		if line != "" && !strings.HasPrefix(line, keyPrefix) {
-			newLines = append(newLines, line)
-		} else if strings.HasPrefix(line, keyPrefix) {
-			found = true
+	var kept []entry
+	for _, c := range commands {
+		if c.name != provider {
+			kept = append(kept, c)
 		}
 	}
-
-	if !found {
-		return fmt.Errorf("key '%s' not found", provider)
+	removedCommand := len(kept) < len(commands)
+	if removedCommand {
+		if err := writeCommands(configDir, kept); err != nil {
+			return err
+		}
 	}
 
-	newContent := strings.Join(newLines, "\n") + "\n"
-	if err := os.WriteFile(keysPath, []byte(newContent), 0600); err != nil {
-		return err
+	i := s.find(provider)
+	if i < 0 {
+		if removedCommand {
+			return nil
+		}
+		return fmt.Errorf("key '%s' not found", provider)
 	}
-
-	return setPermissions(keysPath)
+	s.entries = append(s.entries[:i], s.entries[i+1:]...)
+	return s.save()
 }
 
-func HandleSaveKey(provider string) error {
+// HandleSaveKey prompts for the key, or registers command if it is set.
+func HandleSaveKey(provider, command string) error {
 	if provider == "" {
 		return fmt.Errorf("provider is required")
 	}
 
+	if command != "" {
+		if err := SaveKeyCommand(provider, command); err != nil {
+			return err
+		}
+		fmt.Printf("Saved key command for '%s'.\n", provider)
+		return nil
+	}
+
 	fmt.Printf("Enter API key for '%s': ", provider)
 	apiKey, err := term.ReadPassword(int(syscall.Stdin))
 	fmt.Println()
@@ -257,19 +376,19 @@ func HandleSaveKey(provider string) error {
 }
 
 func HandleListKeys() error {
-	providers, err := ListKeys()
+	keys, err := ListKeys()
 	if err != nil {
 		return err
 	}
 
-	if len(providers) == 0 {
+	if len(keys) == 0 {
 		fmt.Println("No keys saved.")
 		return nil
 	}
 
 	fmt.Println("Saved API keys:")
-	for _, provider := range providers {
-		fmt.Printf("- %s\n", provider)
+	for _, key := range keys {
+		fmt.Printf("- %s (%s)\n", key.Name, key.Scheme)
 	}
 	return nil
 }
@@ -286,3 +405,63 @@ func HandleDeleteKey(provider string) error {
 	fmt.Printf("Deleted key '%s'.\n", provider)
 	return nil
 }
+
+func readPassphrase(prompt string) (string, error) {
+	fmt.Print(prompt)
+	passphrase, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	return string(passphrase), err
+}
+
+func HandleUnlock(timeout time.Duration) error {
+	passphrase, err := readPassphrase("Passphrase: ")
+	if err != nil {
+		return err
+	}
+	if err := Unlock(passphrase, timeout); err != nil {
+		return err
+	}
+
+	fmt.Printf("Unlocked saved keys for %s.\n", timeout)
+	return nil
+}
+
+func HandleLock() error {
+	if err := Lock(); err != nil {
+		return err
+	}
+
+	fmt.Println("Locked saved keys.")
+	return nil
+}
+
+func HandleSetPassphrase(remove bool) error {
+	if remove {
+		if err := SetPassphrase(""); err != nil {
+			return err
+		}
+		fmt.Println("Removed the passphrase.")
+		return nil
+	}
+
+	passphrase, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return err
+	}
+	if passphrase == "" {
+		return fmt.Errorf("passphrase must not be empty")
+	}
+	confirm, err := readPassphrase("Confirm passphrase: ")
+	if err != nil {
+		return err
+	}
+	if confirm != passphrase {
+		return fmt.Errorf("passphrases do not match")
+	}
+
+	if err := SetPassphrase(passphrase); err != nil {
+		return err
+	}
+	fmt.Printf("Saved keys are now protected by the passphrase and unlocked for %s.\n", DefaultUnlockTimeout)
+	return nil
+}
@@ -0,0 +1,276 @@
+package keymanagement
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupDirs(t *testing.T) (configDir, dataDir string) {
+	t.Helper()
+	root := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(root, "config"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(root, "data"))
+	t.Setenv("XDG_RUNTIME_DIR", filepath.Join(root, "run"))
+	t.Setenv(PassphraseEnv, "")
+
+	configDir, err := getHinataDir("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataDir, err = getHinataDir("data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return configDir, dataDir
+}
+
+func schemes(t *testing.T) map[string]Scheme {
+	t.Helper()
+	keys, err := ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]Scheme)
+	for _, k := range keys {
+		m[k.Name] = k.Scheme
+	}
+	return m
+}
+
+func TestSaveAndGet(t *testing.T) {
+	configDir, _ := setupDirs(t)
+
+	if err := SaveAPIKey("openai", "sk-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveAPIKey("openai", "sk-newer"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetAPIKeyFromStore("openai")
+	if err != nil || got != "sk-newer" {
+		t.Fatalf("Expected sk-newer, got %q (%v)", got, err)
+	}
+	if s := schemes(t); len(s) != 1 || s["openai"] != SchemeAESGCM {
+		t.Errorf("Expected one aes-gcm key, got %v", s)
+	}
+
+	content, _ := os.ReadFile(filepath.Join(configDir, "keys"))
+	if strings.Contains(string(content), "sk-newer") {
+		t.Error("Key was stored in plain text")
+	}
+
+	got, err = GetAPIKeyFromStore("missing")
+	if err != nil || got != "" {
+		t.Errorf("Expected no key, got %q (%v)", got, err)
+	}
+}
+
+func TestTamperedKeyIsRejected(t *testing.T) {
+	configDir, _ := setupDirs(t)
+	if err := SaveAPIKey("a", "sk-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveAPIKey("b", "sk-b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Swapping values between entries must not go unnoticed.
+	keysPath := filepath.Join(configDir, "keys")
+	content, _ := os.ReadFile(keysPath)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	_, valueA, _ := strings.Cut(lines[0], "=")
+	_, valueB, _ := strings.Cut(lines[1], "=")
+	swapped := "a=" + valueB + "\nb=" + valueA + "\n"
+	if err := os.WriteFile(keysPath, []byte(swapped), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetAPIKeyFromStore("a"); err == nil {
+		t.Error("Expected an error for a moved value")
+	}
+}
+
+func TestMigrateXOR(t *testing.T) {
+	configDir, dataDir := setupDirs(t)
+	if err := ensureLocalKey(dataDir); err != nil {
+		t.Fatal(err)
+	}
+	localKey, err := readLocalKey(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("sk-legacy")
+	xorCrypt(localKey, data)
+	legacy := "openai=" + base64.StdEncoding.EncodeToString(data) + "\n"
+	if err := os.WriteFile(filepath.Join(configDir, "keys"), []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := schemes(t); s["openai"] != SchemeXOR {
+		t.Fatalf("Expected a xor key before migration, got %v", s)
+	}
+	got, err := GetAPIKeyFromStore("openai")
+	if err != nil || got != "sk-legacy" {
+		t.Fatalf("Expected sk-legacy, got %q (%v)", got, err)
+	}
+	if s := schemes(t); s["openai"] != SchemeAESGCM {
+		t.Errorf("Expected the key to be migrated, got %v", s)
+	}
+	if got, _ := GetAPIKeyFromStore("openai"); got != "sk-legacy" {
+		t.Errorf("Expected sk-legacy after migration, got %q", got)
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	setupDirs(t)
+	if err := SaveAPIKey("openai", "sk-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetPassphrase("hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if s := schemes(t); s["openai"] != SchemePassphrase {
+		t.Fatalf("Expected the key to be re-encrypted, got %v", s)
+	}
+	// Setting a passphrase leaves the keys unlocked.
+	if got, err := GetAPIKeyFromStore("openai"); err != nil || got != "sk-secret" {
+		t.Fatalf("Expected sk-secret, got %q (%v)", got, err)
+	}
+
+	if err := Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetAPIKeyFromStore("openai"); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked, got %v", err)
+	}
+	if err := SaveAPIKey("anthropic", "sk-ant"); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked when saving, got %v", err)
+	}
+
+	t.Setenv(PassphraseEnv, "wrong")
+	if _, err := GetAPIKeyFromStore("openai"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("Expected ErrWrongPassphrase, got %v", err)
+	}
+	t.Setenv(PassphraseEnv, "hunter2")
+	if got, err := GetAPIKeyFromStore("openai"); err != nil || got != "sk-secret" {
+		t.Fatalf("Expected sk-secret from the environment, got %q (%v)", got, err)
+	}
+	t.Setenv(PassphraseEnv, "")
+
+	if err := Unlock("wrong", time.Hour); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("Expected ErrWrongPassphrase, got %v", err)
+	}
+	if err := Unlock("hunter2", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetAPIKeyFromStore("openai"); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected an expired session to be locked, got %v", err)
+	}
+	if err := Unlock("hunter2", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetPassphrase(""); err != nil {
+		t.Fatal(err)
+	}
+	if s := schemes(t); s["openai"] != SchemeAESGCM {
+		t.Fatalf("Expected the passphrase to be removed, got %v", s)
+	}
+	if got, err := GetAPIKeyFromStore("openai"); err != nil || got != "sk-secret" {
+		t.Errorf("Expected sk-secret, got %q (%v)", got, err)
+	}
+}
+
+func TestSessionDirMustBePrivate(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", root)
+	dir := filepath.Join(root, "hinata")
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(dir, 0755)
+	if _, err := sessionPath(); err == nil {
+		t.Error("Expected a directory readable by others to be refused")
+	}
+
+	os.Remove(dir)
+	if err := os.Symlink(t.TempDir(), dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessionPath(); err == nil {
+		t.Error("Expected a symlink to be refused")
+	}
+
+	os.Remove(dir)
+	if _, err := sessionPath(); err != nil {
+		t.Errorf("Expected a new private directory to be accepted, got %v", err)
+	}
+}
+
+func TestKeyCommand(t *testing.T) {
+	configDir, _ := setupDirs(t)
+	if err := SaveAPIKey("openrouter", "sk-stored"); err != nil {
+		t.Fatal(err)
+	}
+
+	counter := filepath.Join(configDir, "runs")
+	command := "echo run >> " + counter + "; printf 'sk-helper\\nextra\\n'"
+	if err := SaveKeyCommand("openrouter", command); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		got, err := GetAPIKeyFromStore("openrouter")
+		if err != nil || got != "sk-helper" {
+			t.Fatalf("Expected sk-helper, got %q (%v)", got, err)
+		}
+	}
+	runs, _ := os.ReadFile(counter)
+	if n := strings.Count(string(runs), "run"); n != 1 {
+		t.Errorf("Expected the command to run once, ran %d times", n)
+	}
+
+	keys, err := ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != (KeyInfo{Name: "openrouter", Scheme: SchemeCommand}) {
+		t.Errorf("Expected the command and the saved key, got %v", keys)
+	}
+
+	if err := DeleteKey("openrouter"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := ListKeys(); len(keys) != 0 {
+		t.Errorf("Expected both entries to be deleted, got %v", keys)
+	}
+
+	if err := SaveKeyCommand("failing", "exit 3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetAPIKeyFromStore("failing"); err == nil {
+		t.Error("Expected an error from a failing command")
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{"openrouter", "openrouter:work", "my-provider:team-billing"} {
+		if err := ValidateName(name); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ":work", "openrouter:", "a:b:c", "a=b", "open router"} {
+		if err := ValidateName(name); err == nil {
+			t.Errorf("Expected %q to be invalid", name)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package keymanagement
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// PassphraseEnv supplies the passphrase to scripts that cannot use
+// `hnt-llm unlock`.
+const PassphraseEnv = "HINATA_KEY_PASSPHRASE"
+
+// DefaultUnlockTimeout is how long `hnt-llm unlock` lasts by default.
+const DefaultUnlockTimeout = 8 * time.Hour
+
+var (
+	ErrLocked          = errors.New("saved API keys are locked; run `hnt-llm unlock` or set " + PassphraseEnv)
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+)
+
+// kdfParams is stored in keystore.json next to .local_key once a passphrase
+// is set.
+type kdfParams struct {
+	KDF       string `json:"kdf"`
+	Salt      []byte `json:"salt"`
+	Time      uint32 `json:"time"`
+	MemoryKiB uint32 `json:"memory_kib"`
+	Threads   uint8  `json:"threads"`
+	// Check is a known value encrypted with the derived key, to tell a
+	// wrong passphrase apart from a damaged entry.
+	Check string `json:"check"`
+}
+
+const checkName = "keystore-check"
+
+var checkValue = []byte("hinata")
+
+func kdfParamsPath(dataDir string) string {
+	return filepath.Join(dataDir, "keystore.json")
+}
+
+// readKDFParams returns nil if no passphrase is set.
+func readKDFParams(dataDir string) (*kdfParams, error) {
+	data, err := os.ReadFile(kdfParamsPath(dataDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var p kdfParams
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", kdfParamsPath(dataDir), err)
+	}
+	if p.KDF != "argon2id" {
+		return nil, fmt.Errorf("unsupported key derivation function %q", p.KDF)
+	}
+	return &p, nil
+}
+
+func (p *kdfParams) derive(passphrase string) []byte {
+	return argon2.IDKey([]byte(passphrase), p.Salt, p.Time, p.MemoryKiB, p.Threads, 32)
+}
+
+// verify reports whether key was derived from the right passphrase.
+func (p *kdfParams) verify(key []byte) bool {
+	scheme, encoded := parseScheme(p.Check)
+	plain, err := decryptValue(scheme, key, checkName, encoded)
+	return err == nil && bytes.Equal([]byte(plain), checkValue)
+}
+
+func newKDFParams(passphrase string) (*kdfParams, []byte, error) {
+	p := &kdfParams{KDF: "argon2id", Salt: make([]byte, 16), Time: 3, MemoryKiB: 64 * 1024, Threads: 4}
+	if _, err := rand.Read(p.Salt); err != nil {
+		return nil, nil, err
+	}
+
+	key := p.derive(passphrase)
+	check, err := encryptValue(SchemePassphrase, key, checkName, string(checkValue))
+	if err != nil {
+		return nil, nil, err
+	}
+	p.Check = check
+	return p, key, nil
+}
+
+// session is the unlocked passphrase key, kept in the runtime directory so
+// that it does not survive a reboot.
+type session struct {
+	Key     []byte    `json:"key"`
+	Expires time.Time `json:"expires"`
+}
+
+func sessionPath() (string, error) {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "hinata-"+strconv.Itoa(os.Getuid()))
+	} else {
+		dir = filepath.Join(dir, "hinata")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	// Without XDG_RUNTIME_DIR the path is predictable, so another user
+	// could have created it first.
+	if err := checkPrivateDir(dir); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "keys-session"), nil
+}
+
+// checkPrivateDir makes sure dir is a real directory, not a symlink, that
+// only the current user can access.
+func checkPrivateDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(stat.Uid) != os.Getuid() || info.Mode().Perm() != 0700 {
+		return fmt.Errorf("refusing to keep the unlocked key in %s: it must be a directory owned by you with mode 0700", dir)
+	}
+	return nil
+}
+
+// passphraseKey returns the key for SchemePassphrase entries from the
+// unlocked session or PassphraseEnv, or ErrLocked.
+func passphraseKey(p *kdfParams) ([]byte, error) {
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		key := p.derive(passphrase)
+		if !p.verify(key) {
+			return nil, fmt.Errorf("%s: %w", PassphraseEnv, ErrWrongPassphrase)
+		}
+		return key, nil
+	}
+
+	path, err := sessionPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+
+	var s session
+	if err := json.Unmarshal(data, &s); err != nil || time.Now().After(s.Expires) || !p.verify(s.Key) {
+		os.Remove(path)
+		return nil, ErrLocked
+	}
+	return s.Key, nil
+}
+
+func writeSession(key []byte, ttl time.Duration) error {
+	path, err := sessionPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(session{Key: key, Expires: time.Now().Add(ttl)})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// Unlock checks passphrase and keeps the derived key for ttl, so that
+// passphrase-protected keys can be read without asking again.
+func Unlock(passphrase string, ttl time.Duration) error {
+	dataDir, err := getHinataDir("data")
+	if err != nil {
+		return err
+	}
+	p, err := readKDFParams(dataDir)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return errors.New("no passphrase is set; use `hnt-llm set-passphrase` first")
+	}
+
+	key := p.derive(passphrase)
+	if !p.verify(key) {
+		return ErrWrongPassphrase
+	}
+	return writeSession(key, ttl)
+}
+
+// Lock forgets the unlocked passphrase key.
+func Lock() error {
+	path, err := sessionPath()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// PassphraseSet reports whether saved keys are protected by a passphrase.
+func PassphraseSet() (bool, error) {
+	dataDir, err := getHinataDir("data")
+	if err != nil {
+		return false, err
+	}
+	p, err := readKDFParams(dataDir)
+	return p != nil, err
+}
+
+// SetPassphrase protects all saved keys with passphrase, replacing any
+// previous one. An empty passphrase removes the protection. If a
+// passphrase is already set, the keys must be unlocked.
+func SetPassphrase(passphrase string) error {
+	configDir, err := getHinataDir("config")
+	if err != nil {
+		return err
+	}
+	dataDir, err := getHinataDir("data")
+	if err != nil {
+		return err
+	}
+	if err := ensureLocalKey(dataDir); err != nil {
+		return err
+	}
+
+	s, err := openStore(configDir, dataDir)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]string, len(s.entries))
+	for _, e := range s.entries {
+		apiKey, err := s.decrypt(e)
+		if err != nil {
+			return err
+		}
+		keys[e.name] = apiKey
+	}
+
+	// The keys are re-encrypted before keystore.json changes, and each file
+	// is replaced atomically, so the keys are never left without the
+	// parameters they were encrypted with for longer than it takes to
+	// rename a file.
+	var params []byte
+	if passphrase == "" {
+		s.params, s.passKey = nil, nil
+	} else {
+		p, key, err := newKDFParams(passphrase)
+		if err != nil {
+			return err
+		}
+		if params, err = json.MarshalIndent(p, "", "  "); err != nil {
+			return err
+		}
+		s.params, s.passKey = p, key
+	}
+
+	for i, e := range s.entries {
+		value, err := s.encrypt(e.name, keys[e.name])
+		if err != nil {
+			return err
+		}
+		s.entries[i].value = value
+	}
+	if err := s.save(); err != nil {
+		return err
+	}
+
+	if passphrase == "" {
+		if err := os.Remove(kdfParamsPath(dataDir)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		Lock()
+		return nil
+	}
+	if err := writeFileAtomic(kdfParamsPath(dataDir), params); err != nil {
+		return err
+	}
+	return writeSession(s.passKey, DefaultUnlockTimeout)
+}
@@ -0,0 +1,36 @@
+package llm
+
+import (
+	"context"
+	"net/http"
+)
+
+// adapter translates between our Message/StreamEvent types and one
+// provider wire format. A new adapter is created for every stream, so
+// implementations may keep per-stream state.
+type adapter interface {
+	// newRequest builds the HTTP request for a streaming completion.
+	newRequest(ctx context.Context, apiKey string, model string, messages []Message) (*http.Request, error)
+	// parseEvent handles one SSE event. done reports that the provider
+	// signalled the end of the stream.
+	parseEvent(event string, data string) (events []StreamEvent, done bool, err error)
+	// newModelsRequest builds the request for the provider's model list.
+	newModelsRequest(ctx context.Context, apiKey string, url string) (*http.Request, error)
+	// parseModels parses the response to newModelsRequest.
+	parseModels(body []byte) ([]ModelInfo, error)
+}
+
+func newAdapter(provider *Provider, config Config) adapter {
+	switch provider.ApiType {
+	case ApiTypeAnthropic:
+		return &anthropicAdapter{provider: provider, config: config}
+	default:
+		return &openAIAdapter{provider: provider, config: config}
+	}
+}
+
+func setExtraHeaders(req *http.Request, provider *Provider) {
+	for k, v := range provider.ExtraHeaders {
+		req.Header.Set(k, v)
+	}
+}
@@ -0,0 +1,278 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	anthropicVersion          = "2023-06-01"
+	anthropicDefaultMaxTokens = 8192
+)
+
+// anthropicAdapter speaks the native Anthropic Messages API.
+type anthropicAdapter struct {
+	provider *Provider
+	config   Config
+	usage    Usage
+	// toolCall is the tool_use block currently being streamed.
+	toolCall *ToolCall
+}
+
+func (a *anthropicAdapter) newRequest(ctx context.Context, apiKey string, model string, messages []Message) (*http.Request, error) {
+	payload := AnthropicRequest{
+		Model:     model,
+		MaxTokens: anthropicDefaultMaxTokens,
+		Stream:    true,
+	}
+
+	// The Messages API takes the system prompt as a top-level field rather
+	// than as a message.
+	var systemParts []string
+	for _, m := range messages {
+		if m.Role == "system" {
+			systemParts = append(systemParts, m.Content)
+			continue
+		}
+		appendAnthropicMessage(&payload.Messages, m)
+	}
+	// The Messages API has no response_format, so the schema becomes part
+	// of the system prompt.
+	if len(a.config.ResponseSchema) > 0 {
+		systemParts = append(systemParts, schemaInstruction(a.config.ResponseSchema))
+	}
+	payload.System = strings.Join(systemParts, "\n\n")
+	a.applyParams(&payload)
+
+	for _, t := range a.config.Tools {
+		schema := t.Function.Parameters
+		if len(schema) == 0 {
+			schema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		payload.Tools = append(payload.Tools, AnthropicTool{
+			Name:        t.Function.Name,
+			Description: t.Function.Description,
+			InputSchema: schema,
+		})
+	}
+
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", a.provider.ApiURL, bytes.NewReader(jsonPayload))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("x-api-key", apiKey)
+	}
+	req.Header.Set("anthropic-version", anthropicVersion)
+	setExtraHeaders(req, a.provider)
+
+	return req, nil
+}
+
+func (a *anthropicAdapter) applyParams(payload *AnthropicRequest) {
+	p := a.config.Params
+	payload.Temperature = p.Temperature
+	payload.TopP = p.TopP
+	payload.StopSequences = p.Stop
+	if p.MaxTokens != nil {
+		payload.MaxTokens = *p.MaxTokens
+	}
+
+	if p.ReasoningEffort == "" {
+		return
+	}
+
+	// Extended thinking counts against max_tokens, which must leave room
+	// for the answer, and does not allow sampling changes.
+	budget := reasoningBudget(p.ReasoningEffort)
+	payload.Thinking = &AnthropicThinking{Type: "enabled", BudgetTokens: budget}
+	if payload.MaxTokens <= budget {
+		payload.MaxTokens = budget + anthropicDefaultMaxTokens
+	}
+	if payload.Temperature != nil || payload.TopP != nil {
+		log.Printf("WARNING: temperature and top_p are ignored when Anthropic extended thinking is enabled.")
+		payload.Temperature = nil
+		payload.TopP = nil
+	}
+}
+
+// appendAnthropicMessage converts m to content blocks. Tool results become
+// tool_result blocks in a user message, merged with an immediately
+// preceding one so that all results for a turn travel together.
+func appendAnthropicMessage(messages *[]AnthropicMessage, m Message) {
+	role := m.Role
+	var blocks []AnthropicContentBlock
+
+	if m.Role == "tool" {
+		role = "user"
+		blocks = append(blocks, AnthropicContentBlock{
+			Type:      "tool_result",
+			ToolUseID: m.ToolCallID,
+			Content:   m.Content,
+		})
+	} else if len(m.Parts) > 0 {
+		for _, part := range m.Parts {
+			if part.Type == "image_url" {
+				blocks = append(blocks, AnthropicContentBlock{
+					Type: "image",
+					Source: &AnthropicImageSource{
+						Type:      "base64",
+						MediaType: part.ImageURL.mediaType(),
+						Data:      part.ImageURL.data(),
+					},
+				})
+			} else {
+				blocks = append(blocks, AnthropicContentBlock{Type: "text", Text: part.Text})
+			}
+		}
+	} else if m.Content != "" {
+		blocks = append(blocks, AnthropicContentBlock{Type: "text", Text: m.Content})
+	}
+
+	for _, tc := range m.ToolCalls {
+		input := json.RawMessage(tc.Function.Arguments)
+		if len(input) == 0 {
+			input = json.RawMessage("{}")
+		}
+		blocks = append(blocks, AnthropicContentBlock{
+			Type:  "tool_use",
+			ID:    tc.ID,
+			Name:  tc.Function.Name,
+			Input: input,
+		})
+	}
+
+	if n := len(*messages); m.Role == "tool" && n > 0 && (*messages)[n-1].Role == "user" {
+		(*messages)[n-1].Content = append((*messages)[n-1].Content, blocks...)
+		return
+	}
+
+	*messages = append(*messages, AnthropicMessage{Role: role, Content: blocks})
+}
+
+func (a *anthropicAdapter) parseEvent(event string, data string) ([]StreamEvent, bool, error) {
+	var ev AnthropicEvent
+	if err := json.Unmarshal([]byte(data), &ev); err != nil {
+		return nil, false, fmt.Errorf("invalid stream data %q: %w", data, err)
+	}
+
+	switch ev.Type {
+	case "message_start":
+		// Input tokens are reported up front, output tokens accumulate in
+		// message_delta events.
+		if ev.Message != nil && ev.Message.Usage != nil {
+			u := ev.Message.Usage
+			a.usage.PromptTokens = u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+			a.usage.CompletionTokens = u.OutputTokens
+		}
+	case "message_delta":
+		if ev.Usage != nil {
+			a.usage.CompletionTokens = ev.Usage.OutputTokens
+		}
+		if ev.Delta != nil && ev.Delta.StopReason != "" {
+			return []StreamEvent{{FinishReason: anthropicFinishReason(ev.Delta.StopReason)}}, false, nil
+		}
+	case "content_block_start":
+		if ev.ContentBlock != nil && ev.ContentBlock.Type == "tool_use" {
+			a.toolCall = &ToolCall{
+				ID:       ev.ContentBlock.ID,
+				Type:     "function",
+				Function: ToolCallFunction{Name: ev.ContentBlock.Name},
+			}
+		}
+	case "content_block_stop":
+		if a.toolCall != nil {
+			call := a.toolCall
+			a.toolCall = nil
+			if call.Function.Arguments == "" {
+				call.Function.Arguments = "{}"
+			}
+			return []StreamEvent{{ToolCall: call}}, false, nil
+		}
+	case "content_block_delta":
+		if ev.Delta == nil {
+			return nil, false, nil
+		}
+		switch ev.Delta.Type {
+		case "input_json_delta":
+			if a.toolCall != nil {
+				a.toolCall.Function.Arguments += ev.Delta.PartialJSON
+			}
+		case "text_delta":
+			if ev.Delta.Text != "" {
+				return []StreamEvent{{Content: ev.Delta.Text}}, false, nil
+			}
+		case "thinking_delta":
+			if a.config.IncludeReasoning && ev.Delta.Thinking != "" {
+				return []StreamEvent{{Reasoning: ev.Delta.Thinking}}, false, nil
+			}
+		}
+	case "message_stop":
+		if a.usage.PromptTokens > 0 || a.usage.CompletionTokens > 0 {
+			usage := a.usage
+			return []StreamEvent{{Usage: &usage}}, true, nil
+		}
+		return nil, true, nil
+	case "error":
+		return nil, false, newAPIError(a.provider.Name, 0, []byte(data))
+	}
+
+	return nil, false, nil
+}
+
+// anthropicFinishReason maps stop_reason to the OpenAI-style values.
+func anthropicFinishReason(stopReason string) string {
+	switch stopReason {
+	case "end_turn", "stop_sequence", "pause_turn":
+		return FinishStop
+	case "max_tokens":
+		return FinishLength
+	case "tool_use":
+		return FinishToolCalls
+	case "refusal":
+		return FinishContentFilter
+	}
+	return stopReason
+}
+
+func (a *anthropicAdapter) newModelsRequest(ctx context.Context, apiKey string, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url+"?limit=1000", nil)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey != "" {
+		req.Header.Set("x-api-key", apiKey)
+	}
+	req.Header.Set("anthropic-version", anthropicVersion)
+	setExtraHeaders(req, a.provider)
+	return req, nil
+}
+
+func (a *anthropicAdapter) parseModels(body []byte) ([]ModelInfo, error) {
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+
+	models := make([]ModelInfo, 0, len(list.Data))
+	for _, m := range list.Data {
+		models = append(models, ModelInfo{ID: m.ID})
+	}
+	return models, nil
+}
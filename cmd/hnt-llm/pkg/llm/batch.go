@@ -0,0 +1,341 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BatchRequest is one line of a batch input file. Exactly one of Messages
+// and Input is set; Input is a conversation in the hnt tag format.
+type BatchRequest struct {
+	ID       string    `json:"id,omitempty"`
+	Messages []Message `json:"messages,omitempty"`
+	Input    string    `json:"input,omitempty"`
+	System   string    `json:"system,omitempty"`
+	// Model and Params override the defaults of the batch.
+	Model  string  `json:"model,omitempty"`
+	Params *Params `json:"params,omitempty"`
+}
+
+// BatchResult is one line of a batch output file. Line is the input line
+// it answers, counting from 1.
+type BatchResult struct {
+	Line         int    `json:"line"`
+	ID           string `json:"id,omitempty"`
+	Model        string `json:"model,omitempty"`
+	Content      string `json:"content,omitempty"`
+	Reasoning    string `json:"reasoning,omitempty"`
+	FinishReason string `json:"finish_reason,omitempty"`
+	Usage        *Usage `json:"usage,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+type BatchOptions struct {
+	// Config holds the defaults for every request.
+	Config Config
+	// Concurrency is the number of requests in flight. Zero means 1.
+	Concurrency int
+	// RateLimits caps the requests per minute started for each provider.
+	RateLimits map[string]float64
+	// After skips input lines up to and including this one, as returned
+	// by ResumeBatchOutput.
+	After int
+}
+
+// BatchSummary counts the requests of a RunBatch call.
+type BatchSummary struct {
+	Succeeded int
+	Failed    int
+	Skipped   int
+	Usage     Usage
+}
+
+type indexedResult struct {
+	index  int
+	result BatchResult
+}
+
+type batchItem struct {
+	line int
+	req  BatchRequest
+	err  error
+}
+
+// RunBatch reads JSONL requests from in and writes one JSONL result per
+// request to out, in input order. Failed requests are reported in their
+// result rather than stopping the batch; the error is only for I/O
+// failures and cancellation.
+func RunBatch(ctx context.Context, in io.Reader, out io.Writer, opts BatchOptions) (BatchSummary, error) {
+	var summary BatchSummary
+	items, err := readBatch(in)
+	if err != nil {
+		return summary, err
+	}
+
+	var pending []batchItem
+	for _, item := range items {
+		if item.line <= opts.After {
+			summary.Skipped++
+			continue
+		}
+		pending = append(pending, item)
+	}
+
+	concurrency := max(opts.Concurrency, 1)
+	limiters := map[string]*rateLimiter{}
+	for provider, perMinute := range opts.RateLimits {
+		if perMinute > 0 {
+			limiters[provider] = &rateLimiter{interval: time.Duration(float64(time.Minute) / perMinute)}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Results are written in input order, so finished requests wait for
+	// slower ones before them. The window bounds how many can wait.
+	window := make(chan struct{}, 4*concurrency)
+	jobs := make(chan int)
+	results := make(chan indexedResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				result := runBatchItem(ctx, opts.Config, pending[index], limiters)
+				results <- indexedResult{index, result}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for i := range pending {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	done := make(map[int]BatchResult)
+	next := 0
+	var writeErr error
+	for r := range results {
+		done[r.index] = r.result
+		// Once cancelled, requests fail with the context's error, which
+		// must not be recorded as their result.
+		for ; writeErr == nil && ctx.Err() == nil; next++ {
+			result, ok := done[next]
+			if !ok {
+				break
+			}
+			delete(done, next)
+			<-window
+
+			if writeErr = writeBatchResult(out, result); writeErr != nil {
+				cancel()
+				break
+			}
+			if result.Error != "" {
+				summary.Failed++
+			} else {
+				summary.Succeeded++
+			}
+			if result.Usage != nil {
+				summary.Usage.Add(*result.Usage)
+			}
+		}
+	}
+
+	if writeErr != nil {
+		return summary, writeErr
+	}
+	if next < len(pending) {
+		return summary, ctx.Err()
+	}
+	return summary, nil
+}
+
+func readBatch(in io.Reader) ([]batchItem, error) {
+	var items []batchItem
+	reader := bufio.NewReader(in)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			item := batchItem{line: line}
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&item.req); err != nil {
+				item.err = fmt.Errorf("invalid request: %w", err)
+			} else if (len(item.req.Messages) > 0) == (item.req.Input != "") {
+				item.err = errors.New("invalid request: expected either messages or input")
+			}
+			items = append(items, item)
+		}
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func runBatchItem(ctx context.Context, defaults Config, item batchItem, limiters map[string]*rateLimiter) BatchResult {
+	result := BatchResult{Line: item.line, ID: item.req.ID}
+	fail := func(err error) BatchResult {
+		result.Error = err.Error()
+		return result
+	}
+	if item.err != nil {
+		return fail(item.err)
+	}
+
+	config := defaults
+	req := item.req
+	if req.Model != "" {
+		config.Model = req.Model
+	}
+	if req.Params != nil {
+		config.Params = config.Params.Merge(*req.Params)
+	}
+	if req.System != "" {
+		config.SystemPrompt = req.System
+	}
+
+	messages := req.Messages
+	if req.Input != "" {
+		var err error
+		if messages, err = BuildMessages(req.Input, ""); err != nil {
+			return fail(err)
+		}
+	}
+
+	model, err := ResolveAliases(config.Model)
+	if err != nil {
+		return fail(err)
+	}
+	if models := SplitModelChain(model); len(models) > 0 {
+		providerName, _ := splitModel(models[0])
+		if limiter := limiters[providerName]; limiter != nil {
+			if err := limiter.wait(ctx); err != nil {
+				return fail(err)
+			}
+		}
+	}
+
+	stream := NewMessageStream(ctx, config, messages)
+	var content, reasoning strings.Builder
+	for stream.Next() {
+		ev := stream.Event()
+		content.WriteString(ev.Content)
+		reasoning.WriteString(ev.Reasoning)
+		if ev.Retry != nil && ev.Retry.DiscardPartial {
+			content.Reset()
+			reasoning.Reset()
+		}
+		if ev.Model != "" {
+			result.Model = ev.Model
+		}
+		if ev.Usage != nil {
+			result.Usage = ev.Usage
+		}
+	}
+	result.Content = content.String()
+	result.Reasoning = reasoning.String()
+	result.FinishReason = stream.FinishReason()
+	if err := stream.Err(); err != nil {
+		return fail(err)
+	}
+	return result
+}
+
+func writeBatchResult(out io.Writer, result BatchResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(append(data, '\n'))
+	return err
+}
+
+// rateLimiter spaces out the requests to one provider.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(l.interval)
+	l.mu.Unlock()
+
+	select {
+	case <-time.After(time.Until(start)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ResumeBatchOutput prepares an existing output file to be continued. It
+// drops a partly written last line and returns the input line of the last
+// complete result, for BatchOptions.After.
+func ResumeBatchOutput(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	complete := bytes.LastIndexByte(data, '\n') + 1
+	if err := os.Truncate(path, int64(complete)); err != nil {
+		return 0, err
+	}
+
+	last := 0
+	for i, line := range bytes.Split(data[:complete], []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var result BatchResult
+		if err := json.Unmarshal(line, &result); err != nil {
+			return 0, fmt.Errorf("%s:%d: not a batch result: %w", path, i+1, err)
+		}
+		if result.Line <= last {
+			return 0, fmt.Errorf("%s:%d: results are out of order, is this the output of a batch?", path, i+1)
+		}
+		last = result.Line
+	}
+	return last, nil
+}
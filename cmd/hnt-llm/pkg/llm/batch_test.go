@@ -0,0 +1,151 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newEchoServer answers with the last user message. Messages that are
+// numbers are delayed by that many milliseconds.
+func newEchoServer(t *testing.T, requests *atomic.Int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		var body struct {
+			Messages []Message `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		last := body.Messages[len(body.Messages)-1].Content
+		var delay int
+		if _, err := fmt.Sscan(last, &delay); err == nil {
+			time.Sleep(time.Duration(delay) * time.Millisecond)
+		}
+		reply, _ := json.Marshal(last)
+		fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%s},\"finish_reason\":\"stop\"}],\"usage\":{\"prompt_tokens\":10,\"completion_tokens\":2}}\n\ndata: [DONE]\n\n", reply)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func readResults(t *testing.T, data []byte) []BatchResult {
+	t.Helper()
+	var results []BatchResult
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var r BatchResult
+		if err := json.Unmarshal(line, &r); err != nil {
+			t.Fatalf("invalid result %q: %v", line, err)
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func TestRunBatchOrder(t *testing.T) {
+	var requests atomic.Int32
+	server := newEchoServer(t, &requests)
+	withTestProvider(t, Provider{Name: "testbatch", ApiURL: server.URL, NoAuth: true})
+
+	input := strings.Join([]string{
+		`{"id": "slow", "messages": [{"role": "user", "content": "80"}]}`,
+		`{"input": "<hnt-user>20</hnt-user>"}`,
+		``,
+		`{"messages": [{"role": "user", "content": "0"}], "model": "testbatch/other"}`,
+		`{"messages": [], "input": ""}`,
+		`not json`,
+	}, "\n")
+
+	var out bytes.Buffer
+	opts := BatchOptions{Config: Config{Model: "testbatch/m", NoCache: true}, Concurrency: 3}
+	summary, err := RunBatch(context.Background(), strings.NewReader(input), &out, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := readResults(t, out.Bytes())
+	var lines []int
+	for _, r := range results {
+		lines = append(lines, r.Line)
+	}
+	if fmt.Sprint(lines) != "[1 2 4 5 6]" {
+		t.Fatalf("Expected results in input order, got lines %v", lines)
+	}
+	if r := results[0]; r.ID != "slow" || r.Content != "80" || r.Model != "testbatch/m" || r.Usage == nil || r.FinishReason != FinishStop {
+		t.Errorf("Unexpected first result %+v", r)
+	}
+	if results[2].Model != "testbatch/other" {
+		t.Errorf("Expected the model override, got %q", results[2].Model)
+	}
+	if results[3].Error == "" || results[4].Error == "" {
+		t.Errorf("Expected errors for invalid requests, got %+v", results[3:])
+	}
+	if summary.Succeeded != 3 || summary.Failed != 2 || summary.Usage.PromptTokens != 30 {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+}
+
+func TestResumeBatch(t *testing.T) {
+	var requests atomic.Int32
+	server := newEchoServer(t, &requests)
+	withTestProvider(t, Provider{Name: "testbatch", ApiURL: server.URL, NoAuth: true})
+
+	input := `{"input": "<hnt-user>a</hnt-user>"}
+{"input": "<hnt-user>b</hnt-user>"}
+{"input": "<hnt-user>c</hnt-user>"}
+`
+	path := filepath.Join(t.TempDir(), "out.jsonl")
+	partial := `{"line":1,"content":"a"}` + "\n" + `{"line":2,"cont`
+	if err := os.WriteFile(path, []byte(partial), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := ResumeBatchOutput(path)
+	if err != nil || after != 1 {
+		t.Fatalf("Expected to resume after line 1, got %d (%v)", after, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := BatchOptions{Config: Config{Model: "testbatch/m", NoCache: true}, After: after}
+	summary, err := RunBatch(context.Background(), strings.NewReader(input), f, opts)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if requests.Load() != 2 || summary.Skipped != 1 {
+		t.Errorf("Expected 2 requests and 1 skipped row, got %d and %+v", requests.Load(), summary)
+	}
+	data, _ := os.ReadFile(path)
+	var contents []string
+	for _, r := range readResults(t, data) {
+		contents = append(contents, r.Content)
+	}
+	if fmt.Sprint(contents) != "[a b c]" {
+		t.Errorf("Expected the torn line to be replaced, got %v", contents)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{interval: 20 * time.Millisecond}
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("Expected requests to be spaced out, took %s", elapsed)
+	}
+}
@@ -0,0 +1,350 @@
+package llm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The response cache is opt-in: set "cache": {"enabled": true} in the config
+// file or HINATA_LLM_CACHE=1.
+const CacheEnv = "HINATA_LLM_CACHE"
+
+const (
+	DefaultCacheTTL      = 7 * 24 * time.Hour
+	DefaultCacheMaxBytes = 100 * 1024 * 1024
+)
+
+type CacheSettings struct {
+	Enabled    bool   `json:"enabled"`
+	TTLSeconds *int   `json:"ttl_seconds,omitempty"`
+	MaxBytes   *int64 `json:"max_bytes,omitempty"`
+}
+
+type responseCache struct {
+	dir      string
+	ttl      time.Duration
+	maxBytes int64
+}
+
+// cachedResponse is a completed stream. Text is stored coalesced, so a hit
+// is replayed as one reasoning and one content event.
+type cachedResponse struct {
+	Model        string     `json:"model"`
+	CreatedAt    time.Time  `json:"created_at"`
+	Reasoning    string     `json:"reasoning,omitempty"`
+	Content      string     `json:"content"`
+	ToolCalls    []ToolCall `json:"tool_calls,omitempty"`
+	FinishReason string     `json:"finish_reason,omitempty"`
+}
+
+// CacheDir returns $XDG_CACHE_HOME/hinata/llm/responses.
+func CacheDir() (string, error) {
+	baseDir := os.Getenv("XDG_CACHE_HOME")
+	if baseDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		baseDir = filepath.Join(homeDir, ".cache")
+	}
+	return filepath.Join(baseDir, "hinata", "llm", "responses"), nil
+}
+
+// openCache returns the response cache, or nil when it is disabled.
+func (config Config) openCache() (*responseCache, error) {
+	if config.NoCache {
+		return nil, nil
+	}
+
+	s, err := LoadSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	var cs CacheSettings
+	if s.Cache != nil {
+		cs = *s.Cache
+	}
+	switch strings.ToLower(os.Getenv(CacheEnv)) {
+	case "1", "true", "yes":
+		cs.Enabled = true
+	case "0", "false", "no":
+		cs.Enabled = false
+	}
+	if !cs.Enabled {
+		return nil, nil
+	}
+
+	dir, err := CacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &responseCache{dir: dir, ttl: DefaultCacheTTL, maxBytes: DefaultCacheMaxBytes}
+	if cs.TTLSeconds != nil {
+		c.ttl = time.Duration(*cs.TTLSeconds) * time.Second
+	}
+	if cs.MaxBytes != nil {
+		c.maxBytes = *cs.MaxBytes
+	}
+	return c, nil
+}
+
+// cacheKey hashes everything that affects the response.
+func cacheKey(provider string, model string, messages []Message, config Config) (string, error) {
+	data, err := json.Marshal(struct {
+		Provider         string          `json:"provider"`
+		Model            string          `json:"model"`
+		Messages         []Message       `json:"messages"`
+		Params           Params          `json:"params"`
+		Tools            []Tool          `json:"tools,omitempty"`
+		ResponseSchema   json.RawMessage `json:"response_schema,omitempty"`
+		IncludeReasoning bool            `json:"include_reasoning"`
+	}{provider, model, messages, config.Params, config.Tools, config.ResponseSchema, config.IncludeReasoning})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (c *responseCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+// get returns the cached response for key. Expired entries are removed.
+func (c *responseCache) get(key string) (*cachedResponse, bool) {
+	path := c.path(key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	if c.ttl > 0 && time.Since(info.ModTime()) > c.ttl {
+		os.Remove(path)
+		return nil, false
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	var resp cachedResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, false
+	}
+	return &resp, true
+}
+
+// put stores the events of a response under key. Responses cut short by
+// the token limit or a content filter are not stored, so that a retry asks
+// the provider again.
+func (c *responseCache) put(key string, model string, events []StreamEvent) error {
+	resp := cachedResponse{Model: model, CreatedAt: time.Now()}
+	var content, reasoning strings.Builder
+	for _, ev := range events {
+		content.WriteString(ev.Content)
+		reasoning.WriteString(ev.Reasoning)
+		if ev.ToolCall != nil {
+			resp.ToolCalls = append(resp.ToolCalls, *ev.ToolCall)
+		}
+		if ev.FinishReason != "" {
+			resp.FinishReason = ev.FinishReason
+		}
+	}
+	if resp.FinishReason != FinishStop && resp.FinishReason != FinishToolCalls {
+		return nil
+	}
+	resp.Content = content.String()
+	resp.Reasoning = reasoning.String()
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	// Responses can contain anything from the conversation, so the cache
+	// is private like the call log.
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+
+	// Write through a temporary file so that concurrent readers never see
+	// a partial entry. CreateTemp makes it 0600.
+	tmp, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), c.path(key)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return c.prune()
+}
+
+// replay sends a cached response as stream events.
+func (r *cachedResponse) replay(emit func(StreamEvent)) {
+	emit(StreamEvent{Model: r.Model, Cached: true})
+	if r.Reasoning != "" {
+		emit(StreamEvent{Reasoning: r.Reasoning})
+	}
+	if r.Content != "" {
+		emit(StreamEvent{Content: r.Content})
+	}
+	for i := range r.ToolCalls {
+		emit(StreamEvent{ToolCall: &r.ToolCalls[i]})
+	}
+	if r.FinishReason != "" {
+		emit(StreamEvent{FinishReason: r.FinishReason})
+	}
+}
+
+type cacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func listCacheEntries(dir string) ([]cacheEntry, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []cacheEntry
+	for _, de := range dirEntries {
+		if de.IsDir() || !strings.HasSuffix(de.Name(), ".json") {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, cacheEntry{
+			path:    filepath.Join(dir, de.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+	return entries, nil
+}
+
+// prune removes expired entries, then the oldest ones until the cache fits
+// in maxBytes.
+func (c *responseCache) prune() error {
+	entries, err := listCacheEntries(c.dir)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	var live []cacheEntry
+	for _, e := range entries {
+		if c.ttl > 0 && time.Since(e.modTime) > c.ttl {
+			os.Remove(e.path)
+			continue
+		}
+		total += e.size
+		live = append(live, e)
+	}
+
+	for _, e := range live {
+		if c.maxBytes <= 0 || total <= c.maxBytes {
+			break
+		}
+		if err := os.Remove(e.path); err == nil {
+			total -= e.size
+		}
+	}
+	return nil
+}
+
+// CacheStats describes the contents of the response cache.
+type CacheStats struct {
+	Dir     string
+	Enabled bool
+	Entries int
+	Bytes   int64
+	Expired int
+	Oldest  time.Time
+	Newest  time.Time
+}
+
+func GetCacheStats() (CacheStats, error) {
+	dir, err := CacheDir()
+	if err != nil {
+		return CacheStats{}, err
+	}
+	stats := CacheStats{Dir: dir}
+
+	c, err := Config{}.openCache()
+	if err != nil {
+		return stats, err
+	}
+	stats.Enabled = c != nil
+	ttl := DefaultCacheTTL
+	if c != nil {
+		ttl = c.ttl
+	}
+
+	entries, err := listCacheEntries(dir)
+	if err != nil {
+		return stats, err
+	}
+	for _, e := range entries {
+		stats.Entries++
+		stats.Bytes += e.size
+		if ttl > 0 && time.Since(e.modTime) > ttl {
+			stats.Expired++
+		}
+	}
+	if len(entries) > 0 {
+		stats.Oldest = entries[0].modTime
+		stats.Newest = entries[len(entries)-1].modTime
+	}
+	return stats, nil
+}
+
+// ClearCache removes every cached response and returns how many there were.
+func ClearCache() (int, error) {
+	dir, err := CacheDir()
+	if err != nil {
+		return 0, err
+	}
+
+	entries, err := listCacheEntries(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, e := range entries {
+		if err := os.Remove(e.path); err != nil {
+			return removed, fmt.Errorf("failed to remove %s: %w", e.path, err)
+		}
+		removed++
+	}
+	return removed, nil
+}
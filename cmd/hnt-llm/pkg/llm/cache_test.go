@@ -0,0 +1,122 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	requests := 0
+	finish := FinishStop
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":\"answer %d\"},\"finish_reason\":%q}]}\n\n", requests, finish)
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testcache", ApiURL: server.URL, NoAuth: true})
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv(CacheEnv, "1")
+
+	run := func(config Config, prompt string) (string, bool) {
+		eventChan, errChan := StreamLLMResponse(context.Background(), config, prompt)
+		content, cached := "", false
+		for ev := range eventChan {
+			content += ev.Content
+			cached = cached || ev.Cached
+		}
+		if err := <-errChan; err != nil {
+			t.Fatalf("unexpected stream error: %v", err)
+		}
+		return content, cached
+	}
+
+	config := Config{Model: "testcache/m"}
+	if content, cached := run(config, "hello"); content != "answer 1" || cached {
+		t.Fatalf("Expected a fresh response, got %q (cached %v)", content, cached)
+	}
+	if content, cached := run(config, "hello"); content != "answer 1" || !cached || requests != 1 {
+		t.Errorf("Expected a cache hit, got %q (cached %v) after %d requests", content, cached, requests)
+	}
+
+	if content, _ := run(config, "something else"); content != "answer 2" {
+		t.Errorf("Expected a different prompt to miss, got %q", content)
+	}
+
+	temp := 0.5
+	if content, _ := run(Config{Model: "testcache/m", Params: Params{Temperature: &temp}}, "hello"); content != "answer 3" {
+		t.Errorf("Expected different parameters to miss, got %q", content)
+	}
+
+	schema := json.RawMessage(`{"type":"object"}`)
+	if content, _ := run(Config{Model: "testcache/m", ResponseSchema: schema}, "hello"); content != "answer 4" {
+		t.Errorf("Expected a response schema to miss, got %q", content)
+	}
+
+	if content, cached := run(Config{Model: "testcache/m", NoCache: true}, "hello"); content != "answer 5" || cached {
+		t.Errorf("Expected NoCache to bypass the cache, got %q", content)
+	}
+
+	// A truncated answer is not cached.
+	finish = FinishLength
+	noContinue := Config{Model: "testcache/m", MaxContinuations: -1}
+	run(noContinue, "truncated")
+	if content, cached := run(noContinue, "truncated"); content != "answer 7" || cached {
+		t.Errorf("Expected a truncated response not to be cached, got %q (cached %v)", content, cached)
+	}
+
+	dir, _ := CacheDir()
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Expected a private cache directory, got %v (%v)", info.Mode(), err)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if info, err := entry.Info(); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("Expected private cache entries, got %s", entry.Name())
+		}
+	}
+
+	stats, err := GetCacheStats()
+	if err != nil || !stats.Enabled || stats.Entries != 4 {
+		t.Errorf("Unexpected stats %+v (%v)", stats, err)
+	}
+	if removed, err := ClearCache(); err != nil || removed != 4 {
+		t.Errorf("Expected 4 entries cleared, got %d (%v)", removed, err)
+	}
+}
+
+func TestCachePrune(t *testing.T) {
+	dir := t.TempDir()
+	c := &responseCache{dir: dir, ttl: time.Hour, maxBytes: 250}
+
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := c.put(key, "p/m", []StreamEvent{{Content: "some cached content", FinishReason: FinishStop}}); err != nil {
+			t.Fatal(err)
+		}
+		// Spread modification times so that pruning order is defined.
+		mtime := time.Now().Add(time.Duration(i-4) * time.Minute)
+		os.Chtimes(c.path(key), mtime, mtime)
+	}
+	c.prune()
+
+	if _, ok := c.get("key0"); ok {
+		t.Error("Expected the oldest entry to be pruned")
+	}
+	if _, ok := c.get("key3"); !ok {
+		t.Error("Expected the newest entry to be kept")
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(c.path("key3"), old, old)
+	if _, ok := c.get("key3"); ok {
+		t.Error("Expected an expired entry to miss")
+	}
+}
@@ -0,0 +1,413 @@
+package llm
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The call log is opt-in: set "log": {"enabled": true} in the config file or
+// HINATA_LLM_LOG=1.
+const LogEnv = "HINATA_LLM_LOG"
+
+const (
+	DefaultLogMaxBytes = 20 * 1024 * 1024
+	DefaultLogMaxFiles = 5
+)
+
+type LogSettings struct {
+	Enabled bool `json:"enabled"`
+	// MaxBytes is the size at which the log is rotated.
+	MaxBytes *int64 `json:"max_bytes,omitempty"`
+	// MaxFiles is the number of rotated files kept besides the current one.
+	MaxFiles *int `json:"max_files,omitempty"`
+}
+
+// LogRecord is one line of the call log, written when a stream ends.
+type LogRecord struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// Requested is the model, alias or chain asked for, and Model the
+	// provider/model that answered, if any did.
+	Requested string `json:"requested"`
+	Provider  string `json:"provider,omitempty"`
+	Model     string `json:"model,omitempty"`
+	// Key is the name of the API key, never the key itself.
+	Key      string    `json:"key,omitempty"`
+	Messages []Message `json:"messages"`
+	Params   Params    `json:"params"`
+	Tools    []Tool    `json:"tools,omitempty"`
+
+	Output       string     `json:"output"`
+	Reasoning    string     `json:"reasoning,omitempty"`
+	ToolCalls    []ToolCall `json:"tool_calls,omitempty"`
+	FinishReason string     `json:"finish_reason,omitempty"`
+	Usage        *Usage     `json:"usage,omitempty"`
+	Retries      int        `json:"retries,omitempty"`
+	Fallbacks    int        `json:"fallbacks,omitempty"`
+	// Continuations counts the requests that continued a response cut
+	// off by the token limit.
+	Continuations int  `json:"continuations,omitempty"`
+	Cached        bool `json:"cached,omitempty"`
+
+	LatencyMs int64 `json:"latency_ms"`
+	// TTFTMs is the time to the first content or reasoning token.
+	TTFTMs *int64 `json:"ttft_ms,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// LogPath returns $XDG_DATA_HOME/hinata/llm/log.jsonl. Rotated files are
+// log.1.jsonl, log.2.jsonl and so on, oldest last.
+func LogPath() (string, error) {
+	baseDir := os.Getenv("XDG_DATA_HOME")
+	if baseDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		baseDir = filepath.Join(homeDir, ".local", "share")
+	}
+	return filepath.Join(baseDir, "hinata", "llm", "log.jsonl"), nil
+}
+
+func rotatedLogPath(path string, n int) string {
+	if n == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%d.jsonl", strings.TrimSuffix(path, ".jsonl"), n)
+}
+
+type callLog struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+}
+
+// openCallLog returns the call log, or nil when it is disabled.
+func openCallLog() (*callLog, error) {
+	s, err := LoadSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	var ls LogSettings
+	if s.Log != nil {
+		ls = *s.Log
+	}
+	switch strings.ToLower(os.Getenv(LogEnv)) {
+	case "1", "true", "yes":
+		ls.Enabled = true
+	case "0", "false", "no":
+		ls.Enabled = false
+	}
+	if !ls.Enabled {
+		return nil, nil
+	}
+
+	path, err := LogPath()
+	if err != nil {
+		return nil, err
+	}
+	l := &callLog{path: path, maxBytes: DefaultLogMaxBytes, maxFiles: DefaultLogMaxFiles}
+	if ls.MaxBytes != nil {
+		l.maxBytes = *ls.MaxBytes
+	}
+	if ls.MaxFiles != nil {
+		l.maxFiles = *ls.MaxFiles
+	}
+	return l, nil
+}
+
+// logMu serialises writes and rotation within the process. Records are
+// small single writes to a file opened for appending, so concurrent
+// processes do not interleave them.
+var logMu sync.Mutex
+
+func (l *callLog) write(record LogRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return err
+	}
+	if info, err := os.Stat(l.path); err == nil && l.maxBytes > 0 && info.Size()+int64(len(data)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+// rotate shifts log.N.jsonl to log.N+1.jsonl, dropping the oldest, and
+// moves the current log to log.1.jsonl.
+func (l *callLog) rotate() error {
+	os.Remove(rotatedLogPath(l.path, l.maxFiles))
+	for n := l.maxFiles - 1; n >= 0; n-- {
+		err := os.Rename(rotatedLogPath(l.path, n), rotatedLogPath(l.path, n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if l.maxFiles == 0 {
+		return os.Remove(l.path)
+	}
+	return nil
+}
+
+// callRecorder builds the record of one call from its events.
+type callRecorder struct {
+	record  LogRecord
+	start   time.Time
+	output  strings.Builder
+	reason  strings.Builder
+	mu      sync.Mutex
+	secrets []string
+}
+
+type callRecorderKey struct{}
+
+// addSecret registers a key used by the call, to be redacted from the
+// record wherever it appears.
+func addSecret(ctx context.Context, secret string) {
+	if r, ok := ctx.Value(callRecorderKey{}).(*callRecorder); ok && secret != "" {
+		r.mu.Lock()
+		r.secrets = append(r.secrets, secret)
+		r.mu.Unlock()
+	}
+}
+
+func (r *callRecorder) add(ev StreamEvent) {
+	if ev.Retry != nil {
+		r.record.Retries++
+		if ev.Retry.DiscardPartial {
+			r.output.Reset()
+			r.reason.Reset()
+			r.record.ToolCalls = nil
+		}
+	}
+	if ev.Fallback != nil {
+		r.record.Fallbacks++
+	}
+	if ev.Continuation != nil {
+		r.record.Continuations++
+	}
+	if ev.Cached {
+		r.record.Cached = true
+	}
+	if ev.Model != "" {
+		r.record.Model, r.record.Key = ev.Model, ev.Key
+		r.record.Provider, _ = splitModel(ev.Model)
+	}
+	if (ev.Content != "" || ev.Reasoning != "") && r.record.TTFTMs == nil {
+		ttft := time.Since(r.start).Milliseconds()
+		r.record.TTFTMs = &ttft
+	}
+	r.output.WriteString(ev.Content)
+	r.reason.WriteString(ev.Reasoning)
+	if ev.ToolCall != nil {
+		r.record.ToolCalls = append(r.record.ToolCalls, *ev.ToolCall)
+	}
+	if ev.FinishReason != "" {
+		r.record.FinishReason = ev.FinishReason
+	}
+	if ev.Usage != nil {
+		r.record.Usage = ev.Usage
+	}
+}
+
+func (r *callRecorder) finish(err error) LogRecord {
+	record := r.record
+	record.LatencyMs = time.Since(r.start).Milliseconds()
+	record.Output = r.output.String()
+	record.Reasoning = r.reason.String()
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	redact := func(s string) string { return redactSecrets(s, r.secrets) }
+	record.Output = redact(record.Output)
+	record.Reasoning = redact(record.Reasoning)
+	record.Error = redact(record.Error)
+	record.ToolCalls = redactToolCalls(record.ToolCalls, redact)
+	record.Messages = make([]Message, len(r.record.Messages))
+	for i, m := range r.record.Messages {
+		m.Content = redact(m.Content)
+		m.ToolCalls = redactToolCalls(m.ToolCalls, redact)
+		if len(m.Parts) > 0 {
+			parts := make([]ContentPart, len(m.Parts))
+			for j, p := range m.Parts {
+				p.Text = redact(p.Text)
+				if p.ImageURL != nil {
+					p.ImageURL = &ImageURL{URL: elideDataURL(p.ImageURL.URL)}
+				}
+				parts[j] = p
+			}
+			m.Parts = parts
+		}
+		record.Messages[i] = m
+	}
+	return record
+}
+
+// redactToolCalls returns a copy of calls with redact applied to their
+// arguments.
+func redactToolCalls(calls []ToolCall, redact func(string) string) []ToolCall {
+	if len(calls) == 0 {
+		return calls
+	}
+	redacted := make([]ToolCall, len(calls))
+	for i, call := range calls {
+		call.Function.Arguments = redact(call.Function.Arguments)
+		redacted[i] = call
+	}
+	return redacted
+}
+
+// keyPattern matches the common API key formats, so that keys pasted into
+// a conversation are not written to the log.
+var keyPattern = regexp.MustCompile(`\b(sk-[A-Za-z0-9_\-]{20,}|AIza[0-9A-Za-z_\-]{35}|gsk_[A-Za-z0-9]{20,}|xai-[A-Za-z0-9]{20,})`)
+
+func redactSecrets(s string, secrets []string) string {
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, "[REDACTED]")
+	}
+	return keyPattern.ReplaceAllString(s, "[REDACTED]")
+}
+
+// elideDataURL keeps the media type of an inline image but not its data.
+func elideDataURL(url string) string {
+	header, data, ok := strings.Cut(url, ",")
+	if !ok || !strings.HasPrefix(header, "data:") {
+		return url
+	}
+	return fmt.Sprintf("%s,[%d bytes]", header, len(data))
+}
+
+// logCall records the call made with config and messages in the call log,
+// if it is enabled, by observing its events on their way to the caller.
+func logCall(ctx context.Context, config Config, messages []Message, start func(context.Context) (<-chan StreamEvent, <-chan error)) (<-chan StreamEvent, <-chan error) {
+	l, err := openCallLog()
+	if err != nil {
+		log.Printf("WARNING: failed to open the call log: %v", err)
+	}
+	if l == nil {
+		return start(ctx)
+	}
+
+	r := &callRecorder{start: time.Now()}
+	r.record = LogRecord{
+		ID:        newLogID(),
+		Time:      r.start,
+		Requested: config.Model,
+		Messages:  withSystemPrompt(messages, config.SystemPrompt),
+		Params:    config.Params,
+		Tools:     config.Tools,
+	}
+	events, errs := start(context.WithValue(ctx, callRecorderKey{}, r))
+
+	eventChan := make(chan StreamEvent, 100)
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(eventChan)
+		defer close(errChan)
+		for ev := range events {
+			r.add(ev)
+			eventChan <- ev
+		}
+		err := <-errs
+		if werr := l.write(r.finish(err)); werr != nil {
+			log.Printf("WARNING: failed to write the call log: %v", werr)
+		}
+		if err != nil {
+			errChan <- err
+		}
+	}()
+	return eventChan, errChan
+}
+
+func newLogID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ScanLog calls fn for each record of the call log, oldest first, across
+// the rotated files. Lines that cannot be parsed are skipped.
+func ScanLog(fn func(LogRecord) error) error {
+	path, err := LogPath()
+	if err != nil {
+		return err
+	}
+
+	var files []string
+	for n := 0; ; n++ {
+		p := rotatedLogPath(path, n)
+		if _, err := os.Stat(p); err != nil {
+			if n == 0 {
+				continue
+			}
+			break
+		}
+		files = append([]string{p}, files...)
+	}
+
+	for _, p := range files {
+		if err := scanLogFile(p, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanLogFile(path string, fn func(LogRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var record LogRecord
+			if json.Unmarshal(line, &record) == nil {
+				if err := fn(record); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
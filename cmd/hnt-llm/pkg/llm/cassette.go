@@ -0,0 +1,225 @@
+package llm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Cassettes record provider responses so that LLM calls can be replayed
+// without network access or API keys. HINATA_LLM_CASSETTE names the
+// directory, HINATA_LLM_CASSETTE_MODE is "replay" (the default) or
+// "record".
+const (
+	CassetteEnv     = "HINATA_LLM_CASSETTE"
+	CassetteModeEnv = "HINATA_LLM_CASSETTE_MODE"
+
+	CassetteReplay = "replay"
+	CassetteRecord = "record"
+)
+
+// errNoRecording is returned in replay mode for requests that were never
+// recorded. It is not retried.
+var errNoRecording = errors.New("no recording for this request in cassette")
+
+// cassetteEntry is the metadata saved next to a recorded response body.
+type cassetteEntry struct {
+	Method  string          `json:"method"`
+	URL     string          `json:"url"`
+	Request json.RawMessage `json:"request"`
+	Status  int             `json:"status"`
+	Header  http.Header     `json:"header,omitempty"`
+}
+
+type cassette struct {
+	dir  string
+	mode string
+}
+
+// cassetteFromEnv returns the configured cassette, or nil when recording
+// and replay are off.
+func cassetteFromEnv() (*cassette, error) {
+	dir := os.Getenv(CassetteEnv)
+	if dir == "" {
+		return nil, nil
+	}
+
+	mode := os.Getenv(CassetteModeEnv)
+	switch mode {
+	case "":
+		mode = CassetteReplay
+	case CassetteReplay, CassetteRecord:
+	default:
+		return nil, fmt.Errorf("%s must be %q or %q, got %q", CassetteModeEnv, CassetteReplay, CassetteRecord, mode)
+	}
+
+	return &cassette{dir: dir, mode: mode}, nil
+}
+
+func (c *cassette) replaying() bool {
+	return c != nil && c.mode == CassetteReplay
+}
+
+// transport wraps next so that requests are recorded or replayed.
+func (c *cassette) transport(next http.RoundTripper) http.RoundTripper {
+	if c == nil {
+		return next
+	}
+	return &cassetteTransport{cassette: c, next: next}
+}
+
+// requestHash identifies a request by method, URL and body. Headers are
+// left out so that API keys never affect or end up in a recording.
+func requestHash(method, url string, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", method, url)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+type cassetteTransport struct {
+	cassette *cassette
+	next     http.RoundTripper
+}
+
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	hash := requestHash(req.Method, req.URL.String(), body)
+	metaPath := filepath.Join(t.cassette.dir, hash+".json")
+	bodyPath := filepath.Join(t.cassette.dir, hash+".sse")
+
+	if t.cassette.mode == CassetteReplay {
+		return replayResponse(req, metaPath, bodyPath)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(t.cassette.dir, 0755); err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to create cassette directory: %w", err)
+	}
+
+	entry := cassetteEntry{
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Request: requestJSON(body),
+		Status:  resp.StatusCode,
+		Header:  http.Header{"Content-Type": resp.Header.Values("Content-Type")},
+	}
+	resp.Body = &recordingBody{body: resp.Body, entry: entry, metaPath: metaPath, bodyPath: bodyPath}
+	return resp, nil
+}
+
+// requestJSON keeps a readable copy of the request in the recording.
+func requestJSON(body []byte) json.RawMessage {
+	if json.Valid(body) {
+		return body
+	}
+	data, _ := json.Marshal(string(body))
+	return data
+}
+
+func replayResponse(req *http.Request, metaPath, bodyPath string) (*http.Response, error) {
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w (%s); record it with %s=%s", errNoRecording, filepath.Base(metaPath), CassetteModeEnv, CassetteRecord)
+		}
+		return nil, err
+	}
+
+	var entry cassetteEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", metaPath, err)
+	}
+
+	body, err := os.ReadFile(bodyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	header := entry.Header
+	if header == nil {
+		header = http.Header{}
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.Status, http.StatusText(entry.Status)),
+		StatusCode:    entry.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// recordingBody copies the response as it is read and saves it once the
+// stream has ended. The rest of the body is drained on Close, since readers
+// stop at the provider's end-of-stream event. Streams that break off are
+// not recorded.
+type recordingBody struct {
+	body     io.ReadCloser
+	buf      bytes.Buffer
+	complete bool
+
+	entry    cassetteEntry
+	metaPath string
+	bodyPath string
+}
+
+func (r *recordingBody) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.buf.Write(p[:n])
+	if err == io.EOF {
+		r.complete = true
+	}
+	return n, err
+}
+
+func (r *recordingBody) Close() error {
+	if !r.complete {
+		if _, err := io.Copy(&r.buf, r.body); err == nil {
+			r.complete = true
+		}
+	}
+
+	err := r.body.Close()
+	if !r.complete {
+		return err
+	}
+
+	meta, merr := json.MarshalIndent(r.entry, "", "  ")
+	if merr != nil {
+		return merr
+	}
+	if werr := os.WriteFile(r.bodyPath, r.buf.Bytes(), 0644); werr != nil {
+		return werr
+	}
+	if werr := os.WriteFile(r.metaPath, append(meta, '\n'), 0644); werr != nil {
+		return werr
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCassetteRecordReplay(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"recorded\"}}]}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testcassette", ApiURL: server.URL, EnvVar: "HNT_TEST_CASSETTE_KEY"})
+	dir := t.TempDir()
+	t.Setenv(CassetteEnv, dir)
+	config := Config{Model: "testcassette/m"}
+
+	t.Setenv("HNT_TEST_CASSETTE_KEY", "secret-key")
+	t.Setenv(CassetteModeEnv, CassetteRecord)
+	eventChan, errChan := StreamLLMResponse(context.Background(), config, "hello")
+	content, _ := collect(t, eventChan, errChan)
+	if content != "recorded" || requests != 1 {
+		t.Fatalf("Expected one recorded request, got %q after %d requests", content, requests)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 2 {
+		t.Fatalf("Expected a metadata and a body file, got %v", files)
+	}
+	for _, f := range files {
+		data, _ := os.ReadFile(f)
+		if strings.Contains(string(data), "secret-key") {
+			t.Errorf("API key leaked into %s", f)
+		}
+	}
+
+	// Replay needs neither the server nor a key.
+	t.Setenv("HNT_TEST_CASSETTE_KEY", "")
+	t.Setenv(CassetteModeEnv, CassetteReplay)
+	eventChan, errChan = StreamLLMResponse(context.Background(), config, "hello")
+	content, _ = collect(t, eventChan, errChan)
+	if content != "recorded" || requests != 1 {
+		t.Errorf("Expected a replay without network access, got %q after %d requests", content, requests)
+	}
+}
+
+func TestCassetteMissingRecording(t *testing.T) {
+	withTestProvider(t, Provider{Name: "testcassette", ApiURL: "http://127.0.0.1:1", NoAuth: true})
+	t.Setenv(CassetteEnv, t.TempDir())
+	t.Setenv(CassetteModeEnv, "")
+
+	eventChan, errChan := StreamLLMResponse(context.Background(), Config{Model: "testcassette/m"}, "not recorded")
+	for range eventChan {
+	}
+	err := <-errChan
+	if err == nil || !strings.Contains(err.Error(), "no recording") {
+		t.Errorf("Expected a missing recording error, got %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HTTPSettings is the "http" section of the config file. Unset timeouts
+// use the defaults below; a negative value disables one.
+type HTTPSettings struct {
+	// Proxy is an http, https or socks5 URL. Without it the usual
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY variables apply.
+	Proxy                   string `json:"proxy,omitempty"`
+	DialTimeoutMs           *int   `json:"dial_timeout_ms,omitempty"`
+	TLSHandshakeTimeoutMs   *int   `json:"tls_handshake_timeout_ms,omitempty"`
+	ResponseHeaderTimeoutMs *int   `json:"response_header_timeout_ms,omitempty"`
+	// IdleTimeoutMs is how long a response stream may go without
+	// receiving any data, including keep-alive comments.
+	IdleTimeoutMs *int `json:"idle_timeout_ms,omitempty"`
+}
+
+const (
+	DefaultDialTimeout           = 10 * time.Second
+	DefaultTLSHandshakeTimeout   = 10 * time.Second
+	DefaultResponseHeaderTimeout = 2 * time.Minute
+	DefaultIdleTimeout           = 5 * time.Minute
+)
+
+var (
+	clientMu sync.Mutex
+	client   *http.Client
+)
+
+// SetHTTPClient replaces the client used for all requests. Passing nil
+// restores the default, built from the config file on next use.
+func SetHTTPClient(c *http.Client) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	client = c
+}
+
+// httpClient returns the shared client. Its transport keeps connections
+// alive between requests and negotiates HTTP/2 where the server offers it.
+func httpClient() (*http.Client, error) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	if client != nil {
+		return client, nil
+	}
+
+	s, err := LoadSettings()
+	if err != nil {
+		return nil, err
+	}
+	var hs HTTPSettings
+	if s.HTTP != nil {
+		hs = *s.HTTP
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if hs.Proxy != "" {
+		proxyURL, err := url.Parse(hs.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %w", hs.Proxy, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   settingDuration(hs.DialTimeoutMs, DefaultDialTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+	client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 proxy,
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   10,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   settingDuration(hs.TLSHandshakeTimeoutMs, DefaultTLSHandshakeTimeout),
+			ResponseHeaderTimeout: settingDuration(hs.ResponseHeaderTimeoutMs, DefaultResponseHeaderTimeout),
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+	return client, nil
+}
+
+// settingDuration converts an optional millisecond setting. Negative
+// values give zero, which disables the timeout.
+func settingDuration(ms *int, def time.Duration) time.Duration {
+	if ms == nil {
+		return def
+	}
+	if *ms < 0 {
+		return 0
+	}
+	return time.Duration(*ms) * time.Millisecond
+}
+
+func (config Config) idleTimeout() (time.Duration, error) {
+	if config.IdleTimeout != 0 {
+		return max(config.IdleTimeout, 0), nil
+	}
+	s, err := LoadSettings()
+	if err != nil {
+		return 0, err
+	}
+	if s.HTTP != nil {
+		return settingDuration(s.HTTP.IdleTimeoutMs, DefaultIdleTimeout), nil
+	}
+	return DefaultIdleTimeout, nil
+}
+
+// idleBody calls onIdle when no data has been read for timeout.
+type idleBody struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func newIdleBody(body io.ReadCloser, timeout time.Duration, onIdle func()) *idleBody {
+	return &idleBody{ReadCloser: body, timer: time.AfterFunc(timeout, onIdle), timeout: timeout}
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
+
+// Prewarm opens a connection to the provider of the first model in a
+// chain, so that the next request skips the TCP and TLS handshakes. It is
+// meant to run in the background while the user is still typing.
+func Prewarm(ctx context.Context, model string) error {
+	model, err := ResolveAliases(model)
+	if err != nil {
+		return err
+	}
+	models := SplitModelChain(model)
+	if len(models) == 0 {
+		return nil
+	}
+	providerName, _ := splitModel(models[0])
+	provider, err := LookupProvider(providerName)
+	if err != nil {
+		return err
+	}
+
+	tape, err := cassetteFromEnv()
+	if err != nil || tape.replaying() {
+		return err
+	}
+
+	c, err := httpClient()
+	if err != nil {
+		return err
+	}
+
+	// Any response will do, the connection is what stays in the pool.
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, provider.ApiURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
@@ -0,0 +1,85 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"partial\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testopenai", ApiURL: server.URL, NoAuth: true})
+
+	config := Config{Model: "testopenai/m", IdleTimeout: 50 * time.Millisecond, Retry: &RetryPolicy{MaxAttempts: 1}}
+	start := time.Now()
+	stream := NewStream(context.Background(), config, "hi")
+	content := ""
+	for stream.Next() {
+		content += stream.Event().Content
+	}
+
+	err := stream.Err()
+	if err == nil || !strings.Contains(err.Error(), "no data received") {
+		t.Fatalf("Expected an idle timeout error, got %v", err)
+	}
+	if content != "partial" {
+		t.Errorf("Expected the partial content, got %q", content)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Idle timeout took %s", elapsed)
+	}
+}
+
+func TestPrewarmReusesConnection(t *testing.T) {
+	var conns, heads atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+			return
+		}
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"ok\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testopenai", ApiURL: server.URL, NoAuth: true})
+
+	if err := Prewarm(context.Background(), "testopenai/m,other/m"); err != nil {
+		t.Fatalf("Prewarm failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		stream := NewStream(context.Background(), Config{Model: "testopenai/m"}, "hi")
+		for stream.Next() {
+		}
+		if err := stream.Err(); err != nil {
+			t.Fatalf("unexpected stream error: %v", err)
+		}
+	}
+
+	if heads.Load() != 1 {
+		t.Errorf("Expected one prewarm request, got %d", heads.Load())
+	}
+	if conns.Load() != 1 {
+		t.Errorf("Expected the prewarmed connection to be reused, got %d connections", conns.Load())
+	}
+}
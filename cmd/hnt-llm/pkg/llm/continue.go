@@ -0,0 +1,169 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// ContinuationEvent is sent when a response cut off by the token limit is
+// about to be continued by a new request. The content that follows carries
+// on from where the previous request stopped.
+type ContinuationEvent struct {
+	// Number counts the continuations of the response, starting at 1.
+	Number int
+	Max    int
+}
+
+func (c *ContinuationEvent) String() string {
+	return fmt.Sprintf("the response hit the token limit, continuing (%d/%d)", c.Number, c.Max)
+}
+
+// continuePrompt asks providers without assistant prefill to carry on.
+const continuePrompt = "Your previous response was cut off by the output token limit. Continue it exactly where it stopped, without repeating anything and without any preamble."
+
+func (config Config) maxContinuations() (int, error) {
+	if config.MaxContinuations != 0 {
+		return max(config.MaxContinuations, 0), nil
+	}
+	s, err := LoadSettings()
+	if err != nil {
+		return 0, err
+	}
+	if s.MaxContinuations != nil {
+		return *s.MaxContinuations, nil
+	}
+	return 0, nil
+}
+
+// continueStream streams like streamMessages, but a response that stops
+// with FinishLength is continued by up to config.maxContinuations further
+// requests to the model that answered. Usage events report the total so
+// far.
+func continueStream(ctx context.Context, config Config, messages []Message) (<-chan StreamEvent, <-chan error) {
+	limit, err := config.maxContinuations()
+	if err != nil || limit == 0 {
+		// A config file error is reported by streamMessages as well.
+		return streamMessages(ctx, config, messages)
+	}
+
+	eventChan := make(chan StreamEvent, 100)
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer close(eventChan)
+		defer close(errChan)
+
+		var content strings.Builder
+		var total Usage
+		segmentConfig, segmentMessages := config, messages
+		// trimmed is whitespace the caller already has but the model was
+		// not shown, which it usually repeats at the start of the segment.
+		trimmed := ""
+		for n := 0; ; n++ {
+			var segment strings.Builder
+			var usage *Usage
+			answered, finish, toolCalls := "", "", false
+
+			events, errs := streamMessages(ctx, segmentConfig, segmentMessages)
+			for ev := range events {
+				if trimmed != "" && ev.Content != "" {
+					ev.Content, trimmed = skipRepeated(ev.Content, trimmed)
+				}
+				segment.WriteString(ev.Content)
+				if ev.Retry != nil && ev.Retry.DiscardPartial {
+					segment.Reset()
+				}
+				if ev.Model != "" {
+					answered = ev.Model
+				}
+				if ev.FinishReason != "" {
+					finish = ev.FinishReason
+				}
+				if ev.ToolCall != nil {
+					toolCalls = true
+				}
+				if ev.Usage != nil {
+					usage = ev.Usage
+					sum := total
+					sum.Add(*ev.Usage)
+					ev.Usage = &sum
+				}
+				eventChan <- ev
+			}
+			if err := <-errs; err != nil {
+				errChan <- err
+				return
+			}
+
+			content.WriteString(segment.String())
+			if finish != FinishLength || toolCalls || segment.Len() == 0 || answered == "" || n == limit {
+				return
+			}
+			if usage != nil {
+				total.Add(*usage)
+			}
+
+			providerName, _ := splitModel(answered)
+			provider, err := LookupProvider(providerName)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			eventChan <- StreamEvent{Continuation: &ContinuationEvent{Number: n + 1, Max: limit}}
+
+			// The continuation must come from the same model, and a retry
+			// from scratch would discard the earlier parts too.
+			segmentConfig.Model = answered
+			policy, err := config.RetryPolicy()
+			if err != nil {
+				errChan <- err
+				return
+			}
+			policy.OnPartial = PartialFail
+			segmentConfig.Retry = &policy
+			segmentMessages, trimmed = continuationMessages(provider, config, messages, content.String())
+		}
+	}()
+
+	return eventChan, errChan
+}
+
+// continuationMessages returns messages followed by the partial answer.
+// Anthropic continues a trailing assistant message by itself, except with
+// extended thinking; other providers are asked to continue. It also returns
+// the trailing whitespace trimmed from an Anthropic prefill.
+func continuationMessages(provider *Provider, config Config, messages []Message, partial string) ([]Message, string) {
+	prefill := provider.ApiType == ApiTypeAnthropic && config.Params.ReasoningEffort == ""
+
+	result := append([]Message{}, messages...)
+	trimmed := ""
+	if prefill {
+		// Anthropic rejects a prefill that ends in whitespace.
+		kept := strings.TrimRight(partial, " \t\r\n")
+		partial, trimmed = kept, partial[len(kept):]
+	}
+	if last := len(result) - 1; last >= 0 && result[last].Role == "assistant" && len(result[last].ToolCalls) == 0 && len(result[last].Parts) == 0 {
+		// The request already ended with a prefill of its own.
+		result[last].Content += partial
+	} else {
+		result = append(result, Message{Role: "assistant", Content: partial})
+	}
+	if !prefill {
+		result = append(result, Message{Role: "user", Content: continuePrompt})
+	}
+	return result, trimmed
+}
+
+// skipRepeated drops the start of content that repeats pending, and returns
+// what is left of both. pending is cleared once content differs from it.
+func skipRepeated(content, pending string) (string, string) {
+	n := 0
+	for n < len(content) && n < len(pending) && content[n] == pending[n] {
+		n++
+	}
+	if n < len(content) {
+		return content[n:], ""
+	}
+	return "", pending[n:]
+}
@@ -0,0 +1,125 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestContinuation(t *testing.T) {
+	var requests [][]Message
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []Message `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, body.Messages)
+
+		content, finish := "<<<<<<< TARGET\nold\n====", "length"
+		if len(requests) == 2 {
+			content, finish = "===\nnew\n>>>>>>> REPLACE\n", "stop"
+		}
+		fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q},\"finish_reason\":%q}],\"usage\":{\"prompt_tokens\":10,\"completion_tokens\":5}}\n\ndata: [DONE]\n\n", content, finish)
+	}))
+	defer server.Close()
+	withTestProvider(t, Provider{Name: "testcontinue", ApiURL: server.URL, NoAuth: true})
+
+	for _, limit := range []int{-1, 3} {
+		requests = nil
+		stream := NewStream(context.Background(), Config{Model: "testcontinue/m", NoCache: true, MaxContinuations: limit}, "<hnt-user>edit</hnt-user>")
+		var content strings.Builder
+		var continuations int
+		var usage *Usage
+		for stream.Next() {
+			ev := stream.Event()
+			content.WriteString(ev.Content)
+			if ev.Continuation != nil {
+				continuations++
+			}
+			if ev.Usage != nil {
+				usage = ev.Usage
+			}
+		}
+		if err := stream.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		if limit < 0 {
+			if len(requests) != 1 || stream.FinishReason() != FinishLength {
+				t.Errorf("Expected no continuation when disabled, got %d requests", len(requests))
+			}
+			continue
+		}
+
+		if content.String() != "<<<<<<< TARGET\nold\n=======\nnew\n>>>>>>> REPLACE\n" {
+			t.Errorf("Expected the parts to be stitched together, got %q", content.String())
+		}
+		if continuations != 1 || len(requests) != 2 || stream.FinishReason() != FinishStop {
+			t.Errorf("Expected one continuation, got %d events, %d requests and finish reason %q", continuations, len(requests), stream.FinishReason())
+		}
+		if usage == nil || usage.PromptTokens != 20 || usage.CompletionTokens != 10 {
+			t.Errorf("Expected the usage of both requests, got %+v", usage)
+		}
+		second := requests[1]
+		if n := len(second); n != 3 || second[1].Role != "assistant" || second[1].Content != "<<<<<<< TARGET\nold\n====" || second[2].Content != continuePrompt {
+			t.Errorf("Unexpected continuation request %+v", second)
+		}
+	}
+}
+
+func TestContinuationMessagesPrefill(t *testing.T) {
+	provider := &Provider{Name: "anthropic", ApiType: ApiTypeAnthropic}
+	messages := []Message{{Role: "user", Content: "hi"}, {Role: "assistant", Content: "Sure: "}}
+
+	got, trimmed := continuationMessages(provider, Config{}, messages, "part one \n")
+	if len(got) != 2 || got[1].Content != "Sure: part one" || trimmed != " \n" {
+		t.Errorf("Expected the partial answer to extend the prefill, got %+v and %q trimmed", got, trimmed)
+	}
+	if messages[1].Content != "Sure: " {
+		t.Error("The original messages were modified")
+	}
+
+	got, _ = continuationMessages(provider, Config{Params: Params{ReasoningEffort: "low"}}, messages[:1], "part")
+	if len(got) != 3 || got[2].Role != "user" {
+		t.Errorf("Expected a continue prompt with extended thinking, got %+v", got)
+	}
+}
+
+func TestContinuationPrefillWhitespace(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+
+		text, stop := "    old\n    ", "max_tokens"
+		if len(bodies) == 2 {
+			text, stop = "\n    new\n", "end_turn"
+		}
+		fmt.Fprintf(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":%q}}\n\n", text)
+		fmt.Fprintf(w, "event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":%q},\"usage\":{\"output_tokens\":1}}\n\n", stop)
+		fmt.Fprint(w, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+	}))
+	defer server.Close()
+	withTestProvider(t, Provider{Name: "testprefill", ApiURL: server.URL, NoAuth: true, ApiType: ApiTypeAnthropic})
+
+	stream := NewStream(context.Background(), Config{Model: "testprefill/m", NoCache: true, MaxContinuations: 1}, "edit")
+	var content strings.Builder
+	for stream.Next() {
+		content.WriteString(stream.Event().Content)
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bodies) != 2 || !strings.Contains(bodies[1], `"    old"`) {
+		t.Fatalf("Expected a prefill without trailing whitespace, got %q", bodies)
+	}
+	if content.String() != "    old\n    new\n" {
+		t.Errorf("Expected the repeated whitespace to be dropped, got %q", content.String())
+	}
+}
@@ -0,0 +1,136 @@
+package llm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Kinds of provider errors. Use errors.Is to check for them:
+//
+//	if errors.Is(err, llm.ErrContextLength) {
+//		// drop some history and try again
+//	}
+var (
+	ErrRateLimited   = errors.New("rate limited")
+	ErrContextLength = errors.New("context length exceeded")
+	ErrModeration    = errors.New("rejected by moderation")
+	ErrAuth          = errors.New("authentication failed")
+	ErrOverloaded    = errors.New("provider overloaded")
+)
+
+// APIError is an error reported by a provider, either as an HTTP error
+// response or as an error event in the middle of a stream.
+type APIError struct {
+	Provider string
+	// StatusCode is the HTTP status, or for mid-stream errors the numeric
+	// code the provider gave, if any.
+	StatusCode int
+	Type       string
+	Code       string
+	Message    string
+	// Kind is one of the Err* values, or nil if the error was not
+	// recognised.
+	Kind error
+}
+
+func (e *APIError) Error() string {
+	var b strings.Builder
+	b.WriteString("API error")
+	if e.StatusCode != 0 {
+		fmt.Fprintf(&b, ": %d", e.StatusCode)
+		if text := http.StatusText(e.StatusCode); text != "" {
+			b.WriteString(" " + text)
+		}
+	}
+	b.WriteString(" -")
+	if e.Type != "" {
+		b.WriteString(" " + e.Type + ":")
+	} else if e.Code != "" && e.Code != strconv.Itoa(e.StatusCode) {
+		b.WriteString(" " + e.Code + ":")
+	}
+	b.WriteString(" " + e.Message)
+	return b.String()
+}
+
+func (e *APIError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+// retryable reports whether the request may succeed if it is made again.
+func (e *APIError) retryable() bool {
+	return e.Kind == ErrRateLimited || e.Kind == ErrOverloaded || isRetryableStatus(e.StatusCode)
+}
+
+// errorPayload covers the error shapes of the supported APIs:
+// {"error": {"message": ..., "type": ..., "code": ...}} for OpenAI and
+// OpenRouter (whose code is the HTTP status), the same inside
+// {"type": "error", ...} for Anthropic, and {"error": "message"}.
+type errorPayload struct {
+	Type     string          `json:"type"`
+	Code     json.RawMessage `json:"code"`
+	Message  string          `json:"message"`
+	Metadata json.RawMessage `json:"metadata"`
+}
+
+// newAPIError builds an APIError from an error response body or an error
+// event's data. status is 0 for mid-stream errors.
+func newAPIError(provider string, status int, body []byte) *APIError {
+	e := &APIError{Provider: provider, StatusCode: status}
+
+	var envelope struct {
+		Error json.RawMessage `json:"error"`
+	}
+	var payload errorPayload
+	if json.Unmarshal(body, &envelope) == nil && json.Unmarshal(envelope.Error, &payload) != nil {
+		payload = errorPayload{}
+		json.Unmarshal(envelope.Error, &payload.Message)
+	}
+
+	e.Type = payload.Type
+	e.Message = payload.Message
+	e.Code = strings.Trim(string(payload.Code), `"`)
+	if e.Code == "null" {
+		e.Code = ""
+	}
+	if e.StatusCode == 0 {
+		if n, err := strconv.Atoi(e.Code); err == nil && n >= 400 && n < 600 {
+			e.StatusCode = n
+		}
+	}
+	if e.Message == "" {
+		e.Message = strings.TrimSpace(string(body))
+	}
+
+	e.Kind = classifyError(e, string(payload.Metadata))
+	return e
+}
+
+func classifyError(e *APIError, metadata string) error {
+	text := strings.ToLower(e.Type + " " + e.Code + " " + e.Message)
+	containsAny := func(substrs ...string) bool {
+		for _, s := range substrs {
+			if strings.Contains(text, s) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case containsAny("context_length", "context length", "context window", "maximum context", "prompt is too long", "too many tokens", "reduce the length"):
+		return ErrContextLength
+	case e.StatusCode == http.StatusTooManyRequests || containsAny("rate_limit", "rate limit", "too many requests"):
+		return ErrRateLimited
+	case e.StatusCode == 529 || containsAny("overloaded"):
+		return ErrOverloaded
+	case strings.Contains(metadata, "flagged_input") || containsAny("moderation", "flagged", "content_filter", "content_policy", "content policy"):
+		return ErrModeration
+	case e.StatusCode == http.StatusUnauthorized || containsAny("authentication", "invalid_api_key", "invalid api key", "unauthorized"):
+		return ErrAuth
+	}
+	return nil
+}
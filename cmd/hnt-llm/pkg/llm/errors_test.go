@@ -0,0 +1,118 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewAPIError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		kind   error
+	}{
+		{"openai context length", 400, `{"error":{"message":"This model's maximum context length is 8192 tokens.","type":"invalid_request_error","code":"context_length_exceeded"}}`, ErrContextLength},
+		{"anthropic prompt too long", 400, `{"type":"error","error":{"type":"invalid_request_error","message":"prompt is too long: 210000 tokens > 200000 maximum"}}`, ErrContextLength},
+		{"openai rate limit", 429, `{"error":{"message":"Rate limit reached","type":"requests","code":"rate_limit_exceeded"}}`, ErrRateLimited},
+		{"anthropic overloaded", 529, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`, ErrOverloaded},
+		{"openrouter moderation", 403, `{"error":{"code":403,"message":"Input was flagged","metadata":{"reasons":["violence"],"flagged_input":"..."}}}`, ErrModeration},
+		{"auth", 401, `{"error":{"message":"Incorrect API key provided","type":"invalid_request_error","code":"invalid_api_key"}}`, ErrAuth},
+		{"plain text", 500, `upstream exploded`, nil},
+		{"string error", 400, `{"error":"bad request"}`, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newAPIError("test", tt.status, []byte(tt.body))
+			if err.Kind != tt.kind {
+				t.Errorf("Expected kind %v, got %v (%v)", tt.kind, err.Kind, err)
+			}
+			if tt.kind != nil && !errors.Is(err, tt.kind) {
+				t.Errorf("Expected errors.Is to match %v", tt.kind)
+			}
+			if err.Message == "" {
+				t.Error("Expected a message")
+			}
+		})
+	}
+}
+
+func TestMidStreamError(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		fmt.Fprint(w, ": OPENROUTER PROCESSING\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"error\":{\"code\":400,\"message\":\"This endpoint's maximum context length is 4096 tokens\"},\"choices\":[{\"delta\":{},\"finish_reason\":\"error\"}]}\n\n")
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testopenai", ApiURL: server.URL, NoAuth: true})
+
+	stream := NewStream(context.Background(), Config{Model: "testopenai/m", Retry: fastRetry}, "hi")
+	content := ""
+	for stream.Next() {
+		content += stream.Event().Content
+	}
+
+	err := stream.Err()
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 400 {
+		t.Fatalf("Expected an APIError with status 400, got %v", err)
+	}
+	if !errors.Is(err, ErrContextLength) {
+		t.Errorf("Expected ErrContextLength, got %v", err)
+	}
+	if content != "Hel" || calls != 1 {
+		t.Errorf("Expected the partial content from one call, got %q after %d calls", content, calls)
+	}
+}
+
+func TestMidStreamRateLimitRetried(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			fmt.Fprint(w, "data: {\"error\":{\"code\":429,\"message\":\"Rate limit exceeded\"}}\n\n")
+			return
+		}
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"ok\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testopenai", ApiURL: server.URL, NoAuth: true})
+
+	stream := NewStream(context.Background(), Config{Model: "testopenai/m", Retry: fastRetry}, "hi")
+	content := ""
+	for stream.Next() {
+		content += stream.Event().Content
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if content != "ok" || calls != 2 {
+		t.Errorf("Expected %q after a retry, got %q after %d calls", "ok", content, calls)
+	}
+}
+
+func TestStatusErrorIsTyped(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":{"message":"No auth credentials found","code":401}}`)
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testopenai", ApiURL: server.URL, NoAuth: true})
+
+	stream := NewStream(context.Background(), Config{Model: "testopenai/m", Retry: fastRetry}, "hi")
+	for stream.Next() {
+	}
+	if err := stream.Err(); !errors.Is(err, ErrAuth) {
+		t.Errorf("Expected ErrAuth, got %v", err)
+	}
+}
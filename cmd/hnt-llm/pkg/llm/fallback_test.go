@@ -0,0 +1,103 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func okServer(content string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\ndata: [DONE]\n\n", content)
+	}))
+}
+
+func runChain(t *testing.T, config Config) (string, string, []*FallbackEvent, error) {
+	t.Helper()
+	eventChan, errChan := StreamLLMResponse(context.Background(), config, "hi")
+	var content strings.Builder
+	var model string
+	var fallbacks []*FallbackEvent
+	for ev := range eventChan {
+		content.WriteString(ev.Content)
+		if ev.Model != "" {
+			model = ev.Model
+		}
+		if ev.Fallback != nil {
+			fallbacks = append(fallbacks, ev.Fallback)
+		}
+	}
+	return content.String(), model, fallbacks, <-errChan
+}
+
+func TestFallbackOnMissingKey(t *testing.T) {
+	backup := okServer("from backup")
+	defer backup.Close()
+
+	withTestProvider(t, Provider{Name: "nokey", ApiURL: "http://127.0.0.1:1", EnvVar: "HNT_TEST_UNSET_KEY"})
+	withTestProvider(t, Provider{Name: "backup", ApiURL: backup.URL, NoAuth: true})
+	t.Setenv("HNT_TEST_UNSET_KEY", "")
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+
+	content, model, fallbacks, err := runChain(t, Config{Model: "nokey/a, backup/b"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if content != "from backup" || model != "backup/b" {
+		t.Errorf("Expected backup/b to answer, got %q from %q", content, model)
+	}
+	if len(fallbacks) != 1 || fallbacks[0].From != "nokey/a" || fallbacks[0].To != "backup/b" {
+		t.Errorf("Unexpected fallback events: %+v", fallbacks)
+	}
+}
+
+func TestFallbackOnFirstTokenTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	backup := okServer("fast")
+	defer backup.Close()
+
+	withTestProvider(t, Provider{Name: "slow", ApiURL: slow.URL, NoAuth: true})
+	withTestProvider(t, Provider{Name: "backup", ApiURL: backup.URL, NoAuth: true})
+
+	config := Config{Model: "slow/a,backup/b", FirstTokenTimeout: 50 * time.Millisecond, Retry: fastRetry}
+	content, model, fallbacks, err := runChain(t, config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if content != "fast" || model != "backup/b" {
+		t.Errorf("Expected backup/b to answer, got %q from %q", content, model)
+	}
+	if len(fallbacks) != 1 {
+		t.Errorf("Expected one fallback, got %+v", fallbacks)
+	}
+}
+
+func TestFallbackAllFail(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadRequest)
+	}))
+	defer failing.Close()
+
+	withTestProvider(t, Provider{Name: "failing", ApiURL: failing.URL, NoAuth: true})
+
+	_, _, _, err := runChain(t, Config{Model: "failing/a,failing/b"})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if !strings.Contains(err.Error(), "failing/a") || !strings.Contains(err.Error(), "failing/b") {
+		t.Errorf("Expected both failures in the error, got %v", err)
+	}
+}
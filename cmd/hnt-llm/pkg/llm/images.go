@@ -0,0 +1,229 @@
+package llm
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/escaping"
+)
+
+// MaxImageBytes is the largest image BuildMessages will attach. Providers
+// may set a lower limit with Provider.MaxImageBytes.
+const MaxImageBytes = 20 * 1024 * 1024
+
+// imageRegex matches <hnt-image path="..."> references, with or without a
+// trailing slash.
+var imageRegex = regexp.MustCompile(`<hnt-image\s+path="([^"]*)"\s*/?>`)
+
+var imageMediaTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// ContentPart is one element of a multi-part message.
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+
+	// path is the original reference, used when the image has to be
+	// replaced by a placeholder. Images read from JSON have none.
+	path string
+}
+
+type ImageURL struct {
+	// URL is a data: URL with base64 image data.
+	URL string `json:"url"`
+}
+
+func (i *ImageURL) mediaType() string {
+	mediaType, _, _ := strings.Cut(strings.TrimPrefix(i.URL, "data:"), ";")
+	return mediaType
+}
+
+func (i *ImageURL) data() string {
+	_, data, _ := strings.Cut(i.URL, ",")
+	return data
+}
+
+// size is the number of bytes the base64 data decodes to.
+func (i *ImageURL) size() int {
+	data := i.data()
+	padding := len(data) - len(strings.TrimRight(data, "="))
+	return base64.StdEncoding.DecodedLen(len(data)) - padding
+}
+
+// ResolveImagePaths rewrites relative <hnt-image> paths in content to be
+// relative to dir, so that the content can be read from anywhere.
+func ResolveImagePaths(content string, dir string) string {
+	return imageRegex.ReplaceAllStringFunc(content, func(match string) string {
+		path := imageRegex.FindStringSubmatch(match)[1]
+		if path == "" || filepath.IsAbs(path) {
+			return match
+		}
+		return fmt.Sprintf(`<hnt-image path="%s">`, filepath.Join(dir, path))
+	})
+}
+
+// expandImages splits content on <hnt-image> references and loads the
+// images. It returns nil parts if no image was loaded. A reference to a file
+// that is missing or not an image is kept as text, since it may just be
+// quoted from a document.
+func expandImages(content string) ([]ContentPart, error) {
+	matches := imageRegex.FindAllStringSubmatchIndex(content, -1)
+	if len(matches) == 0 {
+		return nil, nil
+	}
+
+	var parts []ContentPart
+	var text strings.Builder
+	images := 0
+	flushText := func() {
+		if strings.TrimSpace(text.String()) != "" {
+			parts = append(parts, ContentPart{Type: "text", Text: escaping.UnescapeImages(text.String())})
+		}
+		text.Reset()
+	}
+
+	pos := 0
+	for _, m := range matches {
+		text.WriteString(content[pos:m[0]])
+		pos = m[1]
+
+		part, err := loadImage(content[m[2]:m[3]])
+		var notImage *notImageError
+		if errors.As(err, &notImage) {
+			log.Printf("WARNING: %v; sending the reference as text", err)
+			text.WriteString(content[m[0]:m[1]])
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		flushText()
+		parts = append(parts, part)
+		images++
+	}
+	text.WriteString(content[pos:])
+	flushText()
+
+	if images == 0 {
+		return nil, nil
+	}
+	return parts, nil
+}
+
+// notImageError reports an <hnt-image> reference that does not point to an
+// image.
+type notImageError struct {
+	msg string
+}
+
+func (e *notImageError) Error() string {
+	return e.msg
+}
+
+func loadImage(path string) (ContentPart, error) {
+	if path == "" {
+		return ContentPart{}, &notImageError{"<hnt-image> is missing a path"}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return ContentPart{}, &notImageError{fmt.Sprintf("failed to read image: %v", err)}
+	}
+	if info.Size() > MaxImageBytes {
+		return ContentPart{}, fmt.Errorf("image %s is %d bytes, larger than the %d byte limit", path, info.Size(), MaxImageBytes)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ContentPart{}, fmt.Errorf("failed to read image: %w", err)
+	}
+
+	mediaType := http.DetectContentType(data)
+	if !imageMediaTypes[mediaType] {
+		return ContentPart{}, &notImageError{fmt.Sprintf("image %s has unsupported type %s (expected PNG, JPEG, GIF or WebP)", path, mediaType)}
+	}
+
+	return ContentPart{
+		Type:     "image_url",
+		ImageURL: &ImageURL{URL: "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data)},
+		path:     path,
+	}, nil
+}
+
+// prepareImages adapts image parts to what provider accepts. Providers
+// without vision get plain text content with a placeholder for each image,
+// and images over the provider's size limit are an error.
+func prepareImages(provider *Provider, messages []Message) ([]Message, error) {
+	prepared := make([]Message, len(messages))
+	warned := false
+
+	for i, m := range messages {
+		prepared[i] = m
+		if len(m.Parts) == 0 {
+			continue
+		}
+
+		parts := make([]ContentPart, len(m.Parts))
+		for j, part := range m.Parts {
+			parts[j] = part
+			if part.Type != "image_url" {
+				continue
+			}
+			if part.ImageURL == nil {
+				return nil, fmt.Errorf("message %d has an image_url part without an image_url", i+1)
+			}
+
+			if provider.NoVision {
+				if !warned {
+					log.Printf("WARNING: provider '%s' does not support images. They will be replaced with a placeholder.", provider.Name)
+					warned = true
+				}
+				placeholder := "[image omitted]"
+				if part.path != "" {
+					placeholder = fmt.Sprintf("[image omitted: %s]", part.path)
+				}
+				parts[j] = ContentPart{Type: "text", Text: placeholder}
+				continue
+			}
+
+			if size := part.ImageURL.size(); provider.MaxImageBytes > 0 && size > provider.MaxImageBytes {
+				name := "image"
+				if part.path != "" {
+					name += " " + part.path
+				}
+				return nil, fmt.Errorf("%s is %d bytes, larger than the %d byte limit of provider '%s'", name, size, provider.MaxImageBytes, provider.Name)
+			}
+		}
+		prepared[i].Parts = parts
+
+		if provider.NoVision {
+			prepared[i].Content = joinText(parts)
+			prepared[i].Parts = nil
+		}
+	}
+
+	return prepared, nil
+}
+
+// joinText concatenates the text parts of a message.
+func joinText(parts []ContentPart) string {
+	var texts []string
+	for _, part := range parts {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "")
+}
@@ -0,0 +1,175 @@
+package llm
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/escaping"
+)
+
+// writePNG writes a file that content sniffing recognises as a PNG.
+func writePNG(t *testing.T, size int) string {
+	t.Helper()
+	data := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, size)...)
+	path := filepath.Join(t.TempDir(), "shot.png")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBuildMessagesImage(t *testing.T) {
+	path := writePNG(t, 16)
+
+	prompt := `<hnt-user>What is this? <hnt-image path="` + path + `"/></hnt-user>`
+	messages, err := BuildMessages(prompt, "")
+	if err != nil {
+		t.Fatalf("BuildMessages failed: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message, got %+v", messages)
+	}
+
+	m := messages[0]
+	if m.Content != "What is this? " {
+		t.Errorf("Expected text-only Content, got %q", m.Content)
+	}
+	if len(m.Parts) != 2 || m.Parts[1].Type != "image_url" {
+		t.Fatalf("Expected text and image parts, got %+v", m.Parts)
+	}
+	if !strings.HasPrefix(m.Parts[1].ImageURL.URL, "data:image/png;base64,") {
+		t.Errorf("Expected a PNG data URL, got %q", m.Parts[1].ImageURL.URL[:30])
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wire struct {
+		Content []ContentPart `json:"content"`
+	}
+	if err := json.Unmarshal(data, &wire); err != nil || len(wire.Content) != 2 {
+		t.Errorf("Expected content to be sent as an array, got %s", data)
+	}
+}
+
+func TestBuildMessagesTopLevelImage(t *testing.T) {
+	path := writePNG(t, 16)
+
+	messages, err := BuildMessages(`describe <hnt-image path="`+path+`">`, "")
+	if err != nil {
+		t.Fatalf("BuildMessages failed: %v", err)
+	}
+	if len(messages) != 1 || len(messages[0].Parts) != 2 {
+		t.Errorf("Expected one user message with an image, got %+v", messages)
+	}
+}
+
+func TestBuildMessagesImageNotFound(t *testing.T) {
+	notImage := filepath.Join(t.TempDir(), "notes.txt")
+	os.WriteFile(notImage, []byte("just text"), 0644)
+
+	for _, path := range []string{notImage, "shot.png"} {
+		content := `use <hnt-image path="` + path + `"> to attach`
+		messages, err := BuildMessages("<hnt-user>"+content+"</hnt-user>", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 1 || messages[0].Parts != nil || messages[0].Content != content {
+			t.Errorf("Expected the reference to %s to be kept as text, got %+v", path, messages)
+		}
+	}
+}
+
+func TestBuildMessagesEscapedImage(t *testing.T) {
+	path := writePNG(t, 16)
+	content := "see " + escaping.EscapeImages(`<hnt-image path="`+path+`">`)
+
+	m, err := NewMessage("user", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Parts != nil || m.Content != `see <hnt-image path="`+path+`">` {
+		t.Errorf("Expected an escaped reference to be unescaped text, got %+v", m)
+	}
+}
+
+func TestPrepareImages(t *testing.T) {
+	path := writePNG(t, 64)
+	messages, err := BuildMessages(`look: <hnt-image path="`+path+`">`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prepared, err := prepareImages(&Provider{Name: "textonly", NoVision: true}, messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prepared[0].Parts != nil || prepared[0].Content != "look: [image omitted: "+path+"]" {
+		t.Errorf("Expected a text placeholder, got %+v", prepared[0])
+	}
+	if messages[0].Parts == nil {
+		t.Error("prepareImages modified its input")
+	}
+
+	if _, err := prepareImages(&Provider{Name: "small", MaxImageBytes: 32}, messages); err == nil {
+		t.Error("Expected an error for an image over the provider limit")
+	}
+}
+
+func TestPrepareImagesFromJSON(t *testing.T) {
+	data := base64.StdEncoding.EncodeToString(make([]byte, 70))
+	messages, err := ParseMessagesJSON([]byte(`[{"role": "user", "content": [
+		{"type": "text", "text": "look: "},
+		{"type": "image_url", "image_url": {"url": "data:image/png;base64,` + data + `"}}
+	]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prepared, err := prepareImages(&Provider{Name: "textonly", NoVision: true}, messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prepared[0].Content != "look: [image omitted]" {
+		t.Errorf("Expected a placeholder without a path, got %q", prepared[0].Content)
+	}
+
+	if _, err := prepareImages(&Provider{Name: "exact", MaxImageBytes: 70}, messages); err != nil {
+		t.Errorf("Expected an image at the provider limit to pass, got %v", err)
+	}
+	if _, err := prepareImages(&Provider{Name: "small", MaxImageBytes: 69}, messages); err == nil {
+		t.Error("Expected an error for an image over the provider limit")
+	}
+}
+
+func TestAnthropicImageBlock(t *testing.T) {
+	path := writePNG(t, 16)
+	messages, err := BuildMessages(`<hnt-image path="`+path+`">`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var converted []AnthropicMessage
+	appendAnthropicMessage(&converted, messages[0])
+
+	blocks := converted[0].Content
+	if len(blocks) != 1 || blocks[0].Type != "image" || blocks[0].Source == nil {
+		t.Fatalf("Expected an image block, got %+v", blocks)
+	}
+	if blocks[0].Source.MediaType != "image/png" || blocks[0].Source.Data == "" {
+		t.Errorf("Unexpected image source: %+v", blocks[0].Source)
+	}
+}
+
+func TestResolveImagePaths(t *testing.T) {
+	got := ResolveImagePaths(`a <hnt-image path="attachments/x.png"> b <hnt-image path="/abs.png">`, "/conv")
+	want := `a <hnt-image path="/conv/attachments/x.png"> b <hnt-image path="/abs.png">`
+	if got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,26 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+)
+
+// InterruptContext returns a context that is cancelled by the first Ctrl-C,
+// so that a generation stops cleanly and its partial output can be kept. A
+// second Ctrl-C kills the process as usual.
+func InterruptContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(parent, os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// Interrupted reports whether a stream failed only because ctx was
+// cancelled, as opposed to failing on its own.
+func Interrupted(ctx context.Context, err error) bool {
+	return ctx.Err() != nil && errors.Is(err, context.Canceled)
+}
@@ -0,0 +1,101 @@
+package llm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/keymanagement"
+)
+
+// KeyProfileEnv selects a named key, like Config.KeyProfile.
+const KeyProfileEnv = "HINATA_KEY_PROFILE"
+
+// keyProfile returns the profile to use and whether it was asked for
+// explicitly. Config.KeyProfile wins over KeyProfileEnv, which wins over
+// the key_profiles directory defaults of the config file.
+func (config Config) keyProfile() (string, bool, error) {
+	if config.KeyProfile != "" {
+		return config.KeyProfile, true, nil
+	}
+	if profile := os.Getenv(KeyProfileEnv); profile != "" {
+		return profile, true, nil
+	}
+
+	s, err := LoadSettings()
+	if err != nil || len(s.KeyProfiles) == 0 {
+		return "", false, err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", false, err
+	}
+	return directoryProfile(s.KeyProfiles, cwd), false, nil
+}
+
+// directoryProfile returns the profile of the deepest directory in
+// profiles that contains dir.
+func directoryProfile(profiles map[string]string, dir string) string {
+	home, _ := os.UserHomeDir()
+	best, bestLen := "", -1
+	for root, profile := range profiles {
+		if rest, ok := strings.CutPrefix(root, "~/"); ok && home != "" {
+			root = filepath.Join(home, rest)
+		}
+		root = filepath.Clean(root)
+		if (dir == root || strings.HasPrefix(dir, root+string(filepath.Separator))) && len(root) > bestLen {
+			best, bestLen = profile, len(root)
+		}
+	}
+	return best
+}
+
+// apiKey finds the key for provider and returns it with a name to record
+// in place of the secret: the saved key's name or the environment
+// variable.
+//
+// A selected profile uses the saved key "provider:profile". A profile
+// given as "provider:profile" only applies to that provider. Without a
+// profile, the provider's environment variable wins over the saved key.
+// An explicitly selected profile must exist; a directory default falls
+// back to the usual key.
+func (config Config) apiKey(provider *Provider) (string, string, error) {
+	profile, explicit, err := config.keyProfile()
+	if err != nil {
+		return "", "", err
+	}
+	if name, rest, ok := strings.Cut(profile, ":"); ok {
+		profile = ""
+		if name == provider.Name {
+			profile = rest
+		}
+	}
+
+	if profile != "" {
+		name := provider.Name + ":" + profile
+		apiKey, err := keymanagement.GetAPIKeyFromStore(name)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read saved API key '%s': %w", name, err)
+		}
+		if apiKey != "" {
+			return apiKey, name, nil
+		}
+		if explicit {
+			return "", "", fmt.Errorf("API key '%s' not found. Save it with `hnt-llm save-key %s`", name, name)
+		}
+	}
+
+	if apiKey := os.Getenv(provider.EnvVar); apiKey != "" {
+		return apiKey, "$" + provider.EnvVar, nil
+	}
+	apiKey, err := keymanagement.GetAPIKeyFromStore(provider.Name)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read saved API key for '%s': %w", provider.Name, err)
+	}
+	if apiKey == "" {
+		return "", "", fmt.Errorf("API key for '%s' not found. Please set %s or save the key with `hnt-llm save-key %s`",
+			provider.Name, provider.EnvVar, provider.Name)
+	}
+	return apiKey, provider.Name, nil
+}
@@ -0,0 +1,137 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/keymanagement"
+)
+
+func TestDirectoryProfile(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip("no home directory")
+	}
+	profiles := map[string]string{
+		"~/work":        "work",
+		"~/work/oss":    "personal",
+		"/srv/projects": "team",
+	}
+
+	tests := []struct {
+		dir  string
+		want string
+	}{
+		{filepath.Join(home, "work"), "work"},
+		{filepath.Join(home, "work", "api"), "work"},
+		{filepath.Join(home, "work", "oss", "hinata"), "personal"},
+		{filepath.Join(home, "workshop"), ""},
+		{"/srv/projects/x", "team"},
+		{"/tmp", ""},
+	}
+	for _, tt := range tests {
+		if got := directoryProfile(profiles, tt.dir); got != tt.want {
+			t.Errorf("directoryProfile(%q) = %q, want %q", tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestKeySelection(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(root, "config"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(root, "data"))
+	t.Setenv("TESTKEYS_API_KEY", "")
+	t.Setenv(KeyProfileEnv, "")
+
+	var gotAuth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"ok\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer server.Close()
+	withTestProvider(t, Provider{Name: "testkeys", ApiURL: server.URL, EnvVar: "TESTKEYS_API_KEY"})
+
+	for name, key := range map[string]string{"testkeys": "sk-personal", "testkeys:work": "sk-work"} {
+		if err := keymanagement.SaveAPIKey(name, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run := func(config Config) (string, error) {
+		t.Helper()
+		config.Model = "testkeys/m"
+		config.NoCache = true
+		stream := NewStream(context.Background(), config, "hi")
+		key := ""
+		for stream.Next() {
+			if ev := stream.Event(); ev.Model != "" {
+				key = ev.Key
+			}
+		}
+		return key, stream.Err()
+	}
+
+	tests := []struct {
+		name     string
+		config   Config
+		env      string
+		settings string
+		wantKey  string
+		wantAuth string
+	}{
+		{"default", Config{}, "", "{}", "testkeys", "sk-personal"},
+		{"flag", Config{KeyProfile: "work"}, "", "{}", "testkeys:work", "sk-work"},
+		{"full name", Config{KeyProfile: "testkeys:work"}, "", "{}", "testkeys:work", "sk-work"},
+		{"other provider", Config{KeyProfile: "openrouter:work"}, "", "{}", "testkeys", "sk-personal"},
+		{"env", Config{}, "work", "{}", "testkeys:work", "sk-work"},
+		{"directory", Config{}, "", fmt.Sprintf(`{"key_profiles": {%q: "work"}}`, root), "testkeys:work", "sk-work"},
+		{"directory fallback", Config{}, "", fmt.Sprintf(`{"key_profiles": {%q: "missing"}}`, root), "testkeys", "sk-personal"},
+	}
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir(root); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(KeyProfileEnv, tt.env)
+			withSettings(t, tt.settings)
+
+			key, err := run(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != tt.wantKey {
+				t.Errorf("Expected key %q, got %q", tt.wantKey, key)
+			}
+			if gotAuth != "Bearer "+tt.wantAuth {
+				t.Errorf("Expected %s to be sent, got %q", tt.wantAuth, gotAuth)
+			}
+		})
+	}
+
+	t.Run("explicit missing", func(t *testing.T) {
+		withSettings(t, "{}")
+		_, err := run(Config{KeyProfile: "missing"})
+		if err == nil || !strings.Contains(err.Error(), "testkeys:missing") {
+			t.Errorf("Expected a missing key error, got %v", err)
+		}
+	})
+
+	t.Run("environment variable", func(t *testing.T) {
+		withSettings(t, "{}")
+		t.Setenv("TESTKEYS_API_KEY", "sk-env")
+		key, err := run(Config{})
+		if err != nil || key != "$TESTKEYS_API_KEY" || gotAuth != "Bearer sk-env" {
+			t.Errorf("Expected the environment variable, got %q %q (%v)", key, gotAuth, err)
+		}
+	})
+}
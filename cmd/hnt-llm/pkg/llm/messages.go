@@ -1,7 +1,11 @@
 package llm
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"strings"
 
@@ -31,6 +35,14 @@ func BuildMessages(content string, systemPrompt string) ([]Message, error) {
 		nonTagContent.WriteString(content[currentPos:tagStartAbs])
 
 		remainingFromTag := content[tagStartAbs:]
+
+		// Image references are part of the message text, not a message.
+		if loc := imageRegex.FindStringIndex(remainingFromTag); loc != nil && loc[0] == 0 {
+			nonTagContent.WriteString(remainingFromTag[:loc[1]])
+			currentPos = tagStartAbs + loc[1]
+			continue
+		}
+
 		tagEndRel := strings.IndexByte(remainingFromTag, '>')
 		if tagEndRel == -1 {
 			return nil, fmt.Errorf("malformed hnt chat: unclosed tag starting at position %d", tagStartAbs)
@@ -76,10 +88,11 @@ func BuildMessages(content string, systemPrompt string) ([]Message, error) {
 			continue
 		}
 
-		messages = append(messages, Message{
-			Role:    role,
-			Content: escaping.Unescape(tagContent),
-		})
+		message, err := NewMessage(role, escaping.Unescape(tagContent))
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
 
 		currentPos = closingTagStartAbs + len(closingTag)
 	}
@@ -88,11 +101,88 @@ func BuildMessages(content string, systemPrompt string) ([]Message, error) {
 
 	trimmedUserContent := strings.TrimSpace(nonTagContent.String())
 	if trimmedUserContent != "" {
-		messages = append(messages, Message{
-			Role:    "user",
-			Content: escaping.Unescape(trimmedUserContent),
-		})
+		message, err := NewMessage("user", escaping.Unescape(trimmedUserContent))
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
+
+// NewMessage builds a message from text, loading the images of any
+// <hnt-image> references in it. References escaped with
+// escaping.EscapeImages are unescaped instead.
+func NewMessage(role string, content string) (Message, error) {
+	parts, err := expandImages(content)
+	if err != nil {
+		return Message{}, err
+	}
+	if parts == nil {
+		return Message{Role: role, Content: escaping.UnescapeImages(content)}, nil
+	}
+	return Message{Role: role, Content: joinText(parts), Parts: parts}, nil
+}
+
+// ReplaceSystemPrompt returns messages with their system messages replaced
+// by systemPrompt, as BuildMessages does for a system prompt given on the
+// command line.
+func ReplaceSystemPrompt(messages []Message, systemPrompt string) []Message {
+	result := []Message{{Role: "system", Content: systemPrompt}}
+	for _, m := range messages {
+		if m.Role == "system" {
+			log.Println("WARNING: the input has a system message, but a system prompt was already provided via --system argument. The input system message will be ignored.")
+			continue
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+// ParseMessagesJSON reads messages in the OpenAI format: a JSON array of
+// messages, an object with a "messages" array, or one message per line
+// (JSONL). Content may be a string or an array of text and image_url parts.
+func ParseMessagesJSON(data []byte) ([]Message, error) {
+	data = bytes.TrimSpace(data)
+	var messages []Message
+	switch {
+	case len(data) == 0:
+		return nil, errors.New("no messages in the input")
+	case data[0] == '[':
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("invalid messages: %w", err)
+		}
+	default:
+		var wrapper struct {
+			Messages []Message `json:"messages"`
+		}
+		if err := json.Unmarshal(data, &wrapper); err == nil && wrapper.Messages != nil {
+			messages = wrapper.Messages
+			break
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		for i := 1; ; i++ {
+			var m Message
+			err := decoder.Decode(&m)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid message %d: %w", i, err)
+			}
+			messages = append(messages, m)
+		}
 	}
 
+	if len(messages) == 0 {
+		return nil, errors.New("no messages in the input")
+	}
+	for i, m := range messages {
+		if m.Role == "" {
+			return nil, fmt.Errorf("message %d has no role", i+1)
+		}
+	}
 	return messages, nil
 }
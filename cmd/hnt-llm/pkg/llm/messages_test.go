@@ -0,0 +1,44 @@
+package llm
+
+import (
+	"testing"
+)
+
+func TestParseMessagesJSON(t *testing.T) {
+	inputs := map[string]string{
+		"array":  `[{"role": "system", "content": "s"}, {"role": "user", "content": [{"type": "text", "text": "hi"}]}]`,
+		"object": `{"messages": [{"role": "system", "content": "s"}, {"role": "user", "content": "hi"}]}`,
+		"jsonl":  "{\"role\": \"system\", \"content\": \"s\"}\n\n{\"role\": \"user\", \"content\": \"hi\"}\n",
+	}
+	for name, input := range inputs {
+		messages, err := ParseMessagesJSON([]byte(input))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(messages) != 2 || messages[0].Content != "s" || messages[1].Role != "user" || messages[1].Content != "hi" || messages[1].Parts != nil {
+			t.Errorf("%s: unexpected messages %+v", name, messages)
+		}
+	}
+
+	for _, input := range []string{``, `[]`, `{"content": "no role"}`, `{"role": "user", "content": "a"} not json`} {
+		if _, err := ParseMessagesJSON([]byte(input)); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
+
+func TestSystemPromptPrecedence(t *testing.T) {
+	messages, err := BuildMessages("<hnt-system>from stdin</hnt-system><hnt-user>hi</hnt-user>", "from flag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].Content != "from flag" || messages[1].Role != "user" {
+		t.Errorf("Expected the given system prompt to replace the one in the text, got %+v", messages)
+	}
+
+	messages = ReplaceSystemPrompt([]Message{{Role: "system", Content: "from stdin"}, {Role: "user", Content: "hi"}}, "from flag")
+	if len(messages) != 2 || messages[0].Content != "from flag" || messages[1].Role != "user" {
+		t.Errorf("Expected the given system prompt to replace the one in the messages, got %+v", messages)
+	}
+}
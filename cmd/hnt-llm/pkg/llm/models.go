@@ -0,0 +1,287 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ModelInfo is one entry of a provider's /models list. Fields the provider
+// does not report are left zero.
+type ModelInfo struct {
+	// ID is the model name within the provider, without the provider
+	// prefix.
+	ID            string `json:"id"`
+	ContextLength int    `json:"context_length,omitempty"`
+	// Price is in USD per million tokens, like DefaultPrices.
+	Price *Price `json:"price,omitempty"`
+}
+
+// catalogue is a cached model list.
+type catalogue struct {
+	FetchedAt time.Time   `json:"fetched_at"`
+	Models    []ModelInfo `json:"models"`
+}
+
+// CatalogueTTL is how long a fetched model list is used, both by
+// FetchModels and to validate model names before a request.
+const CatalogueTTL = 24 * time.Hour
+
+var ErrUnknownModel = errors.New("unknown model")
+
+// ResolveAliases replaces the aliases of the config file in a model or
+// fallback chain. An alias may itself stand for a chain.
+func ResolveAliases(model string) (string, error) {
+	s, err := LoadSettings()
+	if err != nil {
+		return "", err
+	}
+	return expandAliases(s.Aliases, model, 0)
+}
+
+func expandAliases(aliases map[string]string, model string, depth int) (string, error) {
+	if len(aliases) == 0 {
+		return model, nil
+	}
+	if depth > 10 {
+		return "", fmt.Errorf("model alias loop in %q", model)
+	}
+
+	var models []string
+	for _, m := range SplitModelChain(model) {
+		target, ok := aliases[m]
+		if !ok {
+			models = append(models, m)
+			continue
+		}
+		expanded, err := expandAliases(aliases, target, depth+1)
+		if err != nil {
+			return "", err
+		}
+		models = append(models, expanded)
+	}
+	return strings.Join(models, ","), nil
+}
+
+// DefaultModel returns the default_model of the config file, or builtin
+// if there is none.
+func DefaultModel(builtin string) string {
+	if s, err := LoadSettings(); err == nil && s.DefaultModel != "" {
+		return s.DefaultModel
+	}
+	return builtin
+}
+
+// ModelsDir returns $XDG_CACHE_HOME/hinata/llm/models.
+func ModelsDir() (string, error) {
+	dir, err := CacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(dir), "models"), nil
+}
+
+func readCatalogue(providerName string) (*catalogue, error) {
+	dir, err := ModelsDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, providerName+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var c catalogue
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func writeCatalogue(providerName string, c catalogue) error {
+	dir, err := ModelsDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, providerName+".json"), data, 0644)
+}
+
+// modelsURL derives the /models endpoint from the completions URL.
+func modelsURL(provider *Provider) string {
+	base := provider.ApiURL
+	for _, suffix := range []string{"/chat/completions", "/messages"} {
+		if trimmed, ok := strings.CutSuffix(base, suffix); ok {
+			return trimmed + "/models"
+		}
+	}
+	return strings.TrimSuffix(base, "/") + "/models"
+}
+
+// FetchModels returns the models of a provider, sorted by ID. A cached
+// list younger than CatalogueTTL is used unless refresh is set. config
+// only selects the API key.
+func FetchModels(ctx context.Context, config Config, providerName string, refresh bool) ([]ModelInfo, error) {
+	provider, err := LookupProvider(providerName)
+	if err != nil {
+		return nil, err
+	}
+
+	if !refresh {
+		c, err := readCatalogue(provider.Name)
+		if err == nil && c != nil && time.Since(c.FetchedAt) < CatalogueTTL {
+			return c.Models, nil
+		}
+	}
+
+	var apiKey string
+	if !provider.NoAuth {
+		if apiKey, _, err = config.apiKey(provider); err != nil {
+			return nil, err
+		}
+	}
+
+	c, err := httpClient()
+	if err != nil {
+		return nil, err
+	}
+	a := newAdapter(provider, config)
+	req, err := a.newModelsRequest(ctx, apiKey, modelsURL(provider))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(provider.Name, resp.StatusCode, body)
+	}
+
+	models, err := a.parseModels(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the model list of '%s': %w", provider.Name, err)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].ID < models[j].ID })
+
+	if err := writeCatalogue(provider.Name, catalogue{FetchedAt: time.Now(), Models: models}); err != nil {
+		return nil, err
+	}
+	return models, nil
+}
+
+// CachedModels returns the last fetched model list of a provider,
+// whatever its age, or nil if there is none.
+func CachedModels(providerName string) ([]ModelInfo, error) {
+	c, err := readCatalogue(providerName)
+	if err != nil || c == nil {
+		return nil, err
+	}
+	return c.Models, nil
+}
+
+// validateModel checks a provider/model against the cached model list of
+// its provider. Without a fresh list nothing is checked, so that no
+// request is spent on validation.
+func validateModel(model string) error {
+	providerName, modelName := splitModel(model)
+	c, err := readCatalogue(providerName)
+	if err != nil || c == nil || time.Since(c.FetchedAt) >= CatalogueTTL {
+		return nil
+	}
+
+	ids := make([]string, len(c.Models))
+	for i, m := range c.Models {
+		if m.ID == modelName {
+			return nil
+		}
+		ids[i] = m.ID
+	}
+
+	msg := fmt.Sprintf("%s: '%s' is not in the model list of '%s'", ErrUnknownModel, modelName, providerName)
+	if matches := closeMatches(modelName, ids, 3); len(matches) > 0 {
+		for i := range matches {
+			matches[i] = providerName + "/" + matches[i]
+		}
+		msg += ". Did you mean " + strings.Join(matches, ", ") + "?"
+	}
+	return &unknownModelError{msg: msg + fmt.Sprintf(" (run `hnt-llm models %s --refresh` if the list is out of date)", providerName)}
+}
+
+type unknownModelError struct {
+	msg string
+}
+
+func (e *unknownModelError) Error() string        { return e.msg }
+func (e *unknownModelError) Is(target error) bool { return target == ErrUnknownModel }
+
+// closeMatches returns up to n candidates that are within a small edit
+// distance of name or contain it, closest first.
+func closeMatches(name string, candidates []string, n int) []string {
+	type match struct {
+		id   string
+		dist int
+	}
+	limit := max(3, len(name)/4)
+	var matches []match
+	for _, c := range candidates {
+		d := editDistance(name, c)
+		if strings.Contains(c, name) {
+			d = min(d, len(c)-len(name))
+		} else if d > limit {
+			continue
+		}
+		matches = append(matches, match{c, d})
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].dist < matches[j].dist })
+
+	var ids []string
+	for i := 0; i < len(matches) && i < n; i++ {
+		ids = append(ids, matches[i].id)
+	}
+	return ids
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,123 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestExpandAliases(t *testing.T) {
+	aliases := map[string]string{
+		"opus":   "openrouter/anthropic/claude-opus-4",
+		"fast":   "openrouter/google/gemini-2.5-flash",
+		"robust": "opus,fast",
+		"loop":   "loop",
+	}
+
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{"opus", "openrouter/anthropic/claude-opus-4"},
+		{"openai/gpt-4o", "openai/gpt-4o"},
+		{"robust,openai/gpt-4o", "openrouter/anthropic/claude-opus-4,openrouter/google/gemini-2.5-flash,openai/gpt-4o"},
+	}
+	for _, tt := range tests {
+		got, err := expandAliases(aliases, tt.model, 0)
+		if err != nil || got != tt.want {
+			t.Errorf("expandAliases(%q) = %q, %v; want %q", tt.model, got, err, tt.want)
+		}
+	}
+
+	if _, err := expandAliases(aliases, "loop", 0); err == nil {
+		t.Error("Expected an error for an alias loop")
+	}
+}
+
+func TestCloseMatches(t *testing.T) {
+	ids := []string{"anthropic/claude-opus-4", "anthropic/claude-sonnet-4", "openai/gpt-4o", "openai/gpt-4o-mini"}
+
+	if got := closeMatches("anthropic/claude-opus4", ids, 3); !reflect.DeepEqual(got, []string{"anthropic/claude-opus-4"}) {
+		t.Errorf("Expected the typo to be matched, got %v", got)
+	}
+	if got := closeMatches("gpt-4o", ids, 3); !reflect.DeepEqual(got, []string{"openai/gpt-4o", "openai/gpt-4o-mini"}) {
+		t.Errorf("Expected substring matches, got %v", got)
+	}
+	if got := closeMatches("llama", ids, 3); len(got) != 0 {
+		t.Errorf("Expected no matches, got %v", got)
+	}
+}
+
+func TestFetchAndValidateModels(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	var listed, completions atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/models" {
+			listed.Add(1)
+			fmt.Fprint(w, `{"data": [
+				{"id": "vendor/big-model", "context_length": 200000, "pricing": {"prompt": "0.000003", "completion": "0.000015"}},
+				{"id": "vendor/small-model"}
+			]}`)
+			return
+		}
+		completions.Add(1)
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"ok\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer server.Close()
+	withTestProvider(t, Provider{Name: "testmodels", ApiURL: server.URL + "/v1/chat/completions", NoAuth: true})
+	withSettings(t, `{"aliases": {"big": "testmodels/vendor/big-model"}}`)
+
+	// Without a list, models are not checked.
+	stream := NewStream(context.Background(), Config{Model: "testmodels/vendor/unlisted"}, "hi")
+	for stream.Next() {
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatalf("Expected no validation without a model list, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		models, err := FetchModels(context.Background(), Config{}, "testmodels", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(models) != 2 || models[0].ID != "vendor/big-model" || models[0].ContextLength != 200000 || models[1].Price != nil {
+			t.Fatalf("Unexpected models %+v", models)
+		}
+		// Prices are converted from per token to per million tokens.
+		if p := models[0].Price; p == nil || fmt.Sprintf("%.2f/%.2f", p.Prompt, p.Completion) != "3.00/15.00" {
+			t.Errorf("Unexpected price %+v", p)
+		}
+	}
+	if listed.Load() != 1 {
+		t.Errorf("Expected the list to be cached, fetched %d times", listed.Load())
+	}
+
+	before := completions.Load()
+	stream = NewStream(context.Background(), Config{Model: "testmodels/vendor/big-modle"}, "hi")
+	for stream.Next() {
+	}
+	err := stream.Err()
+	if !errors.Is(err, ErrUnknownModel) || !strings.Contains(err.Error(), "testmodels/vendor/big-model?") {
+		t.Fatalf("Expected an unknown model error with a suggestion, got %v", err)
+	}
+	if completions.Load() != before {
+		t.Error("Expected no request for an unknown model")
+	}
+
+	stream = NewStream(context.Background(), Config{Model: "big"}, "hi")
+	for stream.Next() {
+		if ev := stream.Event(); ev.Model != "" && ev.Model != "testmodels/vendor/big-model" {
+			t.Errorf("Expected the alias to be resolved, got %s", ev.Model)
+		}
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatalf("unexpected stream error: %v", err)
+	}
+}
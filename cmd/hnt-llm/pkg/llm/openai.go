@@ -0,0 +1,250 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// openAIAdapter speaks the OpenAI-compatible /chat/completions format used
+// by most providers.
+type openAIAdapter struct {
+	provider *Provider
+	config   Config
+	// toolCalls collects streamed tool call fragments by index until the
+	// choice finishes.
+	toolCalls []*ToolCall
+}
+
+func (a *openAIAdapter) newRequest(ctx context.Context, apiKey string, model string, messages []Message) (*http.Request, error) {
+	actualModel := model
+	if a.provider.Name == "google" && !strings.HasPrefix(model, "models/") {
+		actualModel = "models/" + model
+	}
+
+	payload := ApiRequest{
+		Model:    actualModel,
+		Messages: messages,
+		Stream:   true,
+		StreamOptions: &StreamOptions{
+			IncludeUsage: true,
+		},
+		Tools: a.config.Tools,
+	}
+	a.applyParams(&payload)
+
+	if len(a.config.ResponseSchema) > 0 {
+		if a.provider.NoJSONSchema {
+			payload.ResponseFormat = &ResponseFormat{Type: "json_object"}
+			payload.Messages = withSchemaInstruction(payload.Messages, a.config.ResponseSchema)
+		} else {
+			payload.ResponseFormat = &ResponseFormat{
+				Type:       "json_schema",
+				JSONSchema: &JSONSchemaSpec{Name: "response", Schema: a.config.ResponseSchema},
+			}
+		}
+	}
+
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", a.provider.ApiURL, bytes.NewReader(jsonPayload))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	setExtraHeaders(req, a.provider)
+
+	return req, nil
+}
+
+func (a *openAIAdapter) parseEvent(event string, data string) ([]StreamEvent, bool, error) {
+	data = strings.TrimSpace(data)
+	if data == "[DONE]" {
+		return a.flushToolCalls(), true, nil
+	}
+
+	if event == "error" {
+		return nil, false, newAPIError(a.provider.Name, 0, []byte(data))
+	}
+
+	var chunk ApiResponseChunk
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return nil, false, fmt.Errorf("invalid stream data %q: %w", data, err)
+	}
+	if len(chunk.Error) > 0 && string(chunk.Error) != "null" {
+		return nil, false, newAPIError(a.provider.Name, 0, []byte(data))
+	}
+
+	var events []StreamEvent
+
+	// With include_usage the final chunk carries the usage and an empty
+	// choices array.
+	if chunk.Usage != nil {
+		usage := &Usage{
+			PromptTokens:     chunk.Usage.PromptTokens,
+			CompletionTokens: chunk.Usage.CompletionTokens,
+		}
+		if chunk.Usage.CompletionTokensDetails != nil {
+			usage.ReasoningTokens = chunk.Usage.CompletionTokensDetails.ReasoningTokens
+		}
+		events = append(events, StreamEvent{Usage: usage})
+	}
+
+	if len(chunk.Choices) == 0 {
+		return events, false, nil
+	}
+
+	choice := chunk.Choices[0]
+	delta := choice.Delta
+
+	if delta.Content != nil && *delta.Content != "" {
+		events = append(events, StreamEvent{Content: *delta.Content})
+	}
+
+	if a.config.IncludeReasoning {
+		if delta.Reasoning != nil && *delta.Reasoning != "" {
+			events = append(events, StreamEvent{Reasoning: *delta.Reasoning})
+		} else if delta.ReasoningContent != nil && *delta.ReasoningContent != "" {
+			events = append(events, StreamEvent{Reasoning: *delta.ReasoningContent})
+		}
+	}
+
+	for _, tc := range delta.ToolCalls {
+		a.addToolCallDelta(tc)
+	}
+
+	if choice.FinishReason != nil {
+		events = append(events, a.flushToolCalls()...)
+		if *choice.FinishReason != "" {
+			events = append(events, StreamEvent{FinishReason: *choice.FinishReason})
+		}
+	}
+
+	return events, false, nil
+}
+
+func (a *openAIAdapter) addToolCallDelta(tc ToolCallDelta) {
+	for len(a.toolCalls) <= tc.Index {
+		a.toolCalls = append(a.toolCalls, nil)
+	}
+
+	call := a.toolCalls[tc.Index]
+	if call == nil {
+		call = &ToolCall{Type: "function"}
+		a.toolCalls[tc.Index] = call
+	}
+	if tc.ID != "" {
+		call.ID = tc.ID
+	}
+	if tc.Type != "" {
+		call.Type = tc.Type
+	}
+	call.Function.Name += tc.Function.Name
+	call.Function.Arguments += tc.Function.Arguments
+}
+
+func (a *openAIAdapter) flushToolCalls() []StreamEvent {
+	var events []StreamEvent
+	for _, call := range a.toolCalls {
+		if call != nil {
+			events = append(events, StreamEvent{ToolCall: call})
+		}
+	}
+	a.toolCalls = nil
+	return events
+}
+
+// applyParams maps Params to the provider's field names.
+func (a *openAIAdapter) applyParams(payload *ApiRequest) {
+	p := a.config.Params
+	payload.Temperature = p.Temperature
+	payload.TopP = p.TopP
+	payload.Stop = p.Stop
+	payload.Seed = p.Seed
+
+	if a.provider.Name == "openai" {
+		payload.MaxCompletionTokens = p.MaxTokens
+	} else {
+		payload.MaxTokens = p.MaxTokens
+	}
+
+	if p.ReasoningEffort == "" {
+		return
+	}
+	switch a.provider.Name {
+	case "openrouter":
+		payload.Reasoning = &OpenRouterReasoning{Effort: p.ReasoningEffort}
+	case "google":
+		payload.ExtraBody = map[string]any{
+			"google": map[string]any{
+				"thinking_config": map[string]any{
+					"thinking_budget":  reasoningBudget(p.ReasoningEffort),
+					"include_thoughts": a.config.IncludeReasoning,
+				},
+			},
+		}
+	case "deepseek":
+		log.Printf("WARNING: provider 'deepseek' does not support a reasoning effort. It will be ignored.")
+	default:
+		payload.ReasoningEffort = p.ReasoningEffort
+	}
+}
+
+func (a *openAIAdapter) newModelsRequest(ctx context.Context, apiKey string, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	setExtraHeaders(req, a.provider)
+	return req, nil
+}
+
+// openAIModelList covers OpenAI and OpenRouter. Only OpenRouter reports
+// context lengths and prices, the latter in USD per token.
+type openAIModelList struct {
+	Data []struct {
+		ID            string `json:"id"`
+		ContextLength int    `json:"context_length"`
+		Pricing       *struct {
+			Prompt     string `json:"prompt"`
+			Completion string `json:"completion"`
+		} `json:"pricing"`
+	} `json:"data"`
+}
+
+func (a *openAIAdapter) parseModels(body []byte) ([]ModelInfo, error) {
+	var list openAIModelList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+
+	models := make([]ModelInfo, 0, len(list.Data))
+	for _, m := range list.Data {
+		// Google's compatibility endpoint names models "models/...".
+		info := ModelInfo{ID: strings.TrimPrefix(m.ID, "models/"), ContextLength: m.ContextLength}
+		if m.Pricing != nil {
+			prompt, err1 := strconv.ParseFloat(m.Pricing.Prompt, 64)
+			completion, err2 := strconv.ParseFloat(m.Pricing.Completion, 64)
+			if err1 == nil && err2 == nil {
+				info.Price = &Price{Prompt: prompt * 1e6, Completion: completion * 1e6}
+			}
+		}
+		models = append(models, info)
+	}
+	return models, nil
+}
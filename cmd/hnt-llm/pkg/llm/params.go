@@ -0,0 +1,66 @@
+package llm
+
+import "fmt"
+
+// Params are the generation parameters. Nil and empty fields are left to the
+// provider's defaults.
+type Params struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+	// ReasoningEffort is "low", "medium" or "high". Adapters translate it
+	// to the provider's own setting, e.g. a thinking token budget.
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+}
+
+var reasoningBudgets = map[string]int{
+	"low":    1024,
+	"medium": 8192,
+	"high":   24576,
+}
+
+// reasoningBudget is the thinking token budget used for providers that take
+// a budget instead of an effort level.
+func reasoningBudget(effort string) int {
+	return reasoningBudgets[effort]
+}
+
+func (p Params) Validate() error {
+	if p.ReasoningEffort != "" && reasoningBudgets[p.ReasoningEffort] == 0 {
+		return fmt.Errorf("invalid reasoning effort %q (expected low, medium or high)", p.ReasoningEffort)
+	}
+	if p.MaxTokens != nil && *p.MaxTokens <= 0 {
+		return fmt.Errorf("max tokens must be positive, got %d", *p.MaxTokens)
+	}
+	return nil
+}
+
+// Merge returns p with every field that is set in override replaced.
+func (p Params) Merge(override Params) Params {
+	if override.Temperature != nil {
+		p.Temperature = override.Temperature
+	}
+	if override.MaxTokens != nil {
+		p.MaxTokens = override.MaxTokens
+	}
+	if override.TopP != nil {
+		p.TopP = override.TopP
+	}
+	if override.Stop != nil {
+		p.Stop = override.Stop
+	}
+	if override.Seed != nil {
+		p.Seed = override.Seed
+	}
+	if override.ReasoningEffort != "" {
+		p.ReasoningEffort = override.ReasoningEffort
+	}
+	return p
+}
+
+func (p Params) IsZero() bool {
+	return p.Temperature == nil && p.MaxTokens == nil && p.TopP == nil &&
+		p.Stop == nil && p.Seed == nil && p.ReasoningEffort == ""
+}
@@ -0,0 +1,105 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+// requestBody builds a request with the adapter for provider and returns the
+// decoded JSON payload.
+func requestBody(t *testing.T, provider Provider, params Params) map[string]any {
+	t.Helper()
+	a := newAdapter(&provider, Config{Params: params})
+	req, err := a.newRequest(context.Background(), "", "m", []Message{{Role: "user", Content: "hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(data, &body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func intPtr(v int) *int           { return &v }
+func floatPtr(v float64) *float64 { return &v }
+
+func TestParamsOpenAI(t *testing.T) {
+	params := Params{Temperature: floatPtr(0.2), MaxTokens: intPtr(100), Stop: []string{"END"}, Seed: intPtr(7), ReasoningEffort: "high"}
+
+	body := requestBody(t, Provider{Name: "openai"}, params)
+	if body["temperature"] != 0.2 || body["seed"] != 7.0 || body["reasoning_effort"] != "high" {
+		t.Errorf("Unexpected OpenAI payload: %v", body)
+	}
+	if body["max_completion_tokens"] != 100.0 || body["max_tokens"] != nil {
+		t.Errorf("Expected max_completion_tokens for OpenAI, got %v", body)
+	}
+
+	body = requestBody(t, Provider{Name: "openrouter"}, params)
+	if reasoning, _ := body["reasoning"].(map[string]any); reasoning["effort"] != "high" || body["reasoning_effort"] != nil {
+		t.Errorf("Expected reasoning.effort for OpenRouter, got %v", body)
+	}
+	if body["max_tokens"] != 100.0 {
+		t.Errorf("Expected max_tokens for OpenRouter, got %v", body)
+	}
+
+	body = requestBody(t, Provider{Name: "google"}, params)
+	extra, _ := body["extra_body"].(map[string]any)
+	google, _ := extra["google"].(map[string]any)
+	thinking, _ := google["thinking_config"].(map[string]any)
+	if thinking["thinking_budget"] != float64(reasoningBudget("high")) {
+		t.Errorf("Expected a Gemini thinking budget, got %v", body)
+	}
+}
+
+func TestParamsOmittedByDefault(t *testing.T) {
+	body := requestBody(t, Provider{Name: "openai"}, Params{})
+	for _, key := range []string{"temperature", "top_p", "stop", "seed", "max_tokens", "max_completion_tokens", "reasoning_effort"} {
+		if _, ok := body[key]; ok {
+			t.Errorf("Did not expect %s in the payload", key)
+		}
+	}
+}
+
+func TestParamsAnthropic(t *testing.T) {
+	provider := Provider{Name: "anthropic", ApiType: ApiTypeAnthropic}
+
+	body := requestBody(t, provider, Params{MaxTokens: intPtr(500), Stop: []string{"END"}, TopP: floatPtr(0.9)})
+	if body["max_tokens"] != 500.0 || body["top_p"] != 0.9 || body["stop_sequences"] == nil {
+		t.Errorf("Unexpected Anthropic payload: %v", body)
+	}
+
+	body = requestBody(t, provider, Params{MaxTokens: intPtr(500), Temperature: floatPtr(0.5), ReasoningEffort: "medium"})
+	thinking, _ := body["thinking"].(map[string]any)
+	budget := float64(reasoningBudget("medium"))
+	if thinking["type"] != "enabled" || thinking["budget_tokens"] != budget {
+		t.Errorf("Expected extended thinking, got %v", body)
+	}
+	if body["max_tokens"].(float64) <= budget {
+		t.Errorf("Expected max_tokens above the thinking budget, got %v", body["max_tokens"])
+	}
+	if _, ok := body["temperature"]; ok {
+		t.Error("Expected temperature to be dropped with extended thinking")
+	}
+}
+
+func TestParamsMergeAndValidate(t *testing.T) {
+	saved := Params{Temperature: floatPtr(0.1), Seed: intPtr(1)}
+	merged := saved.Merge(Params{Temperature: floatPtr(0.9)})
+	if *merged.Temperature != 0.9 || *merged.Seed != 1 {
+		t.Errorf("Unexpected merge result: %+v", merged)
+	}
+
+	if err := (Params{ReasoningEffort: "extreme"}).Validate(); err == nil {
+		t.Error("Expected an error for an unknown reasoning effort")
+	}
+	if err := (Params{MaxTokens: intPtr(0)}).Validate(); err == nil {
+		t.Error("Expected an error for max tokens of 0")
+	}
+}
@@ -0,0 +1,64 @@
+package llm
+
+import "strings"
+
+// Price is the cost of a model in USD per million tokens.
+type Price struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// DefaultPrices is a small local price table for commonly used models. It is
+// only used for estimates; add or correct entries under "prices" in the
+// config file.
+var DefaultPrices = map[string]Price{
+	"openrouter/google/gemini-2.5-pro":               {Prompt: 1.25, Completion: 10},
+	"openrouter/google/gemini-2.5-flash":             {Prompt: 0.30, Completion: 2.50},
+	"openrouter/anthropic/claude-opus-4":             {Prompt: 15, Completion: 75},
+	"openrouter/anthropic/claude-sonnet-4":           {Prompt: 3, Completion: 15},
+	"openrouter/deepseek/deepseek-chat-v3-0324:free": {Prompt: 0, Completion: 0},
+	"google/gemini-2.5-pro":                          {Prompt: 1.25, Completion: 10},
+	"google/gemini-2.5-flash":                        {Prompt: 0.30, Completion: 2.50},
+	"anthropic/claude-opus-4-20250514":               {Prompt: 15, Completion: 75},
+	"anthropic/claude-sonnet-4-20250514":             {Prompt: 3, Completion: 15},
+	"openai/gpt-4o":                                  {Prompt: 2.50, Completion: 10},
+	"openai/gpt-4.1":                                 {Prompt: 2, Completion: 8},
+	"openai/o3":                                      {Prompt: 2, Completion: 8},
+	"deepseek/deepseek-chat":                         {Prompt: 0.27, Completion: 1.10},
+	"deepseek/deepseek-reasoner":                     {Prompt: 0.55, Completion: 2.19},
+}
+
+// NormalizeModel adds the default provider prefix to bare model names, the
+// same way StreamLLMResponse resolves them.
+func NormalizeModel(model string) string {
+	if !strings.Contains(model, "/") {
+		return "openrouter/" + model
+	}
+	return model
+}
+
+// LookupPrice returns the price of a provider/model, preferring entries
+// from the config file.
+func LookupPrice(model string) (Price, bool) {
+	model = NormalizeModel(model)
+	if s, err := LoadSettings(); err == nil {
+		if p, ok := s.Prices[model]; ok {
+			return p, true
+		}
+	}
+	p, ok := DefaultPrices[model]
+	return p, ok
+}
+
+// Cost estimates the USD cost of usage. Reasoning tokens are billed as
+// completion tokens and are already included in CompletionTokens.
+func (p Price) Cost(u Usage) float64 {
+	return (float64(u.PromptTokens)*p.Prompt + float64(u.CompletionTokens)*p.Completion) / 1e6
+}
+
+// Add accumulates other into u.
+func (u *Usage) Add(other Usage) {
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.ReasoningTokens += other.ReasoningTokens
+}
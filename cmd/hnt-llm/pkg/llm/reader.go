@@ -0,0 +1,106 @@
+package llm
+
+import (
+	"context"
+)
+
+// Why a generation ended, normalised across providers.
+const (
+	FinishStop          = "stop"
+	FinishLength        = "length"
+	FinishContentFilter = "content_filter"
+	FinishToolCalls     = "tool_calls"
+)
+
+// Stream is a streaming completion. Call Next until it returns false, then
+// Err reports whether the stream ended because of an error:
+//
+//	stream := llm.NewStream(ctx, config, prompt)
+//	for stream.Next() {
+//		fmt.Print(stream.Event().Content)
+//	}
+//	if err := stream.Err(); err != nil {
+//		return err
+//	}
+//
+// Unlike selecting over the two channels returned by StreamLLMResponse, this
+// never loses the final error to a closed event channel.
+type Stream struct {
+	events <-chan StreamEvent
+	errc   <-chan error
+
+	event        StreamEvent
+	err          error
+	finishReason string
+	done         bool
+}
+
+// NewStream streams a completion for prompt, a conversation in the
+// <hnt-user>/<hnt-assistant> tag format.
+func NewStream(ctx context.Context, config Config, prompt string) *Stream {
+	eventChan, errChan := StreamLLMResponse(ctx, config, prompt)
+	return &Stream{events: eventChan, errc: errChan}
+}
+
+// NewMessageStream streams a completion for a list of messages.
+func NewMessageStream(ctx context.Context, config Config, messages []Message) *Stream {
+	eventChan, errChan := StreamMessages(ctx, config, messages)
+	return &Stream{events: eventChan, errc: errChan}
+}
+
+// Next advances to the next event and reports whether there is one.
+func (s *Stream) Next() bool {
+	if s.done {
+		return false
+	}
+
+	event, ok := <-s.events
+	if !ok {
+		// The producer sends its error before closing the event channel,
+		// so it is always available here.
+		s.err = <-s.errc
+		s.done = true
+		s.event = StreamEvent{}
+		return false
+	}
+
+	if event.FinishReason != "" {
+		s.finishReason = event.FinishReason
+	}
+	if event.Retry != nil && event.Retry.DiscardPartial {
+		s.finishReason = ""
+	}
+	s.event = event
+	return true
+}
+
+// Event returns the current event.
+func (s *Stream) Event() StreamEvent {
+	return s.event
+}
+
+// Err returns the error that ended the stream, if any. It is only
+// meaningful once Next has returned false.
+func (s *Stream) Err() error {
+	return s.err
+}
+
+// FinishReason returns why the generation ended, e.g. FinishLength when the
+// answer was cut off by the token limit. It is empty if the provider did not
+// say.
+func (s *Stream) FinishReason() string {
+	return s.finishReason
+}
+
+// Close stops reading the stream. The context passed to NewStream should
+// be cancelled as well so that the request is aborted.
+func (s *Stream) Close() {
+	if s.done {
+		return
+	}
+	s.done = true
+	go func() {
+		for range s.events {
+		}
+	}()
+}
@@ -0,0 +1,90 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStreamReportsErrorAfterEvents(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		brokenStream(w)
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testopenai", ApiURL: server.URL, NoAuth: true})
+
+	// Run it repeatedly: with the old select loops the closed event channel
+	// could win over the pending error.
+	for i := 0; i < 20; i++ {
+		stream := NewStream(context.Background(), Config{Model: "testopenai/m", Retry: fastRetry}, "hi")
+		var content strings.Builder
+		for stream.Next() {
+			content.WriteString(stream.Event().Content)
+		}
+		if stream.Err() == nil {
+			t.Fatal("Expected the stream error to be reported")
+		}
+		if content.String() != "partial" {
+			t.Errorf("Expected the partial output, got %q", content.String())
+		}
+		if stream.Next() {
+			t.Error("Expected Next to keep returning false")
+		}
+	}
+}
+
+func TestStreamFinishReasonOpenAI(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Once upon\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"length\"}]}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testopenai", ApiURL: server.URL, NoAuth: true})
+
+	stream := NewStream(context.Background(), Config{Model: "testopenai/m"}, "hi")
+	for stream.Next() {
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatalf("unexpected stream error: %v", err)
+	}
+	if stream.FinishReason() != FinishLength {
+		t.Errorf("Expected finish reason %q, got %q", FinishLength, stream.FinishReason())
+	}
+}
+
+func TestStreamFinishReasonAnthropic(t *testing.T) {
+	tests := map[string]string{
+		"end_turn":   FinishStop,
+		"max_tokens": FinishLength,
+		"tool_use":   FinishToolCalls,
+		"refusal":    FinishContentFilter,
+	}
+	for stopReason, want := range tests {
+		t.Run(stopReason, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hi\"}}\n\n")
+				fmt.Fprintf(w, "event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":%q},\"usage\":{\"output_tokens\":1}}\n\n", stopReason)
+				fmt.Fprint(w, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+			}))
+			defer server.Close()
+
+			withTestProvider(t, Provider{Name: "testanthropic", ApiURL: server.URL, NoAuth: true, ApiType: ApiTypeAnthropic})
+
+			stream := NewStream(context.Background(), Config{Model: "testanthropic/m"}, "hi")
+			for stream.Next() {
+			}
+			if err := stream.Err(); err != nil {
+				t.Fatalf("unexpected stream error: %v", err)
+			}
+			if stream.FinishReason() != want {
+				t.Errorf("Expected %q, got %q", want, stream.FinishReason())
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// PartialPolicy decides what happens when a stream breaks after some
+// tokens were already delivered.
+type PartialPolicy string
+
+const (
+	// PartialFail keeps the partial output and reports the error.
+	PartialFail PartialPolicy = "fail"
+	// PartialRestart retries from scratch. The RetryEvent has
+	// DiscardPartial set so callers can drop what they received.
+	PartialRestart PartialPolicy = "restart"
+)
+
+// RetryPolicy controls retries of transient failures: connection errors,
+// 408/429/5xx responses and streams that break before completing.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts. 1 disables retries.
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	OnPartial    PartialPolicy
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  3,
+	InitialDelay: time.Second,
+	MaxDelay:     30 * time.Second,
+	OnPartial:    PartialFail,
+}
+
+// RetrySettings is the "retry" section of the config file.
+type RetrySettings struct {
+	MaxAttempts    *int          `json:"max_attempts,omitempty"`
+	InitialDelayMs *int          `json:"initial_delay_ms,omitempty"`
+	MaxDelayMs     *int          `json:"max_delay_ms,omitempty"`
+	OnPartial      PartialPolicy `json:"on_partial,omitempty"`
+}
+
+// RetryEvent is sent before a retry attempt starts.
+type RetryEvent struct {
+	// Attempt is the number of the attempt about to be made, starting at 2.
+	Attempt     int
+	MaxAttempts int
+	Delay       time.Duration
+	Err         error
+	// DiscardPartial means the failed attempt had already produced output,
+	// which the new attempt will produce again from the start.
+	DiscardPartial bool
+}
+
+func (r *RetryEvent) String() string {
+	return fmt.Sprintf("attempt %d/%d in %s: %v", r.Attempt, r.MaxAttempts, r.Delay.Round(100*time.Millisecond), r.Err)
+}
+
+// transientError marks a failure that may succeed when retried.
+type transientError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+func (e *transientError) Unwrap() error { return e.err }
+
+// RetryPolicy returns config.Retry, or the default policy with the overrides
+// from the config file.
+func (config Config) RetryPolicy() (RetryPolicy, error) {
+	if config.Retry != nil {
+		return *config.Retry, nil
+	}
+
+	policy := DefaultRetryPolicy
+	s, err := LoadSettings()
+	if err != nil {
+		return policy, err
+	}
+	if s.Retry != nil {
+		if s.Retry.MaxAttempts != nil {
+			policy.MaxAttempts = *s.Retry.MaxAttempts
+		}
+		if s.Retry.InitialDelayMs != nil {
+			policy.InitialDelay = time.Duration(*s.Retry.InitialDelayMs) * time.Millisecond
+		}
+		if s.Retry.MaxDelayMs != nil {
+			policy.MaxDelay = time.Duration(*s.Retry.MaxDelayMs) * time.Millisecond
+		}
+		if s.Retry.OnPartial != "" {
+			policy.OnPartial = s.Retry.OnPartial
+		}
+	}
+	return policy, nil
+}
+
+// shouldRetry reports whether a failed attempt should be retried and how
+// long to wait first. A Retry-After longer than MaxDelay is not waited out.
+func (p RetryPolicy) shouldRetry(attempt int, err error) (time.Duration, bool) {
+	var te *transientError
+	if !errors.As(err, &te) || attempt >= p.MaxAttempts {
+		return 0, false
+	}
+
+	if te.retryAfter > 0 {
+		if te.retryAfter > p.MaxDelay {
+			return 0, false
+		}
+		return te.retryAfter, true
+	}
+
+	delay := p.InitialDelay << (attempt - 1)
+	if delay > p.MaxDelay || delay <= 0 {
+		delay = p.MaxDelay
+	}
+	// Equal jitter: wait between half and all of the backoff.
+	half := delay / 2
+	if half > 0 {
+		delay = half + time.Duration(rand.Int63n(int64(half)+1))
+	}
+	return delay, true
+}
+
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout,
+		529: // Anthropic "overloaded"
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter accepts both forms of the Retry-After header: delay
+// seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
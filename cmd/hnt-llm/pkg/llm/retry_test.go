@@ -0,0 +1,153 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var fastRetry = &RetryPolicy{
+	MaxAttempts:  3,
+	InitialDelay: time.Millisecond,
+	MaxDelay:     10 * time.Millisecond,
+	OnPartial:    PartialFail,
+}
+
+func TestRetryOnStatus(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"ok\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testopenai", ApiURL: server.URL, NoAuth: true})
+
+	eventChan, errChan := StreamLLMResponse(context.Background(), Config{Model: "testopenai/m", Retry: fastRetry}, "hi")
+	var content strings.Builder
+	var retries []*RetryEvent
+	for ev := range eventChan {
+		content.WriteString(ev.Content)
+		if ev.Retry != nil {
+			retries = append(retries, ev.Retry)
+		}
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if content.String() != "ok" {
+		t.Errorf("Expected content %q, got %q", "ok", content.String())
+	}
+	if len(retries) != 1 || retries[0].Attempt != 2 || retries[0].DiscardPartial {
+		t.Errorf("Expected one retry event for attempt 2, got %+v", retries)
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testopenai", ApiURL: server.URL, NoAuth: true})
+
+	eventChan, errChan := StreamLLMResponse(context.Background(), Config{Model: "testopenai/m", Retry: fastRetry}, "hi")
+	for range eventChan {
+	}
+	if err := <-errChan; err == nil {
+		t.Fatal("Expected an error")
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 call, got %d", calls)
+	}
+}
+
+// brokenStream sends one content chunk and then drops the connection.
+func brokenStream(w http.ResponseWriter) {
+	w.Header().Set("Content-Length", "1000")
+	fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"partial\"}}]}\n\n")
+}
+
+func TestPartialFail(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		brokenStream(w)
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testopenai", ApiURL: server.URL, NoAuth: true})
+
+	eventChan, errChan := StreamLLMResponse(context.Background(), Config{Model: "testopenai/m", Retry: fastRetry}, "hi")
+	var content strings.Builder
+	for ev := range eventChan {
+		content.WriteString(ev.Content)
+	}
+	if err := <-errChan; err == nil {
+		t.Fatal("Expected an error")
+	}
+	if content.String() != "partial" || calls != 1 {
+		t.Errorf("Expected partial output from a single call, got %q after %d calls", content.String(), calls)
+	}
+}
+
+func TestPartialRestart(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			brokenStream(w)
+			return
+		}
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"complete\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testopenai", ApiURL: server.URL, NoAuth: true})
+
+	policy := *fastRetry
+	policy.OnPartial = PartialRestart
+
+	eventChan, errChan := StreamLLMResponse(context.Background(), Config{Model: "testopenai/m", Retry: &policy}, "hi")
+	var content strings.Builder
+	for ev := range eventChan {
+		if ev.Retry != nil {
+			if !ev.Retry.DiscardPartial {
+				t.Error("Expected DiscardPartial on retry after partial output")
+			}
+			content.Reset()
+		}
+		content.WriteString(ev.Content)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if content.String() != "complete" {
+		t.Errorf("Expected %q, got %q", "complete", content.String())
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("3"); d != 3*time.Second {
+		t.Errorf("Expected 3s, got %s", d)
+	}
+	future := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(future); d <= 0 || d > time.Minute {
+		t.Errorf("Expected about a minute, got %s", d)
+	}
+	if d := parseRetryAfter("soon"); d != 0 {
+		t.Errorf("Expected 0 for invalid value, got %s", d)
+	}
+}
@@ -0,0 +1,222 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings is the user configuration file for the llm package, read from
+// $XDG_CONFIG_HOME/hinata/llm/config.json (or $HINATA_LLM_CONFIG).
+type Settings struct {
+	Providers []ProviderSettings `json:"providers"`
+	// Prices overrides or extends DefaultPrices, keyed by provider/model.
+	Prices map[string]Price `json:"prices,omitempty"`
+	Retry  *RetrySettings   `json:"retry,omitempty"`
+	// FirstTokenTimeoutMs applies to all but the last model of a fallback
+	// chain.
+	FirstTokenTimeoutMs *int           `json:"first_token_timeout_ms,omitempty"`
+	Cache               *CacheSettings `json:"cache,omitempty"`
+	Log                 *LogSettings   `json:"log,omitempty"`
+	HTTP                *HTTPSettings  `json:"http,omitempty"`
+	// KeyProfiles maps directories to the key profile used under them,
+	// e.g. {"~/work": "work"}.
+	KeyProfiles map[string]string `json:"key_profiles,omitempty"`
+	// Aliases are short names for models or fallback chains, e.g.
+	// {"opus": "openrouter/anthropic/claude-opus-4"}.
+	Aliases map[string]string `json:"aliases,omitempty"`
+	// DefaultModel replaces the built-in default of every tool.
+	DefaultModel string `json:"default_model,omitempty"`
+	// MaxContinuations is the default of Config.MaxContinuations.
+	MaxContinuations *int `json:"max_continuations,omitempty"`
+}
+
+// DefaultFirstTokenTimeout is used for fallback chains when neither Config
+// nor the config file sets a timeout.
+const DefaultFirstTokenTimeout = 2 * time.Minute
+
+func (config Config) firstTokenTimeout() (time.Duration, error) {
+	if config.FirstTokenTimeout > 0 {
+		return config.FirstTokenTimeout, nil
+	}
+	s, err := LoadSettings()
+	if err != nil {
+		return 0, err
+	}
+	if s.FirstTokenTimeoutMs != nil {
+		return time.Duration(*s.FirstTokenTimeoutMs) * time.Millisecond, nil
+	}
+	return DefaultFirstTokenTimeout, nil
+}
+
+// ProviderSettings describes a user-defined provider, e.g. a local Ollama or
+// llama.cpp server. Entries with the name of a built-in provider replace it.
+type ProviderSettings struct {
+	Name    string `json:"name"`
+	BaseURL string `json:"base_url"`
+	// EnvVar defaults to NAME_API_KEY.
+	EnvVar string `json:"env_var,omitempty"`
+	// NoAuth sends requests without an API key.
+	NoAuth       bool              `json:"no_auth,omitempty"`
+	ExtraHeaders map[string]string `json:"extra_headers,omitempty"`
+	ApiType      string            `json:"api_type,omitempty"`
+	// NoVision replaces images with a text placeholder.
+	NoVision      bool `json:"no_vision,omitempty"`
+	MaxImageBytes int  `json:"max_image_bytes,omitempty"`
+	NoJSONSchema  bool `json:"no_json_schema,omitempty"`
+}
+
+var (
+	settingsOnce sync.Once
+	settings     Settings
+	settingsErr  error
+)
+
+func configDir() (string, error) {
+	baseDir := os.Getenv("XDG_CONFIG_HOME")
+	if baseDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		baseDir = filepath.Join(homeDir, ".config")
+	}
+	return filepath.Join(baseDir, "hinata", "llm"), nil
+}
+
+// SettingsPath returns the location of the config file.
+func SettingsPath() (string, error) {
+	if path := os.Getenv("HINATA_LLM_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.json"), nil
+}
+
+// LoadSettings reads the config file once per process. A missing file is not
+// an error.
+func LoadSettings() (Settings, error) {
+	settingsOnce.Do(func() {
+		settings, settingsErr = readSettings()
+	})
+	return settings, settingsErr
+}
+
+func readSettings() (Settings, error) {
+	var s Settings
+
+	path, err := SettingsPath()
+	if err != nil {
+		return s, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return s, err
+	}
+
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	if s.Retry != nil {
+		switch s.Retry.OnPartial {
+		case "", PartialFail, PartialRestart:
+		default:
+			return s, fmt.Errorf("%s: retry.on_partial must be %q or %q", path, PartialFail, PartialRestart)
+		}
+	}
+
+	for i, p := range s.Providers {
+		if p.Name == "" || strings.Contains(p.Name, "/") {
+			return s, fmt.Errorf("%s: provider %d has an invalid name %q", path, i, p.Name)
+		}
+		if p.BaseURL == "" {
+			return s, fmt.Errorf("%s: provider '%s' is missing base_url", path, p.Name)
+		}
+		switch p.ApiType {
+		case "", ApiTypeOpenAI, ApiTypeAnthropic:
+		default:
+			return s, fmt.Errorf("%s: provider '%s' has unknown api_type %q", path, p.Name, p.ApiType)
+		}
+	}
+
+	return s, nil
+}
+
+func (p ProviderSettings) toProvider() Provider {
+	endpoint := "/chat/completions"
+	if p.ApiType == ApiTypeAnthropic {
+		endpoint = "/messages"
+	}
+
+	envVar := p.EnvVar
+	if envVar == "" && !p.NoAuth {
+		envVar = strings.ToUpper(strings.ReplaceAll(p.Name, "-", "_")) + "_API_KEY"
+	}
+
+	return Provider{
+		Name:          p.Name,
+		ApiURL:        strings.TrimSuffix(p.BaseURL, "/") + endpoint,
+		EnvVar:        envVar,
+		ExtraHeaders:  p.ExtraHeaders,
+		ApiType:       p.ApiType,
+		NoAuth:        p.NoAuth,
+		NoVision:      p.NoVision,
+		MaxImageBytes: p.MaxImageBytes,
+		NoJSONSchema:  p.NoJSONSchema,
+	}
+}
+
+// AllProviders returns the built-in providers merged with the ones from the
+// config file.
+func AllProviders() ([]Provider, error) {
+	s, err := LoadSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	all := append([]Provider{}, Providers...)
+	for _, ps := range s.Providers {
+		p := ps.toProvider()
+		replaced := false
+		for i := range all {
+			if all[i].Name == p.Name {
+				all[i] = p
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			all = append(all, p)
+		}
+	}
+
+	return all, nil
+}
+
+// LookupProvider finds a built-in or user-defined provider by name. An
+// unknown provider is an ErrUnknownModel.
+func LookupProvider(name string) (*Provider, error) {
+	all, err := AllProviders()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range all {
+		if all[i].Name == name {
+			return &all[i], nil
+		}
+	}
+	return nil, &unknownModelError{msg: fmt.Sprintf("provider '%s' not found", name)}
+}
@@ -1,33 +1,70 @@
 package llm
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
-	"os"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/veilm/hinata/cmd/hnt-llm/pkg/keymanagement"
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/sse"
 )
 
-func findSSETerminator(buffer []byte) (int, int) {
-	crlfPos := bytes.Index(buffer, []byte("\r\n\r\n"))
-	lfPos := bytes.Index(buffer, []byte("\n\n"))
-
-	if crlfPos != -1 && (lfPos == -1 || crlfPos < lfPos) {
-		return crlfPos, 4
-	}
-	if lfPos != -1 {
-		return lfPos, 2
+// SplitModelChain splits a comma-separated fallback chain such as
+// "anthropic/claude-opus-4,openrouter/google/gemini-2.5-pro".
+func SplitModelChain(model string) []string {
+	var models []string
+	for _, m := range strings.Split(model, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			models = append(models, m)
+		}
 	}
-	return -1, 0
+	return models
 }
 
+// StreamLLMResponse streams a completion for promptContent, a conversation
+// in the <hnt-user>/<hnt-assistant> tag format. The error channel receives
+// at most one error before the event channel is closed, so callers must
+// drain the events before reading it.
+//
+// Deprecated: use NewStream, which handles this ordering.
 func StreamLLMResponse(ctx context.Context, config Config, promptContent string) (<-chan StreamEvent, <-chan error) {
+	messages, err := BuildMessages(promptContent, config.SystemPrompt)
+	if err != nil {
+		eventChan := make(chan StreamEvent)
+		errChan := make(chan error, 1)
+		errChan <- err
+		close(eventChan)
+		close(errChan)
+		return eventChan, errChan
+	}
+	return StreamMessages(ctx, config, messages)
+}
+
+// StreamMessages is the channel-based form of NewMessageStream, with the
+// same caveat as StreamLLMResponse. Unlike the tag format, messages may
+// carry tool calls and tool results. config.SystemPrompt is prepended
+// unless messages already contain a system message.
+//
+// config.Model may be a fallback chain: when a model fails before producing
+// any output (including a missing key or a first-token timeout), the next
+// one is tried and a Fallback event is sent. The model that answers is
+// reported in an event with Model set.
+//
+// A response cut off by the token limit is continued if
+// config.MaxContinuations allows, with a Continuation event between the
+// parts.
+func StreamMessages(ctx context.Context, config Config, messages []Message) (<-chan StreamEvent, <-chan error) {
+	return logCall(ctx, config, messages, func(ctx context.Context) (<-chan StreamEvent, <-chan error) {
+		return continueStream(ctx, config, messages)
+	})
+}
+
+func streamMessages(ctx context.Context, config Config, messages []Message) (<-chan StreamEvent, <-chan error) {
 	eventChan := make(chan StreamEvent, 100)
 	errChan := make(chan error, 1)
 
@@ -35,175 +72,306 @@ func StreamLLMResponse(ctx context.Context, config Config, promptContent string)
 		defer close(eventChan)
 		defer close(errChan)
 
-		providerName, modelName := "openrouter", config.Model
-		if idx := strings.Index(config.Model, "/"); idx != -1 {
-			providerName = config.Model[:idx]
-			modelName = config.Model[idx+1:]
-		}
-
-		var provider *Provider
-		for i := range Providers {
-			if Providers[i].Name == providerName {
-				provider = &Providers[i]
-				break
-			}
+		model, err := ResolveAliases(config.Model)
+		if err != nil {
+			errChan <- err
+			return
 		}
-		if provider == nil {
-			errChan <- fmt.Errorf("provider '%s' not found", providerName)
+		models := SplitModelChain(model)
+		if len(models) == 0 {
+			errChan <- fmt.Errorf("no model specified")
 			return
 		}
-
-		apiKey := os.Getenv(provider.EnvVar)
-		if apiKey == "" {
-			var err error
-			apiKey, err = keymanagement.GetAPIKeyFromStore(provider.Name)
-			if err != nil || apiKey == "" {
-				errChan <- fmt.Errorf("API key for '%s' not found. Please set %s or save the key with `hnt-llm save-key %s`",
-					provider.Name, provider.EnvVar, provider.Name)
+		for _, m := range models {
+			if err := validateModel(m); err != nil {
+				errChan <- err
 				return
 			}
 		}
 
-		messages, err := BuildMessages(promptContent, config.SystemPrompt)
-		if err != nil {
+		if err := config.Params.Validate(); err != nil {
 			errChan <- err
 			return
 		}
 
-		actualModel := modelName
-		if providerName == "openrouter" {
-			actualModel = strings.ReplaceAll(modelName, "/", "/")
-		} else if providerName == "google" && !strings.HasPrefix(modelName, "models/") {
-			actualModel = "models/" + modelName
-		}
-
-		payload := ApiRequest{
-			Model:    actualModel,
-			Messages: messages,
-			Stream:   true,
-		}
+		messages := withSystemPrompt(messages, config.SystemPrompt)
 
-		jsonPayload, err := json.Marshal(payload)
+		policy, err := config.RetryPolicy()
 		if err != nil {
 			errChan <- err
 			return
 		}
 
-		req, err := http.NewRequestWithContext(ctx, "POST", provider.ApiURL, bytes.NewReader(jsonPayload))
+		timeout, err := config.firstTokenTimeout()
 		if err != nil {
 			errChan <- err
 			return
 		}
 
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+apiKey)
+		var failures []error
+		for i, model := range models {
+			isLast := i == len(models)-1
+			modelTimeout := timeout
+			if isLast {
+				// Nothing to fall back to, so let the last model take its time.
+				modelTimeout = 0
+			}
+
+			produced, err := streamModel(ctx, config, model, messages, policy, modelTimeout, eventChan)
+			if err == nil {
+				return
+			}
 
-		for k, v := range provider.ExtraHeaders {
-			req.Header.Set(k, v)
+			if produced || ctx.Err() != nil || isLast {
+				if len(failures) > 0 {
+					failures = append(failures, fmt.Errorf("%s: %w", model, err))
+					err = fmt.Errorf("all models in the fallback chain failed:\n%w", errors.Join(failures...))
+				}
+				errChan <- err
+				return
+			}
+
+			failures = append(failures, fmt.Errorf("%s: %w", model, err))
+			eventChan <- StreamEvent{Fallback: &FallbackEvent{From: model, To: models[i+1], Err: err}}
+		}
+	}()
+
+	return eventChan, errChan
+}
+
+func withSystemPrompt(messages []Message, systemPrompt string) []Message {
+	if systemPrompt == "" {
+		return messages
+	}
+	for _, m := range messages {
+		if m.Role == "system" {
+			return messages
 		}
+	}
+	return append([]Message{{Role: "system", Content: systemPrompt}}, messages...)
+}
+
+// splitModel splits provider/model. Models without a provider go to
+// OpenRouter.
+func splitModel(model string) (string, string) {
+	if idx := strings.Index(model, "/"); idx != -1 {
+		return model[:idx], model[idx+1:]
+	}
+	return "openrouter", model
+}
+
+// streamModel streams from a single provider/model, retrying transient
+// failures according to policy.
+func streamModel(ctx context.Context, config Config, model string, messages []Message, policy RetryPolicy, firstTokenTimeout time.Duration, eventChan chan<- StreamEvent) (bool, error) {
+	providerName, modelName := splitModel(model)
+	provider, err := LookupProvider(providerName)
+	if err != nil {
+		return false, err
+	}
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
+	messages, err = prepareImages(provider, messages)
+	if err != nil {
+		return false, err
+	}
+
+	tape, err := cassetteFromEnv()
+	if err != nil {
+		return false, err
+	}
+
+	// A cassette takes precedence, so that replays are exact.
+	var cache *responseCache
+	var key string
+	if tape == nil {
+		cache, err = config.openCache()
 		if err != nil {
-			errChan <- err
-			return
+			return false, err
 		}
-		defer resp.Body.Close()
+	}
+	if cache != nil {
+		key, err = cacheKey(provider.Name, modelName, messages, config)
+		if err != nil {
+			return false, err
+		}
+		if resp, ok := cache.get(key); ok {
+			resp.replay(func(ev StreamEvent) { eventChan <- ev })
+			return resp.Content != "" || resp.Reasoning != "", nil
+		}
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			errChan <- fmt.Errorf("API error: %s - %s", resp.Status, string(body))
-			return
+	// Replayed requests never reach the provider, so no key is needed.
+	var apiKey, keyName string
+	if !provider.NoAuth && !tape.replaying() {
+		apiKey, keyName, err = config.apiKey(provider)
+		if err != nil {
+			return false, err
 		}
+		addSecret(ctx, apiKey)
+	}
 
-		reader := bufio.NewReader(resp.Body)
-		var buffer bytes.Buffer
+	// The events of the current attempt are kept for the cache.
+	var recorded []StreamEvent
+	emit := func(ev StreamEvent) {
+		if cache != nil {
+			recorded = append(recorded, ev)
+		}
+		eventChan <- ev
+	}
 
-		for {
-			chunk, err := reader.ReadBytes('\n')
-			if err != nil && err != io.EOF {
-				errChan <- err
-				return
+	for attempt := 1; ; attempt++ {
+		recorded = nil
+		produced, err := streamOnce(ctx, provider, config, apiKey, keyName, modelName, messages, firstTokenTimeout, tape, emit)
+		if err == nil {
+			if cache != nil {
+				if err := cache.put(key, provider.Name+"/"+modelName, recorded); err != nil {
+					log.Printf("WARNING: failed to write response cache: %v", err)
+				}
 			}
+			return produced, nil
+		}
 
-			buffer.Write(chunk)
+		delay, retry := policy.shouldRetry(attempt, err)
+		if !retry || ctx.Err() != nil {
+			return produced, err
+		}
 
-			for {
-				pos, termLen := findSSETerminator(buffer.Bytes())
-				if pos == -1 {
-					break
-				}
+		// Once tokens have reached the caller, a retry can only start
+		// over from scratch.
+		if produced && policy.OnPartial != PartialRestart {
+			return produced, err
+		}
 
-				event := buffer.Bytes()[:pos]
-				buffer.Next(pos + termLen)
+		eventChan <- StreamEvent{Retry: &RetryEvent{
+			Attempt:        attempt + 1,
+			MaxAttempts:    policy.MaxAttempts,
+			Delay:          delay,
+			Err:            err,
+			DiscardPartial: produced,
+		}}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
 
-				eventStr := string(event)
-				if !strings.HasPrefix(eventStr, "data: ") {
-					continue
-				}
+// streamOnce performs a single request and forwards its events. produced
+// reports whether any content or reasoning was sent before a failure.
+// A non-zero firstTokenTimeout aborts the attempt if no content or
+// reasoning arrives in time, and config's idle timeout if the stream
+// stalls.
+func streamOnce(ctx context.Context, provider *Provider, config Config, apiKey, keyName string, modelName string, messages []Message, firstTokenTimeout time.Duration, tape *cassette, emit func(StreamEvent)) (bool, error) {
+	produced := false
+
+	attemptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var timedOut atomic.Bool
+	var timer *time.Timer
+	if firstTokenTimeout > 0 {
+		timer = time.AfterFunc(firstTokenTimeout, func() {
+			timedOut.Store(true)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+	timeoutErr := func(err error) error {
+		if timedOut.Load() {
+			return fmt.Errorf("no response within %s", firstTokenTimeout)
+		}
+		return err
+	}
 
-				dataStr := strings.TrimPrefix(eventStr, "data: ")
-				dataStr = strings.TrimSpace(dataStr)
+	idleTimeout, err := config.idleTimeout()
+	if err != nil {
+		return false, err
+	}
 
-				if dataStr == "[DONE]" {
-					return
-				}
+	adapter := newAdapter(provider, config)
+	req, err := adapter.newRequest(attemptCtx, apiKey, modelName, messages)
+	if err != nil {
+		return false, err
+	}
 
-				var chunk ApiResponseChunk
-				if err := json.Unmarshal([]byte(dataStr), &chunk); err != nil {
-					continue
-				}
+	client, err := httpClient()
+	if err != nil {
+		return false, err
+	}
+	if tape != nil {
+		client = &http.Client{Transport: tape.transport(client.Transport)}
+	}
 
-				if len(chunk.Choices) > 0 {
-					delta := chunk.Choices[0].Delta
+	resp, err := client.Do(req)
+	if err != nil {
+		if timedOut.Load() {
+			return false, timeoutErr(err)
+		}
+		if errors.Is(err, errNoRecording) {
+			return false, err
+		}
+		return false, &transientError{err: err}
+	}
+	defer resp.Body.Close()
 
-					if delta.Content != nil && *delta.Content != "" {
-						eventChan <- StreamEvent{Content: *delta.Content}
-					}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		err := newAPIError(provider.Name, resp.StatusCode, body)
+		if isRetryableStatus(resp.StatusCode) {
+			return false, &transientError{err: err, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+		}
+		return false, err
+	}
 
-					if config.IncludeReasoning {
-						if delta.Reasoning != nil && *delta.Reasoning != "" {
-							eventChan <- StreamEvent{Reasoning: *delta.Reasoning}
-						} else if delta.ReasoningContent != nil && *delta.ReasoningContent != "" {
-							eventChan <- StreamEvent{Reasoning: *delta.ReasoningContent}
-						}
-					}
-				}
+	emit(StreamEvent{Model: provider.Name + "/" + modelName, Key: keyName})
+
+	// A stalled stream is cancelled like a first-token timeout, and
+	// retried like a broken one.
+	var body io.Reader = resp.Body
+	var idle atomic.Bool
+	if idleTimeout > 0 {
+		idleBody := newIdleBody(resp.Body, idleTimeout, func() {
+			idle.Store(true)
+			cancel()
+		})
+		defer idleBody.Close()
+		body = idleBody
+	}
+
+	decoder := sse.NewDecoder(body)
+	for {
+		sseEvent, err := decoder.Next()
+		if err == io.EOF {
+			return produced, nil
+		}
+		if err != nil {
+			if timedOut.Load() {
+				return produced, timeoutErr(err)
+			}
+			if idle.Load() {
+				err = fmt.Errorf("no data received for %s", idleTimeout)
 			}
+			return produced, &transientError{err: err}
+		}
 
-			if err == io.EOF {
-				// Process any remaining data in the buffer before returning
-				if buffer.Len() > 0 {
-					// Check if there's an incomplete SSE event in the buffer
-					eventStr := strings.TrimSpace(buffer.String())
-					if strings.HasPrefix(eventStr, "data: ") {
-						dataStr := strings.TrimPrefix(eventStr, "data: ")
-						dataStr = strings.TrimSpace(dataStr)
-
-						if dataStr != "[DONE]" {
-							var chunk ApiResponseChunk
-							if err := json.Unmarshal([]byte(dataStr), &chunk); err == nil && len(chunk.Choices) > 0 {
-								delta := chunk.Choices[0].Delta
-
-								if delta.Content != nil && *delta.Content != "" {
-									eventChan <- StreamEvent{Content: *delta.Content}
-								}
-
-								if config.IncludeReasoning {
-									if delta.Reasoning != nil && *delta.Reasoning != "" {
-										eventChan <- StreamEvent{Reasoning: *delta.Reasoning}
-									} else if delta.ReasoningContent != nil && *delta.ReasoningContent != "" {
-										eventChan <- StreamEvent{Reasoning: *delta.ReasoningContent}
-									}
-								}
-							}
-						}
-					}
+		events, done, err := adapter.parseEvent(sseEvent.Type, sseEvent.Data)
+		for _, ev := range events {
+			if (ev.Content != "" || ev.Reasoning != "") && !produced {
+				produced = true
+				if timer != nil {
+					timer.Stop()
 				}
-				return
 			}
+			emit(ev)
 		}
-	}()
 
-	return eventChan, errChan
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.retryable() {
+			return produced, &transientError{err: err}
+		}
+		if err != nil || done {
+			return produced, err
+		}
+	}
 }
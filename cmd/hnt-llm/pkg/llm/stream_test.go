@@ -0,0 +1,269 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// withTestProvider registers a provider pointing at server for the duration
+// of the test.
+func withTestProvider(t *testing.T, provider Provider) {
+	t.Helper()
+	saved := Providers
+	Providers = append(append([]Provider{}, Providers...), provider)
+	t.Cleanup(func() { Providers = saved })
+}
+
+// withSettings points the config file at content for the duration of the
+// test.
+func withSettings(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HINATA_LLM_CONFIG", path)
+	settingsOnce = sync.Once{}
+	t.Cleanup(func() { settingsOnce = sync.Once{} })
+}
+
+func collect(t *testing.T, eventChan <-chan StreamEvent, errChan <-chan error) (string, string) {
+	t.Helper()
+	var content, reasoning strings.Builder
+	for ev := range eventChan {
+		content.WriteString(ev.Content)
+		reasoning.WriteString(ev.Reasoning)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("unexpected stream error: %v", err)
+	}
+	return content.String(), reasoning.String()
+}
+
+func TestStreamOpenAI(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer test-key" {
+			t.Errorf("Expected bearer auth, got %q", got)
+		}
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"reasoning\":\"hmm\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\" world\"}}]}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testopenai", ApiURL: server.URL, EnvVar: "HNT_TEST_OPENAI_KEY"})
+	t.Setenv("HNT_TEST_OPENAI_KEY", "test-key")
+
+	config := Config{Model: "testopenai/some-model", IncludeReasoning: true}
+	eventChan, errChan := StreamLLMResponse(context.Background(), config, "hi")
+	content, reasoning := collect(t, eventChan, errChan)
+
+	if content != "Hello world" {
+		t.Errorf("Expected content %q, got %q", "Hello world", content)
+	}
+	if reasoning != "hmm" {
+		t.Errorf("Expected reasoning %q, got %q", "hmm", reasoning)
+	}
+}
+
+func TestStreamAnthropic(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("x-api-key"); got != "test-key" {
+			t.Errorf("Expected x-api-key header, got %q", got)
+		}
+		if got := r.Header.Get("anthropic-version"); got == "" {
+			t.Error("Expected anthropic-version header")
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Error("Did not expect an Authorization header")
+		}
+
+		var req AnthropicRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("Failed to decode request: %v", err)
+		}
+		if req.System != "Be brief." {
+			t.Errorf("Expected top-level system prompt, got %q", req.System)
+		}
+		if req.Model != "claude-test" {
+			t.Errorf("Expected model claude-test, got %q", req.Model)
+		}
+		if len(req.Messages) != 1 || req.Messages[0].Role != "user" {
+			t.Errorf("Expected a single user message, got %+v", req.Messages)
+		}
+
+		events := []string{
+			"event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":25,\"output_tokens\":1}}}",
+			"event: ping\ndata: {\"type\":\"ping\"}",
+			"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"thinking_delta\",\"thinking\":\"Let me think\"}}",
+			"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":1,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hi\"}}",
+			"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":1,\"delta\":{\"type\":\"text_delta\",\"text\":\" there\"}}",
+			"event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":15}}",
+			"event: message_stop\ndata: {\"type\":\"message_stop\"}",
+		}
+		for _, ev := range events {
+			fmt.Fprint(w, ev+"\n\n")
+		}
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testanthropic", ApiURL: server.URL, EnvVar: "HNT_TEST_ANTHROPIC_KEY", ApiType: ApiTypeAnthropic})
+	t.Setenv("HNT_TEST_ANTHROPIC_KEY", "test-key")
+
+	config := Config{Model: "testanthropic/claude-test", SystemPrompt: "Be brief.", IncludeReasoning: true}
+	eventChan, errChan := StreamLLMResponse(context.Background(), config, "<hnt-user>hello</hnt-user>")
+	content, reasoning := collect(t, eventChan, errChan)
+
+	if content != "Hi there" {
+		t.Errorf("Expected content %q, got %q", "Hi there", content)
+	}
+	if reasoning != "Let me think" {
+		t.Errorf("Expected reasoning %q, got %q", "Let me think", reasoning)
+	}
+}
+
+func TestStreamAnthropicError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n")
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testanthropic", ApiURL: server.URL, EnvVar: "HNT_TEST_ANTHROPIC_KEY", ApiType: ApiTypeAnthropic})
+	t.Setenv("HNT_TEST_ANTHROPIC_KEY", "test-key")
+
+	eventChan, errChan := StreamLLMResponse(context.Background(), Config{Model: "testanthropic/claude-test", Retry: fastRetry}, "hi")
+	for range eventChan {
+	}
+	err := <-errChan
+	if err == nil || !strings.Contains(err.Error(), "overloaded_error") {
+		t.Errorf("Expected overloaded error, got %v", err)
+	}
+	if !errors.Is(err, ErrOverloaded) {
+		t.Errorf("Expected ErrOverloaded, got %v", err)
+	}
+}
+
+func TestStreamConfiguredProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("Unexpected path %q", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "" {
+			t.Errorf("Expected no auth header, got %q", got)
+		}
+		if got := r.Header.Get("X-Custom"); got != "yes" {
+			t.Errorf("Expected extra header, got %q", got)
+		}
+		var req ApiRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Model != "qwen3" {
+			t.Errorf("Expected model qwen3, got %q", req.Model)
+		}
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"local\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	withSettings(t, `{"providers": [{"name": "ollama", "base_url": "`+server.URL+`/v1/", "no_auth": true, "extra_headers": {"X-Custom": "yes"}}]}`)
+
+	eventChan, errChan := StreamLLMResponse(context.Background(), Config{Model: "ollama/qwen3"}, "hi")
+	content, _ := collect(t, eventChan, errChan)
+	if content != "local" {
+		t.Errorf("Expected content %q, got %q", "local", content)
+	}
+}
+
+func TestSettingsOverrideBuiltin(t *testing.T) {
+	withSettings(t, `{"providers": [{"name": "openai", "base_url": "http://localhost:8080/v1"}]}`)
+
+	p, err := LookupProvider("openai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ApiURL != "http://localhost:8080/v1/chat/completions" {
+		t.Errorf("Expected overridden URL, got %q", p.ApiURL)
+	}
+	if p.EnvVar != "OPENAI_API_KEY" {
+		t.Errorf("Expected derived env var OPENAI_API_KEY, got %q", p.EnvVar)
+	}
+}
+
+func TestSettingsInvalid(t *testing.T) {
+	withSettings(t, `{"providers": [{"name": "local"}]}`)
+
+	if _, err := LookupProvider("local"); err == nil || !strings.Contains(err.Error(), "base_url") {
+		t.Errorf("Expected missing base_url error, got %v", err)
+	}
+}
+
+func TestStreamUsage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ApiRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.StreamOptions == nil || !req.StreamOptions.IncludeUsage {
+			t.Error("Expected stream_options.include_usage")
+		}
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"ok\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":12,\"completion_tokens\":30,\"completion_tokens_details\":{\"reasoning_tokens\":20}}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testopenai", ApiURL: server.URL, NoAuth: true})
+
+	eventChan, errChan := StreamLLMResponse(context.Background(), Config{Model: "testopenai/m"}, "hi")
+	var usage *Usage
+	for ev := range eventChan {
+		if ev.Usage != nil {
+			usage = ev.Usage
+		}
+	}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	want := Usage{PromptTokens: 12, CompletionTokens: 30, ReasoningTokens: 20}
+	if usage == nil || *usage != want {
+		t.Errorf("Expected usage %+v, got %+v", want, usage)
+	}
+}
+
+func TestStreamInterrupted(t *testing.T) {
+	closed := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"partial\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(closed)
+	}))
+	defer server.Close()
+	withTestProvider(t, Provider{Name: "testinterrupt", ApiURL: server.URL, NoAuth: true})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := NewStream(ctx, Config{Model: "testinterrupt/m", NoCache: true}, "hi")
+	var content strings.Builder
+	for stream.Next() {
+		content.WriteString(stream.Event().Content)
+		if content.Len() > 0 {
+			cancel()
+		}
+	}
+
+	if err := stream.Err(); !Interrupted(ctx, err) {
+		t.Fatalf("Expected an interrupted stream, got %v", err)
+	}
+	if content.String() != "partial" {
+		t.Errorf("Expected the partial content, got %q", content.String())
+	}
+	<-closed
+}
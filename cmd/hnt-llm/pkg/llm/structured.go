@@ -0,0 +1,136 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/jsonschema"
+)
+
+// StructuredAttempts is how many times GenerateStructured asks for a
+// response before giving up.
+const StructuredAttempts = 3
+
+// StructuredResult is a response that passed schema validation.
+type StructuredResult struct {
+	// JSON is the validated value as the model wrote it.
+	JSON  string
+	Model string
+	// Key names the API key that was used, see StreamEvent.Key.
+	Key string
+	// Usage is summed over all attempts.
+	Usage    *Usage
+	Attempts int
+}
+
+func schemaInstruction(schema json.RawMessage) string {
+	return "Respond with only a JSON value that matches the following JSON Schema. Do not add any other text or code fences.\n\n" + string(schema)
+}
+
+// withSchemaInstruction appends the schema instruction to the system
+// message, adding one if there is none.
+func withSchemaInstruction(messages []Message, schema json.RawMessage) []Message {
+	instruction := schemaInstruction(schema)
+	result := append([]Message{}, messages...)
+	for i, m := range result {
+		if m.Role == "system" {
+			result[i].Content = m.Content + "\n\n" + instruction
+			return result
+		}
+	}
+	return append([]Message{{Role: "system", Content: instruction}}, result...)
+}
+
+// ExtractJSON strips what models commonly put around a JSON value: code
+// fences and leading or trailing prose.
+func ExtractJSON(text string) string {
+	text = strings.TrimSpace(text)
+
+	if strings.HasPrefix(text, "```") {
+		if nl := strings.IndexByte(text, '\n'); nl != -1 {
+			text = text[nl+1:]
+		}
+		text = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text), "```"))
+	}
+
+	if json.Valid([]byte(text)) {
+		return text
+	}
+
+	start := strings.IndexAny(text, "{[")
+	end := strings.LastIndexAny(text, "}]")
+	if start != -1 && end > start && json.Valid([]byte(text[start:end+1])) {
+		return text[start : end+1]
+	}
+	return text
+}
+
+// GenerateStructured requests a response matching config.ResponseSchema and
+// validates it. Invalid responses are sent back to the model with the
+// validation error, up to StructuredAttempts times. Events other than
+// content are passed to onEvent, which may be nil.
+func GenerateStructured(ctx context.Context, config Config, messages []Message, onEvent func(StreamEvent)) (*StructuredResult, error) {
+	schema, err := jsonschema.Parse(config.ResponseSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &StructuredResult{}
+	var lastErr error
+
+	for attempt := 1; attempt <= StructuredAttempts; attempt++ {
+		result.Attempts = attempt
+
+		content, err := collectContent(ctx, config, messages, result, onEvent)
+		if err != nil {
+			return nil, err
+		}
+
+		extracted := ExtractJSON(content)
+		lastErr = schema.ValidateJSON([]byte(extracted))
+		if lastErr == nil {
+			result.JSON = extracted
+			return result, nil
+		}
+
+		messages = append(messages,
+			Message{Role: "assistant", Content: content},
+			Message{Role: "user", Content: fmt.Sprintf("Your response does not match the JSON Schema: %v\n\nReply again with only the corrected JSON value.", lastErr)},
+		)
+	}
+
+	return nil, fmt.Errorf("response did not match the JSON schema after %d attempts: %w", StructuredAttempts, lastErr)
+}
+
+func collectContent(ctx context.Context, config Config, messages []Message, result *StructuredResult, onEvent func(StreamEvent)) (string, error) {
+	stream := NewMessageStream(ctx, config, messages)
+
+	var content strings.Builder
+	for stream.Next() {
+		ev := stream.Event()
+		content.WriteString(ev.Content)
+		if ev.Retry != nil && ev.Retry.DiscardPartial {
+			content.Reset()
+		}
+		if ev.Model != "" {
+			result.Model = ev.Model
+			result.Key = ev.Key
+		}
+		if ev.Usage != nil {
+			if result.Usage == nil {
+				result.Usage = &Usage{}
+			}
+			result.Usage.Add(*ev.Usage)
+		}
+		if onEvent != nil && ev.Content == "" {
+			onEvent(ev)
+		}
+	}
+
+	if err := stream.Err(); err != nil {
+		return "", err
+	}
+	return content.String(), nil
+}
@@ -0,0 +1,108 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testSchema = `{"type":"object","properties":{"answer":{"type":"integer"}},"required":["answer"]}`
+
+func TestGenerateStructuredReprompts(t *testing.T) {
+	replies := []string{
+		`Sure! Here is the answer: {"answer": "four"}`,
+		"```json\n{\"answer\": 4}\n```",
+	}
+	var requests []ApiRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ApiRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+		fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", replies[len(requests)-1])
+		fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":10,\"completion_tokens\":5}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "teststructured", ApiURL: server.URL, NoAuth: true})
+
+	config := Config{Model: "teststructured/m", ResponseSchema: json.RawMessage(testSchema)}
+	result, err := GenerateStructured(context.Background(), config, []Message{{Role: "user", Content: "2+2?"}}, nil)
+	if err != nil {
+		t.Fatalf("GenerateStructured failed: %v", err)
+	}
+
+	if result.JSON != `{"answer": 4}` || result.Attempts != 2 {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if result.Usage == nil || result.Usage.PromptTokens != 20 {
+		t.Errorf("Expected usage summed over attempts, got %+v", result.Usage)
+	}
+
+	if rf := requests[0].ResponseFormat; rf == nil || rf.Type != "json_schema" {
+		t.Errorf("Expected a json_schema response_format, got %+v", rf)
+	}
+	second := requests[1].Messages
+	if len(second) != 3 || !strings.Contains(second[2].Content, "/answer") {
+		t.Errorf("Expected the validation error to be sent back, got %+v", second)
+	}
+}
+
+func TestGenerateStructuredGivesUp(t *testing.T) {
+	server := okServer("no JSON here")
+	defer server.Close()
+	withTestProvider(t, Provider{Name: "teststructured", ApiURL: server.URL, NoAuth: true})
+
+	config := Config{Model: "teststructured/m", ResponseSchema: json.RawMessage(testSchema)}
+	if _, err := GenerateStructured(context.Background(), config, []Message{{Role: "user", Content: "hi"}}, nil); err == nil {
+		t.Error("Expected an error after invalid responses")
+	}
+}
+
+func TestSchemaInstructionFallback(t *testing.T) {
+	config := Config{ResponseSchema: json.RawMessage(testSchema)}
+	messages := []Message{{Role: "user", Content: "hi"}}
+
+	a := newAdapter(&Provider{Name: "anthropic", ApiType: ApiTypeAnthropic}, config)
+	req, err := a.newRequest(context.Background(), "", "m", messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var anthropicReq AnthropicRequest
+	json.NewDecoder(req.Body).Decode(&anthropicReq)
+	if !strings.Contains(anthropicReq.System, testSchema) {
+		t.Errorf("Expected the schema in the system prompt, got %q", anthropicReq.System)
+	}
+
+	a = newAdapter(&Provider{Name: "deepseek", NoJSONSchema: true}, config)
+	req, err = a.newRequest(context.Background(), "", "m", messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var openAIReq ApiRequest
+	json.NewDecoder(req.Body).Decode(&openAIReq)
+	if openAIReq.ResponseFormat == nil || openAIReq.ResponseFormat.Type != "json_object" {
+		t.Errorf("Expected json_object mode, got %+v", openAIReq.ResponseFormat)
+	}
+	if openAIReq.Messages[0].Role != "system" || !strings.Contains(openAIReq.Messages[0].Content, testSchema) {
+		t.Errorf("Expected a system instruction with the schema, got %+v", openAIReq.Messages)
+	}
+}
+
+func TestExtractJSON(t *testing.T) {
+	tests := map[string]string{
+		`{"a": 1}`:                             `{"a": 1}`,
+		"```json\n{\"a\": 1}\n```":             `{"a": 1}`,
+		"Here you go:\n[1, 2]\nHope it helps!": `[1, 2]`,
+		"not json":                             "not json",
+	}
+	for input, want := range tests {
+		if got := ExtractJSON(input); got != want {
+			t.Errorf("ExtractJSON(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var shellTool = NewFunctionTool("shell", "Run a shell command", json.RawMessage(`{"type":"object","properties":{"command":{"type":"string"}},"required":["command"]}`))
+
+func collectToolCalls(t *testing.T, eventChan <-chan StreamEvent, errChan <-chan error) []ToolCall {
+	t.Helper()
+	var calls []ToolCall
+	for ev := range eventChan {
+		if ev.ToolCall != nil {
+			calls = append(calls, *ev.ToolCall)
+		}
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("unexpected stream error: %v", err)
+	}
+	return calls
+}
+
+func TestStreamOpenAIToolCalls(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ApiRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("Failed to decode request: %v", err)
+		}
+		if len(req.Tools) != 1 || req.Tools[0].Function.Name != "shell" {
+			t.Errorf("Expected the shell tool in the request, got %+v", req.Tools)
+		}
+		if n := len(req.Messages); n != 3 || req.Messages[2].Role != "tool" || req.Messages[2].ToolCallID != "call_0" {
+			t.Errorf("Expected a trailing tool result message, got %+v", req.Messages)
+		}
+
+		chunks := []string{
+			`{"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"shell","arguments":""}}]}}]}`,
+			`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"comm"}}]}}]}`,
+			`{"choices":[{"delta":{"tool_calls":[{"index":1,"id":"call_2","type":"function","function":{"name":"shell","arguments":"{\"command\":\"pwd\"}"}}]}}]}`,
+			`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"and\":\"ls\"}"}}]}}]}`,
+			`{"choices":[{"delta":{},"finish_reason":"tool_calls"}]}`,
+		}
+		for _, c := range chunks {
+			fmt.Fprintf(w, "data: %s\n\n", c)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testtools", ApiURL: server.URL, NoAuth: true})
+
+	messages := []Message{
+		{Role: "user", Content: "where am I?"},
+		{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_0", Type: "function", Function: ToolCallFunction{Name: "shell", Arguments: `{"command":"hostname"}`}}}},
+		{Role: "tool", ToolCallID: "call_0", Content: "box"},
+	}
+	config := Config{Model: "testtools/m", Tools: []Tool{shellTool}}
+	eventChan, errChan := StreamMessages(context.Background(), config, messages)
+	calls := collectToolCalls(t, eventChan, errChan)
+
+	if len(calls) != 2 {
+		t.Fatalf("Expected 2 tool calls, got %+v", calls)
+	}
+	if calls[0].ID != "call_1" || calls[0].Function.Arguments != `{"command":"ls"}` {
+		t.Errorf("Unexpected first call: %+v", calls[0])
+	}
+	if calls[1].ID != "call_2" || calls[1].Function.Arguments != `{"command":"pwd"}` {
+		t.Errorf("Unexpected second call: %+v", calls[1])
+	}
+}
+
+func TestStreamAnthropicToolUse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req AnthropicRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("Failed to decode request: %v", err)
+		}
+		if len(req.Tools) != 1 || req.Tools[0].Name != "shell" || len(req.Tools[0].InputSchema) == 0 {
+			t.Errorf("Expected the shell tool in the request, got %+v", req.Tools)
+		}
+		if len(req.Messages) != 3 {
+			t.Fatalf("Expected 3 messages, got %+v", req.Messages)
+		}
+		if b := req.Messages[1].Content; len(b) != 1 || b[0].Type != "tool_use" || b[0].ID != "toolu_0" {
+			t.Errorf("Expected a tool_use block, got %+v", b)
+		}
+		if m := req.Messages[2]; m.Role != "user" || len(m.Content) != 1 || m.Content[0].Type != "tool_result" || m.Content[0].ToolUseID != "toolu_0" {
+			t.Errorf("Expected a user tool_result block, got %+v", m)
+		}
+
+		events := []string{
+			`{"type":"message_start","message":{"usage":{"input_tokens":10,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Checking."}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"shell","input":{}}}`,
+			`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"command\":"}}`,
+			`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"ls\"}"}}`,
+			`{"type":"content_block_stop","index":1}`,
+			`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":20}}`,
+			`{"type":"message_stop"}`,
+		}
+		for _, ev := range events {
+			fmt.Fprintf(w, "data: %s\n\n", ev)
+		}
+	}))
+	defer server.Close()
+
+	withTestProvider(t, Provider{Name: "testanthropictools", ApiURL: server.URL, NoAuth: true, ApiType: ApiTypeAnthropic})
+
+	messages := []Message{
+		{Role: "user", Content: "list files"},
+		{Role: "assistant", ToolCalls: []ToolCall{{ID: "toolu_0", Type: "function", Function: ToolCallFunction{Name: "shell", Arguments: `{"command":"pwd"}`}}}},
+		{Role: "tool", ToolCallID: "toolu_0", Content: "/tmp"},
+	}
+	config := Config{Model: "testanthropictools/claude-test", Tools: []Tool{shellTool}}
+	eventChan, errChan := StreamMessages(context.Background(), config, messages)
+	calls := collectToolCalls(t, eventChan, errChan)
+
+	if len(calls) != 1 {
+		t.Fatalf("Expected 1 tool call, got %+v", calls)
+	}
+	if calls[0].ID != "toolu_1" || calls[0].Function.Name != "shell" || calls[0].Function.Arguments != `{"command":"ls"}` {
+		t.Errorf("Unexpected call: %+v", calls[0])
+	}
+}
@@ -1,48 +1,381 @@
 package llm
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
 
 type Config struct {
 	Model            string
 	SystemPrompt     string
 	IncludeReasoning bool
+	// Retry overrides the retry policy from the config file.
+	Retry *RetryPolicy
+	// FirstTokenTimeout is how long a model in a fallback chain may take to
+	// produce its first token before the next model is tried. Zero uses
+	// the config file or DefaultFirstTokenTimeout.
+	FirstTokenTimeout time.Duration
+	// IdleTimeout aborts a response stream that receives no data for this
+	// long. Zero uses the config file or DefaultIdleTimeout, a negative
+	// value disables it.
+	IdleTimeout time.Duration
+	// Tools are offered to the model for native function calling.
+	Tools []Tool
+	// Params are the generation parameters, mapped to each provider's
+	// request format by its adapter.
+	Params Params
+	// NoCache bypasses the response cache, if one is enabled.
+	NoCache bool
+	// ResponseSchema is a JSON Schema the response must follow. It is
+	// sent as response_format where the provider supports it, otherwise
+	// as an instruction. Use GenerateStructured to also validate the
+	// result.
+	ResponseSchema json.RawMessage
+	// KeyProfile selects the saved key "provider:profile". Without it,
+	// $HINATA_KEY_PROFILE and then the key_profiles directory defaults of
+	// the config file apply.
+	KeyProfile string
+	// MaxContinuations is how many times a response cut off by the token
+	// limit is continued by a new request, the parts being streamed as one
+	// response. Zero uses the config file, where it defaults to 0; a
+	// negative value disables it.
+	MaxContinuations int
 }
 
 type StreamEvent struct {
 	Content   string
 	Reasoning string
+	// Usage is set on the final event when the provider reports token
+	// counts.
+	Usage *Usage
+	// Retry is set when a failed attempt is about to be retried.
+	Retry *RetryEvent
+	// Model is the provider/model that accepted the request. It is sent
+	// once per attempt, before any content.
+	Model string
+	// Key is set along with Model to the name of the API key used, e.g.
+	// "openrouter:work" or "$OPENROUTER_API_KEY", never the key itself.
+	Key string
+	// Cached is set along with Model when the response is replayed from
+	// the response cache.
+	Cached bool
+	// Fallback is set when a model in the chain failed and the next one
+	// is about to be tried.
+	Fallback *FallbackEvent
+	// ToolCall is a complete tool call, sent once all of its streamed
+	// argument fragments have arrived.
+	ToolCall *ToolCall
+	// FinishReason is set when the provider reports why the generation
+	// ended: FinishStop, FinishLength, FinishContentFilter or
+	// FinishToolCalls.
+	FinishReason string
+	// Continuation is set when a response cut off by the token limit is
+	// about to be continued, see Config.MaxContinuations.
+	Continuation *ContinuationEvent
+}
+
+// FallbackEvent reports a switch to the next model in a fallback chain.
+type FallbackEvent struct {
+	From string
+	To   string
+	Err  error
+}
+
+func (f *FallbackEvent) String() string {
+	return fmt.Sprintf("%s failed (%v), falling back to %s", f.From, f.Err, f.To)
+}
+
+// Usage is the token accounting for one request.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	// ReasoningTokens is the part of CompletionTokens spent on reasoning,
+	// when the provider reports it.
+	ReasoningTokens int `json:"reasoning_tokens,omitempty"`
 }
 
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// Parts holds text and images in order when a message references
+	// images. Content is then the text alone. Parts are sent in place of
+	// Content.
+	Parts []ContentPart `json:"-"`
+	// ToolCalls are the calls made by an assistant message.
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallID links a "tool" role message to the call it answers.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+}
+
+func (m Message) MarshalJSON() ([]byte, error) {
+	type Alias Message
+	if len(m.Parts) == 0 {
+		return json.Marshal(Alias(m))
+	}
+	return json.Marshal(struct {
+		Alias
+		Content []ContentPart `json:"content"`
+	}{Alias: Alias(m), Content: m.Parts})
+}
+
+// UnmarshalJSON accepts content as a string, null, or an array of parts in
+// the OpenAI format. Parts are kept only if there is an image among them.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type Alias Message
+	aux := struct {
+		*Alias
+		Content json.RawMessage `json:"content"`
+	}{Alias: (*Alias)(m)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	m.Content, m.Parts = "", nil
+	content := bytes.TrimSpace(aux.Content)
+	if len(content) == 0 || string(content) == "null" {
+		return nil
+	}
+	if content[0] == '"' {
+		return json.Unmarshal(content, &m.Content)
+	}
+
+	var parts []ContentPart
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return fmt.Errorf("message content must be a string or an array of parts: %w", err)
+	}
+	m.Content = joinText(parts)
+	for _, p := range parts {
+		if p.Type != "text" {
+			m.Parts = parts
+			break
+		}
+	}
+	return nil
+}
+
+// Tool is a function the model may call. Parameters is a JSON Schema
+// object.
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// NewFunctionTool builds a "function" tool from a JSON Schema.
+func NewFunctionTool(name, description string, parameters json.RawMessage) Tool {
+	return Tool{
+		Type: "function",
+		Function: ToolFunction{
+			Name:        name,
+			Description: description,
+			Parameters:  parameters,
+		},
+	}
+}
+
+type ToolCall struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name string `json:"name"`
+	// Arguments is the JSON-encoded argument object.
+	Arguments string `json:"arguments"`
 }
 
 type ApiRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
-	Stream   bool      `json:"stream"`
+	Model         string         `json:"model"`
+	Messages      []Message      `json:"messages"`
+	Stream        bool           `json:"stream"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	Tools         []Tool         `json:"tools,omitempty"`
+
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	// MaxCompletionTokens replaces max_tokens on the OpenAI API.
+	MaxCompletionTokens *int   `json:"max_completion_tokens,omitempty"`
+	ReasoningEffort     string `json:"reasoning_effort,omitempty"`
+	// Reasoning is OpenRouter's unified reasoning setting.
+	Reasoning *OpenRouterReasoning `json:"reasoning,omitempty"`
+	// ExtraBody carries provider-specific settings, e.g. Gemini's
+	// thinking_config.
+	ExtraBody      map[string]any  `json:"extra_body,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+}
+
+type ResponseFormat struct {
+	// Type is "json_schema", or "json_object" for providers that only
+	// guarantee valid JSON.
+	Type       string          `json:"type"`
+	JSONSchema *JSONSchemaSpec `json:"json_schema,omitempty"`
+}
+
+type JSONSchemaSpec struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+}
+
+type OpenRouterReasoning struct {
+	Effort string `json:"effort,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type ApiResponseChunk struct {
-	Choices []Choice `json:"choices"`
+	Choices []Choice  `json:"choices"`
+	Usage   *ApiUsage `json:"usage,omitempty"`
+	// Error is set when the provider fails mid-stream, as OpenRouter does.
+	Error json.RawMessage `json:"error,omitempty"`
+}
+
+type ApiUsage struct {
+	PromptTokens            int `json:"prompt_tokens"`
+	CompletionTokens        int `json:"completion_tokens"`
+	CompletionTokensDetails *struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"completion_tokens_details,omitempty"`
 }
 
 type Choice struct {
-	Delta Delta `json:"delta"`
+	Delta        Delta   `json:"delta"`
+	FinishReason *string `json:"finish_reason,omitempty"`
 }
 
 type Delta struct {
-	Content          *string `json:"content,omitempty"`
-	Reasoning        *string `json:"reasoning,omitempty"`
-	ReasoningContent *string `json:"reasoning_content,omitempty"`
+	Content          *string         `json:"content,omitempty"`
+	Reasoning        *string         `json:"reasoning,omitempty"`
+	ReasoningContent *string         `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCallDelta `json:"tool_calls,omitempty"`
+}
+
+// ToolCallDelta is one streamed fragment of a tool call. The first fragment
+// for an index carries the id and name, later ones append to the arguments.
+type ToolCallDelta struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments,omitempty"`
+	} `json:"function"`
+}
+
+type AnthropicRequest struct {
+	Model     string             `json:"model"`
+	System    string             `json:"system,omitempty"`
+	Messages  []AnthropicMessage `json:"messages"`
+	MaxTokens int                `json:"max_tokens"`
+	Stream    bool               `json:"stream"`
+	Tools     []AnthropicTool    `json:"tools,omitempty"`
+
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Thinking      *AnthropicThinking `json:"thinking,omitempty"`
+}
+
+type AnthropicThinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens"`
+}
+
+type AnthropicMessage struct {
+	Role    string                  `json:"role"`
+	Content []AnthropicContentBlock `json:"content"`
 }
 
+// AnthropicContentBlock covers the text, image, tool_use and tool_result
+// blocks.
+type AnthropicContentBlock struct {
+	Type      string                `json:"type"`
+	Text      string                `json:"text,omitempty"`
+	ID        string                `json:"id,omitempty"`
+	Name      string                `json:"name,omitempty"`
+	Input     json.RawMessage       `json:"input,omitempty"`
+	ToolUseID string                `json:"tool_use_id,omitempty"`
+	Content   string                `json:"content,omitempty"`
+	Source    *AnthropicImageSource `json:"source,omitempty"`
+}
+
+type AnthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type AnthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type AnthropicEvent struct {
+	Type    string `json:"type"`
+	Index   int    `json:"index"`
+	Message *struct {
+		Usage *AnthropicUsage `json:"usage,omitempty"`
+	} `json:"message,omitempty"`
+	ContentBlock *AnthropicContentBlock `json:"content_block,omitempty"`
+	Delta        *AnthropicDelta        `json:"delta,omitempty"`
+	Usage        *AnthropicUsage        `json:"usage,omitempty"`
+	Error        *AnthropicError        `json:"error,omitempty"`
+}
+
+type AnthropicUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+type AnthropicDelta struct {
+	Type        string `json:"type"`
+	StopReason  string `json:"stop_reason,omitempty"`
+	Text        string `json:"text,omitempty"`
+	Thinking    string `json:"thinking,omitempty"`
+	PartialJSON string `json:"partial_json,omitempty"`
+}
+
+type AnthropicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+const (
+	ApiTypeOpenAI    = "openai"
+	ApiTypeAnthropic = "anthropic"
+)
+
 type Provider struct {
 	Name         string
 	ApiURL       string
 	EnvVar       string
 	ExtraHeaders map[string]string
+	// ApiType selects the request/response format. Empty means ApiTypeOpenAI.
+	ApiType string
+	// NoAuth skips the API key lookup, for local servers.
+	NoAuth bool
+	// NoVision replaces images with a text placeholder.
+	NoVision bool
+	// MaxImageBytes is a provider limit below MaxImageBytes, if any.
+	MaxImageBytes int
+	// NoJSONSchema means response_format only supports json_object, so
+	// schemas are given to the model as an instruction.
+	NoJSONSchema bool
 }
 
 var Providers = []Provider{
@@ -61,15 +394,25 @@ var Providers = []Provider{
 		},
 	},
 	{
-		Name:   "deepseek",
-		ApiURL: "https://api.deepseek.com/chat/completions",
-		EnvVar: "DEEPSEEK_API_KEY",
+		Name:         "deepseek",
+		ApiURL:       "https://api.deepseek.com/chat/completions",
+		EnvVar:       "DEEPSEEK_API_KEY",
+		NoVision:     true,
+		NoJSONSchema: true,
 	},
 	{
 		Name:   "google",
 		ApiURL: "https://generativelanguage.googleapis.com/v1beta/openai/chat/completions",
 		EnvVar: "GOOGLE_API_KEY",
 	},
+	{
+		Name:    "anthropic",
+		ApiURL:  "https://api.anthropic.com/v1/messages",
+		EnvVar:  "ANTHROPIC_API_KEY",
+		ApiType: ApiTypeAnthropic,
+		// The Messages API rejects images over 5 MB.
+		MaxImageBytes: 5 * 1024 * 1024,
+	},
 }
 
 func (d *Delta) UnmarshalJSON(data []byte) error {
@@ -0,0 +1,470 @@
+// Package proxy serves an OpenAI-compatible API on top of the llm package,
+// so that other programs can use hinata's providers, routing and saved keys
+// without ever seeing a key.
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/llm"
+)
+
+type Options struct {
+	// Config holds the defaults for every request. Its Model is used when
+	// a request does not name one.
+	Config llm.Config
+	// Token, if set, must be sent by clients as a bearer token.
+	Token string
+	// Hosts are the names clients may use in the Host header besides
+	// localhost and IP addresses. Other names are refused, so that a web
+	// page cannot reach the API through DNS rebinding.
+	Hosts []string
+	// AuditLog receives one JSON record per request. Nil disables it.
+	AuditLog io.Writer
+}
+
+type server struct {
+	opts    Options
+	auditMu sync.Mutex
+}
+
+// NewHandler returns a handler for /v1/chat/completions and /v1/models.
+func NewHandler(opts Options) http.Handler {
+	s := &server{opts: opts}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/chat/completions", s.authorized(s.handleChatCompletions))
+	mux.HandleFunc("GET /v1/models", s.authorized(s.handleModels))
+	return mux
+}
+
+func (s *server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.allowedHost(r.Host) {
+			writeError(w, http.StatusForbidden, "invalid_request_error", fmt.Sprintf("host %q is not allowed", r.Host))
+			return
+		}
+		if s.opts.Token != "" {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) != 1 {
+				writeError(w, http.StatusUnauthorized, "invalid_api_key", "invalid or missing bearer token")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func (s *server) allowedHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if net.ParseIP(host) != nil || strings.EqualFold(host, "localhost") {
+		return true
+	}
+	for _, allowed := range s.opts.Hosts {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// chatRequest is the subset of the OpenAI request that is passed on.
+type chatRequest struct {
+	Model               string          `json:"model"`
+	Messages            []llm.Message   `json:"messages"`
+	Stream              bool            `json:"stream"`
+	Temperature         *float64        `json:"temperature"`
+	MaxTokens           *int            `json:"max_tokens"`
+	MaxCompletionTokens *int            `json:"max_completion_tokens"`
+	TopP                *float64        `json:"top_p"`
+	Stop                json.RawMessage `json:"stop"`
+	Seed                *int            `json:"seed"`
+	ReasoningEffort     string          `json:"reasoning_effort"`
+	Tools               []llm.Tool      `json:"tools"`
+	ResponseFormat      *struct {
+		Type       string `json:"type"`
+		JSONSchema *struct {
+			Schema json.RawMessage `json:"schema"`
+		} `json:"json_schema"`
+	} `json:"response_format"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+}
+
+// config applies the request over the server defaults.
+func (req *chatRequest) config(defaults llm.Config) (llm.Config, error) {
+	config := defaults
+	if req.Model != "" {
+		config.Model = req.Model
+	}
+	config.Tools = req.Tools
+
+	p := llm.Params{
+		Temperature:     req.Temperature,
+		MaxTokens:       req.MaxTokens,
+		TopP:            req.TopP,
+		Seed:            req.Seed,
+		ReasoningEffort: req.ReasoningEffort,
+	}
+	if req.MaxCompletionTokens != nil {
+		p.MaxTokens = req.MaxCompletionTokens
+	}
+	if len(req.Stop) > 0 && string(req.Stop) != "null" {
+		var stop string
+		if err := json.Unmarshal(req.Stop, &stop); err == nil {
+			p.Stop = []string{stop}
+		} else if err := json.Unmarshal(req.Stop, &p.Stop); err != nil {
+			return config, errors.New("stop must be a string or an array of strings")
+		}
+	}
+	config.Params = defaults.Params.Merge(p)
+
+	if rf := req.ResponseFormat; rf != nil && rf.Type == "json_schema" && rf.JSONSchema != nil {
+		config.ResponseSchema = rf.JSONSchema.Schema
+	}
+
+	for _, m := range req.Messages {
+		for _, part := range m.Parts {
+			if part.ImageURL != nil && !strings.HasPrefix(part.ImageURL.URL, "data:") {
+				return config, errors.New("only data: URLs are supported for images")
+			}
+		}
+	}
+	return config, nil
+}
+
+// auditRecord is one line of the audit log. It never contains a key, only
+// the name of the one that was used.
+type auditRecord struct {
+	Time         time.Time  `json:"time"`
+	Remote       string     `json:"remote"`
+	Model        string     `json:"model"`
+	Answered     string     `json:"answered_model,omitempty"`
+	Key          string     `json:"key,omitempty"`
+	Stream       bool       `json:"stream"`
+	Messages     int        `json:"messages"`
+	Status       int        `json:"status"`
+	DurationMs   int64      `json:"duration_ms"`
+	FinishReason string     `json:"finish_reason,omitempty"`
+	Usage        *llm.Usage `json:"usage,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+func (s *server) audit(record auditRecord) {
+	if s.opts.AuditLog == nil {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	s.opts.AuditLog.Write(append(data, '\n'))
+}
+
+func (s *server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	record := auditRecord{Time: time.Now(), Remote: r.RemoteAddr}
+	defer func() {
+		record.DurationMs = time.Since(record.Time).Milliseconds()
+		s.audit(record)
+	}()
+	fail := func(status int, code string, err error) {
+		record.Status = status
+		record.Error = err.Error()
+		writeError(w, status, code, err.Error())
+	}
+
+	// Browsers send cross-origin form posts without asking first, but only
+	// with form or text/plain content types.
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		fail(http.StatusUnsupportedMediaType, "invalid_request_error", errors.New("the Content-Type must be application/json"))
+		return
+	}
+
+	var req chatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		fail(http.StatusBadRequest, "invalid_request_error", fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	config, err := req.config(s.opts.Config)
+	record.Model, record.Stream, record.Messages = config.Model, req.Stream, len(req.Messages)
+	if err != nil {
+		fail(http.StatusBadRequest, "invalid_request_error", err)
+		return
+	}
+	if len(req.Messages) == 0 {
+		fail(http.StatusBadRequest, "invalid_request_error", errors.New("messages must not be empty"))
+		return
+	}
+
+	stream := llm.NewMessageStream(r.Context(), config, req.Messages)
+	defer stream.Close()
+
+	// Nothing is sent until a provider has accepted the request, which
+	// the Model event signals, so that failures still get a status code.
+	c := completion{id: newID(), created: time.Now().Unix(), model: config.Model}
+	for c.answered == "" && stream.Next() {
+		c.add(stream.Event())
+	}
+	if c.answered == "" {
+		err := stream.Err()
+		if err == nil {
+			err = errors.New("the provider sent no response")
+		}
+		status, code := errorStatus(err)
+		fail(status, code, err)
+		return
+	}
+
+	if req.Stream {
+		s.streamCompletion(w, stream, &c, req.StreamOptions != nil && req.StreamOptions.IncludeUsage)
+	} else {
+		c.collect(stream)
+		if err := stream.Err(); err != nil {
+			status, code := errorStatus(err)
+			fail(status, code, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.response())
+	}
+
+	record.Status = http.StatusOK
+	record.Answered, record.Key = c.answered, c.key
+	record.FinishReason = c.finishReason()
+	record.Usage = c.usage
+	if err := stream.Err(); err != nil {
+		record.Error = err.Error()
+	}
+}
+
+func (s *server) streamCompletion(w http.ResponseWriter, stream *llm.Stream, c *completion, includeUsage bool) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	send := func(v any) {
+		data, _ := json.Marshal(v)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	send(c.chunk(map[string]any{"role": "assistant", "content": ""}, nil))
+	for stream.Next() {
+		ev := stream.Event()
+		c.add(ev)
+		if ev.Content != "" {
+			send(c.chunk(map[string]any{"content": ev.Content}, nil))
+		}
+		if ev.ToolCall != nil {
+			call := map[string]any{"index": len(c.toolCalls) - 1, "id": ev.ToolCall.ID, "type": ev.ToolCall.Type, "function": ev.ToolCall.Function}
+			send(c.chunk(map[string]any{"tool_calls": []any{call}}, nil))
+		}
+	}
+
+	if err := stream.Err(); err != nil {
+		_, code := errorStatus(err)
+		send(map[string]any{"error": apiError{Message: err.Error(), Type: code}})
+		return
+	}
+
+	reason := c.finishReason()
+	send(c.chunk(map[string]any{}, &reason))
+	if includeUsage && c.usage != nil {
+		chunk := c.chunk(nil, nil)
+		chunk["choices"] = []any{}
+		chunk["usage"] = openAIUsage(c.usage)
+		send(chunk)
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// completion accumulates a response.
+type completion struct {
+	id       string
+	created  int64
+	model    string
+	answered string
+	key      string
+	content  strings.Builder
+	finish   string
+	usage    *llm.Usage
+
+	toolCalls []llm.ToolCall
+}
+
+func (c *completion) add(ev llm.StreamEvent) {
+	c.content.WriteString(ev.Content)
+	if ev.Retry != nil && ev.Retry.DiscardPartial {
+		c.content.Reset()
+	}
+	if ev.Model != "" {
+		c.answered, c.key = ev.Model, ev.Key
+	}
+	if ev.ToolCall != nil {
+		c.toolCalls = append(c.toolCalls, *ev.ToolCall)
+	}
+	if ev.FinishReason != "" {
+		c.finish = ev.FinishReason
+	}
+	if ev.Usage != nil {
+		c.usage = ev.Usage
+	}
+}
+
+// collect reads the rest of stream.
+func (c *completion) collect(stream *llm.Stream) {
+	for stream.Next() {
+		c.add(stream.Event())
+	}
+}
+
+func (c *completion) finishReason() string {
+	if c.finish != "" {
+		return c.finish
+	}
+	if len(c.toolCalls) > 0 {
+		return llm.FinishToolCalls
+	}
+	return llm.FinishStop
+}
+
+// responseModel is the provider/model that answered, which differs from
+// the requested one for aliases and fallback chains.
+func (c *completion) responseModel() string {
+	if c.answered != "" {
+		return c.answered
+	}
+	return c.model
+}
+
+func (c *completion) chunk(delta map[string]any, finishReason *string) map[string]any {
+	chunk := map[string]any{
+		"id":      c.id,
+		"object":  "chat.completion.chunk",
+		"created": c.created,
+		"model":   c.responseModel(),
+	}
+	if delta != nil {
+		chunk["choices"] = []any{map[string]any{"index": 0, "delta": delta, "finish_reason": finishReason}}
+	}
+	return chunk
+}
+
+func (c *completion) response() map[string]any {
+	message := map[string]any{"role": "assistant", "content": c.content.String()}
+	if len(c.toolCalls) > 0 {
+		message["tool_calls"] = c.toolCalls
+	}
+	response := map[string]any{
+		"id":      c.id,
+		"object":  "chat.completion",
+		"created": c.created,
+		"model":   c.responseModel(),
+		"choices": []any{map[string]any{"index": 0, "message": message, "finish_reason": c.finishReason()}},
+	}
+	if c.usage != nil {
+		response["usage"] = openAIUsage(c.usage)
+	}
+	return response
+}
+
+func openAIUsage(u *llm.Usage) map[string]any {
+	return map[string]any{
+		"prompt_tokens":     u.PromptTokens,
+		"completion_tokens": u.CompletionTokens,
+		"total_tokens":      u.PromptTokens + u.CompletionTokens,
+	}
+}
+
+func newID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "chatcmpl-" + hex.EncodeToString(b)
+}
+
+type apiError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"error": apiError{Message: message, Type: code}})
+}
+
+// errorStatus maps an llm error to the status and error type returned to
+// the client. Provider errors keep their status.
+func errorStatus(err error) (int, string) {
+	var apiErr *llm.APIError
+	switch {
+	case errors.Is(err, llm.ErrUnknownModel):
+		return http.StatusNotFound, "model_not_found"
+	case errors.Is(err, llm.ErrRateLimited):
+		return http.StatusTooManyRequests, "rate_limit_exceeded"
+	case errors.Is(err, llm.ErrContextLength):
+		return http.StatusBadRequest, "context_length_exceeded"
+	case errors.Is(err, llm.ErrAuth):
+		// The provider rejected our key, which is not the client's fault.
+		return http.StatusBadGateway, "upstream_auth_error"
+	case errors.As(err, &apiErr) && apiErr.StatusCode >= 400:
+		return apiErr.StatusCode, "upstream_error"
+	}
+	return http.StatusBadGateway, "upstream_error"
+}
+
+// handleModels lists the cached model lists of all providers, and the
+// aliases. It never fetches, so that listing is fast and free.
+func (s *server) handleModels(w http.ResponseWriter, r *http.Request) {
+	data := []map[string]any{}
+	providers, err := llm.AllProviders()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	for _, p := range providers {
+		models, err := llm.CachedModels(p.Name)
+		if err != nil {
+			continue
+		}
+		for _, m := range models {
+			data = append(data, map[string]any{"id": p.Name + "/" + m.ID, "object": "model", "created": 0, "owned_by": p.Name})
+		}
+	}
+
+	if settings, err := llm.LoadSettings(); err == nil {
+		aliases := make([]string, 0, len(settings.Aliases))
+		for alias := range settings.Aliases {
+			aliases = append(aliases, alias)
+		}
+		sort.Strings(aliases)
+		for _, alias := range aliases {
+			data = append(data, map[string]any{"id": alias, "object": "model", "created": 0, "owned_by": "alias"})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": data})
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/llm"
+)
+
+// newProxy starts a proxy in front of a fake provider "testproxy". The
+// upstream answers with the last user message and records the requests it
+// got in upstream.
+func newProxy(t *testing.T, opts Options, upstream *[]map[string]any) *httptest.Server {
+	t.Helper()
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HINATA_LLM_CONFIG", filepath.Join(t.TempDir(), "none.json"))
+
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		*upstream = append(*upstream, body)
+
+		messages := body["messages"].([]any)
+		last := messages[len(messages)-1].(map[string]any)["content"]
+		if last == "fail" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error": {"message": "slow down"}}`)
+			return
+		}
+		reply, _ := json.Marshal(fmt.Sprint(last))
+		fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%s}}]}\n\n", reply)
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"!\"},\"finish_reason\":\"stop\"}],\"usage\":{\"prompt_tokens\":5,\"completion_tokens\":2}}\n\ndata: [DONE]\n\n")
+	}))
+	t.Cleanup(provider.Close)
+
+	saved := llm.Providers
+	llm.Providers = append(append([]llm.Provider{}, llm.Providers...), llm.Provider{Name: "testproxy", ApiURL: provider.URL, NoAuth: true})
+	t.Cleanup(func() { llm.Providers = saved })
+
+	opts.Config.NoCache = true
+	opts.Config.Retry = &llm.RetryPolicy{MaxAttempts: 1}
+	server := httptest.NewServer(NewHandler(opts))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func post(t *testing.T, url, token, body string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest("POST", url+"/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp, string(data)
+}
+
+func TestChatCompletion(t *testing.T) {
+	var upstream []map[string]any
+	var audit bytes.Buffer
+	server := newProxy(t, Options{Config: llm.Config{Model: "testproxy/default"}, AuditLog: &audit}, &upstream)
+
+	body := `{"messages": [{"role": "user", "content": [{"type": "text", "text": "hi"}]}], "temperature": 0.5, "stop": "END"}`
+	resp, data := post(t, server.URL, "", body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, data)
+	}
+
+	var completion struct {
+		Model   string `json:"model"`
+		Choices []struct {
+			Message      llm.Message `json:"message"`
+			FinishReason string      `json:"finish_reason"`
+		} `json:"choices"`
+		Usage struct {
+			TotalTokens int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal([]byte(data), &completion); err != nil {
+		t.Fatal(err)
+	}
+	if completion.Model != "testproxy/default" || completion.Choices[0].Message.Content != "hi!" || completion.Choices[0].FinishReason != "stop" || completion.Usage.TotalTokens != 7 {
+		t.Errorf("Unexpected completion %s", data)
+	}
+
+	// Text-only parts are sent on as plain content, with the parameters.
+	got := upstream[0]
+	if got["temperature"] != 0.5 || fmt.Sprint(got["stop"]) != "[END]" || got["messages"].([]any)[0].(map[string]any)["content"] != "hi" {
+		t.Errorf("Unexpected upstream request %v", got)
+	}
+
+	var record auditRecord
+	if err := json.Unmarshal(audit.Bytes(), &record); err != nil {
+		t.Fatalf("invalid audit record %q: %v", audit.String(), err)
+	}
+	if record.Status != http.StatusOK || record.Answered != "testproxy/default" || record.Usage == nil {
+		t.Errorf("Unexpected audit record %+v", record)
+	}
+}
+
+func TestChatCompletionStream(t *testing.T) {
+	var upstream []map[string]any
+	server := newProxy(t, Options{}, &upstream)
+
+	body := `{"model": "testproxy/m", "stream": true, "stream_options": {"include_usage": true}, "messages": [{"role": "user", "content": "hey"}]}`
+	resp, data := post(t, server.URL, "", body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d: %s", resp.StatusCode, data)
+	}
+
+	var content strings.Builder
+	var finish string
+	var usage bool
+	lines := strings.Split(strings.TrimSpace(data), "\n\n")
+	for _, line := range lines[:len(lines)-1] {
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+				FinishReason *string `json:"finish_reason"`
+			} `json:"choices"`
+			Usage *struct{} `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", line, err)
+		}
+		for _, c := range chunk.Choices {
+			content.WriteString(c.Delta.Content)
+			if c.FinishReason != nil {
+				finish = *c.FinishReason
+			}
+		}
+		usage = usage || chunk.Usage != nil
+	}
+	if content.String() != "hey!" || finish != "stop" || !usage || lines[len(lines)-1] != "data: [DONE]" {
+		t.Errorf("Unexpected stream %s", data)
+	}
+}
+
+func TestChatCompletionErrors(t *testing.T) {
+	var upstream []map[string]any
+	server := newProxy(t, Options{Config: llm.Config{Model: "testproxy/m"}, Token: "secret"}, &upstream)
+
+	tests := []struct {
+		token  string
+		body   string
+		status int
+	}{
+		{"", `{"messages": [{"role": "user", "content": "hi"}]}`, http.StatusUnauthorized},
+		{"wrong", `{"messages": [{"role": "user", "content": "hi"}]}`, http.StatusUnauthorized},
+		{"secret", `{"messages": []}`, http.StatusBadRequest},
+		{"secret", `{"model": "nope/m", "messages": [{"role": "user", "content": "hi"}]}`, http.StatusNotFound},
+		{"secret", `{"messages": [{"role": "user", "content": "fail"}]}`, http.StatusTooManyRequests},
+		{"secret", `{"messages": [{"role": "user", "content": "hi"}]}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp, data := post(t, server.URL, tt.token, tt.body)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s with token %q: expected %d, got %d: %s", tt.body, tt.token, tt.status, resp.StatusCode, data)
+		}
+	}
+	if len(upstream) != 2 {
+		t.Errorf("Expected only the valid requests upstream, got %d", len(upstream))
+	}
+
+	// Requests a web page could make from the browser are refused.
+	body := `{"messages": [{"role": "user", "content": "hi"}]}`
+	req, _ := http.NewRequest("POST", server.URL+"/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Content-Type", "text/plain")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected a text/plain body to be refused, got %v (%v)", resp.Status, err)
+	}
+	req, _ = http.NewRequest("POST", server.URL+"/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Content-Type", "application/json")
+	req.Host = "attacker.example:80"
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected an unknown Host to be refused, got %v (%v)", resp.Status, err)
+	}
+	if len(upstream) != 2 {
+		t.Errorf("Expected refused requests not to reach the provider, got %d", len(upstream))
+	}
+}
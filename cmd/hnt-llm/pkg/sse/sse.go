@@ -0,0 +1,161 @@
+// Package sse decodes server-sent event streams as described in the HTML
+// specification (https://html.spec.whatwg.org/multipage/server-sent-events.html).
+package sse
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is one dispatched event.
+type Event struct {
+	// Type is the "event" field. The spec's default, "message", is left
+	// empty so that callers can tell whether a name was sent.
+	Type string
+	// Data is the "data" fields joined with newlines.
+	Data string
+	// ID is the last event ID seen on the stream, which carries over to
+	// later events.
+	ID string
+	// Retry is the reconnection time requested by the server, or zero.
+	Retry time.Duration
+}
+
+// Decoder reads events from a stream.
+type Decoder struct {
+	r *bufio.Reader
+	// skipLF is set after a CR so that a following LF is not read as an
+	// empty line.
+	skipLF  bool
+	started bool
+	lastID  string
+
+	// The event being assembled.
+	event   Event
+	data    strings.Builder
+	hasData bool
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Next returns the next event. Comment lines, unknown fields and blocks
+// without data are skipped. At the end of the stream it returns io.EOF.
+//
+// The spec discards an event that is not terminated by a blank line. Next
+// dispatches it instead, since some providers close the connection right
+// after their last data line.
+func (d *Decoder) Next() (Event, error) {
+	for {
+		line, err := d.readLine()
+		if err != nil {
+			if err != io.EOF {
+				return Event{}, err
+			}
+			if line != "" {
+				d.processLine(line)
+			}
+			if d.hasData {
+				return d.dispatch(), nil
+			}
+			return Event{}, io.EOF
+		}
+
+		if line != "" {
+			d.processLine(line)
+			continue
+		}
+
+		if d.hasData {
+			return d.dispatch(), nil
+		}
+		// A block without data dispatches nothing and resets the event
+		// type.
+		d.event = Event{}
+	}
+}
+
+func (d *Decoder) processLine(line string) {
+	if strings.HasPrefix(line, ":") {
+		return
+	}
+
+	field, value := line, ""
+	if i := strings.IndexByte(line, ':'); i != -1 {
+		field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+	}
+
+	switch field {
+	case "event":
+		d.event.Type = value
+	case "data":
+		if d.hasData {
+			d.data.WriteByte('\n')
+		}
+		d.data.WriteString(value)
+		d.hasData = true
+	case "id":
+		if !strings.ContainsRune(value, 0) {
+			d.lastID = value
+		}
+	case "retry":
+		if ms, err := strconv.ParseUint(value, 10, 32); err == nil {
+			d.event.Retry = time.Duration(ms) * time.Millisecond
+		}
+	}
+}
+
+func (d *Decoder) dispatch() Event {
+	ev := d.event
+	ev.Data = d.data.String()
+	ev.ID = d.lastID
+
+	d.event = Event{}
+	d.data.Reset()
+	d.hasData = false
+	return ev
+}
+
+// readLine returns the next line without its terminator, which may be CRLF,
+// LF or CR. A final line without a terminator is returned along with
+// io.EOF.
+func (d *Decoder) readLine() (string, error) {
+	var line []byte
+	for {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return string(line), err
+		}
+
+		if d.skipLF {
+			d.skipLF = false
+			if b == '\n' {
+				continue
+			}
+		}
+
+		// A byte order mark may start the stream.
+		if !d.started {
+			d.started = true
+			if b == 0xEF {
+				if bom, err := d.r.Peek(2); err == nil && bom[0] == 0xBB && bom[1] == 0xBF {
+					d.r.Discard(2)
+					continue
+				}
+			}
+		}
+
+		switch b {
+		case '\n':
+			return string(line), nil
+		case '\r':
+			d.skipLF = true
+			return string(line), nil
+		}
+		line = append(line, b)
+	}
+}
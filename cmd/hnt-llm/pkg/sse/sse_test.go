@@ -0,0 +1,129 @@
+package sse
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeAll(t *testing.T, input string) []Event {
+	t.Helper()
+	dec := NewDecoder(strings.NewReader(input))
+	var events []Event
+	for {
+		ev, err := dec.Next()
+		if err == io.EOF {
+			return events
+		}
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		events = append(events, ev)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []Event
+	}{
+		{
+			name:  "single line",
+			input: "data: hello\n\n",
+			want:  []Event{{Data: "hello"}},
+		},
+		{
+			name:  "multi-line data",
+			input: "data: first\ndata: second\n\n",
+			want:  []Event{{Data: "first\nsecond"}},
+		},
+		{
+			name:  "event name",
+			input: "event: ping\ndata: {}\n\nevent: message_stop\ndata: {\"type\":\"message_stop\"}\n\n",
+			want:  []Event{{Type: "ping", Data: "{}"}, {Type: "message_stop", Data: `{"type":"message_stop"}`}},
+		},
+		{
+			name:  "comments",
+			input: ": OPENROUTER PROCESSING\n\n: keep-alive\ndata: x\n\n",
+			want:  []Event{{Data: "x"}},
+		},
+		{
+			name:  "no space after colon",
+			input: "data:x\ndata:  two spaces\n\n",
+			want:  []Event{{Data: "x\n two spaces"}},
+		},
+		{
+			name:  "CRLF and CR line endings",
+			input: "data: a\r\n\r\ndata: b\r\rdata: c\n\n",
+			want:  []Event{{Data: "a"}, {Data: "b"}, {Data: "c"}},
+		},
+		{
+			name:  "event without data is not dispatched",
+			input: "event: nothing\n\ndata: x\n\n",
+			want:  []Event{{Data: "x"}},
+		},
+		{
+			name:  "empty data field",
+			input: "data\n\n",
+			want:  []Event{{Data: ""}},
+		},
+		{
+			name:  "id carries over and retry",
+			input: "id: 7\nretry: 1500\ndata: a\n\ndata: b\n\n",
+			want:  []Event{{Data: "a", ID: "7", Retry: 1500 * time.Millisecond}, {Data: "b", ID: "7"}},
+		},
+		{
+			name:  "unknown fields ignored",
+			input: "foo: bar\ndata: x\n\n",
+			want:  []Event{{Data: "x"}},
+		},
+		{
+			name:  "byte order mark",
+			input: "\xEF\xBB\xBFdata: x\n\n",
+			want:  []Event{{Data: "x"}},
+		},
+		{
+			name:  "unterminated final event",
+			input: "data: a\n\ndata: [DONE]",
+			want:  []Event{{Data: "a"}, {Data: "[DONE]"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeAll(t, tt.input)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+// oneByteReader returns a single byte per Read, like a slow connection.
+type oneByteReader struct{ r io.Reader }
+
+func (o oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return o.r.Read(p[:1])
+}
+
+func TestDecodeSplitReads(t *testing.T) {
+	dec := NewDecoder(oneByteReader{strings.NewReader("event: a\r\ndata: 1\r\n\r\ndata: 2\n\n")})
+	for _, want := range []Event{{Type: "a", Data: "1"}, {Data: "2"}} {
+		ev, err := dec.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if ev != want {
+			t.Errorf("Expected %+v, got %+v", want, ev)
+		}
+	}
+	if _, err := dec.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
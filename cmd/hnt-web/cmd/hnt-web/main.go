@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -43,9 +42,13 @@ type OtherFile struct {
 }
 
 type ConversationDetail struct {
-	ID               string        `json:"conversation_id"`
-	Title            string        `json:"title"`
-	Model            string        `json:"model"`
+	ID    string `json:"conversation_id"`
+	Title string `json:"title"`
+	Model string `json:"model"`
+	// AnsweredModel is the model that answered last, which differs from
+	// Model when a fallback chain was used.
+	AnsweredModel    string        `json:"answered_model,omitempty"`
+	Params           llm.Params    `json:"params"`
 	Messages         []MessageFile `json:"messages"`
 	OtherFiles       []OtherFile   `json:"other_files"`
 	ArchivedMessages []MessageFile `json:"archived_messages"`
@@ -491,6 +494,18 @@ func getConversationDetail(w http.ResponseWriter, r *http.Request, convID string
 		detail.Model = strings.TrimSpace(string(data))
 	}
 
+	if metas, err := chat.ListMessageMeta(convDir); err == nil {
+		for _, meta := range metas {
+			if meta.Model != "" {
+				detail.AnsweredModel = meta.Model
+			}
+		}
+	}
+
+	if params, err := chat.ReadParams(convDir); err == nil {
+		detail.Params = params
+	}
+
 	// Check pin status
 	if _, err := os.Stat(filepath.Join(convDir, "pinned.txt")); err == nil {
 		detail.IsPinned = true
@@ -528,7 +543,7 @@ func getConversationDetail(w http.ResponseWriter, r *http.Request, convID string
 	entries, _ := os.ReadDir(convDir)
 	for _, entry := range entries {
 		name := entry.Name()
-		if !strings.HasPrefix(name, ".") && !entry.IsDir() && !strings.HasSuffix(name, ".md") {
+		if !strings.HasPrefix(name, ".") && !entry.IsDir() && !strings.HasSuffix(name, ".md") && !strings.HasSuffix(name, ".meta.json") {
 			file := OtherFile{
 				Filename: name,
 				IsText:   false,
@@ -858,15 +873,21 @@ func generateAssistant(w http.ResponseWriter, r *http.Request, convID string) {
 	}
 
 	// Read model from .model file
-	model := "openrouter/deepseek/deepseek-chat-v3-0324:free"
+	model := llm.DefaultModel("openrouter/deepseek/deepseek-chat-v3-0324:free")
 	if data, err := os.ReadFile(filepath.Join(convDir, "model.txt")); err == nil {
 		model = strings.TrimSpace(string(data))
 	}
 
-	// Pack conversation
-	var buf bytes.Buffer
-	if err := chat.PackConversation(convDir, &buf, true); err != nil {
-		http.Error(w, "Failed to pack conversation", http.StatusInternalServerError)
+	messages, err := chat.LoadMergedMessages(convDir)
+	if err != nil {
+		http.Error(w, "Failed to load conversation: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Generation parameters saved by hnt-chat, hnt-edit or hnt-agent
+	params, err := chat.ReadParams(convDir)
+	if err != nil {
+		http.Error(w, "Failed to read generation parameters: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -874,10 +895,11 @@ func generateAssistant(w http.ResponseWriter, r *http.Request, convID string) {
 		Model:            model,
 		SystemPrompt:     "",
 		IncludeReasoning: true,
+		Params:           params,
 	}
 
 	ctx := context.Background()
-	eventChan, errChan := llm.StreamLLMResponse(ctx, config, buf.String())
+	stream := llm.NewMessageStream(ctx, config, messages)
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -891,41 +913,71 @@ func generateAssistant(w http.ResponseWriter, r *http.Request, convID string) {
 
 	var contentBuffer strings.Builder
 	var reasoningBuffer strings.Builder
+	var usage *llm.Usage
+	answeredModel := model
+	usedKey := ""
 
-	for {
-		select {
-		case event, ok := <-eventChan:
-			if !ok {
-				goto done
-			}
+	for stream.Next() {
+		event := stream.Event()
 
-			if event.Content != "" {
-				// Escape newlines for SSE format
-				escapedContent := strings.ReplaceAll(event.Content, "\n", "\\n")
-				fmt.Fprintf(w, "data: %s\n\n", escapedContent)
-				flusher.Flush()
-				contentBuffer.WriteString(event.Content)
-			}
+		if event.Content != "" {
+			// Escape newlines for SSE format
+			escapedContent := strings.ReplaceAll(event.Content, "\n", "\\n")
+			fmt.Fprintf(w, "data: %s\n\n", escapedContent)
+			flusher.Flush()
+			contentBuffer.WriteString(event.Content)
+		}
 
-			if event.Reasoning != "" {
-				// Stream reasoning tokens with a special prefix
-				// Escape newlines for SSE format
-				escapedReasoning := strings.ReplaceAll(event.Reasoning, "\n", "\\n")
-				fmt.Fprintf(w, "data: [REASONING]%s\n\n", escapedReasoning)
-				flusher.Flush()
-				reasoningBuffer.WriteString(event.Reasoning)
-			}
+		if event.Reasoning != "" {
+			// Stream reasoning tokens with a special prefix
+			// Escape newlines for SSE format
+			escapedReasoning := strings.ReplaceAll(event.Reasoning, "\n", "\\n")
+			fmt.Fprintf(w, "data: [REASONING]%s\n\n", escapedReasoning)
+			flusher.Flush()
+			reasoningBuffer.WriteString(event.Reasoning)
+		}
 
-		case err := <-errChan:
-			if err != nil {
-				fmt.Fprintf(w, "data: [ERROR] %s\n\n", err.Error())
-				flusher.Flush()
-				return
+		if event.Usage != nil {
+			usage = event.Usage
+		}
+
+		if event.Model != "" {
+			answeredModel = event.Model
+			usedKey = event.Key
+		}
+
+		if event.Fallback != nil {
+			fallbackMessage := strings.ReplaceAll(event.Fallback.String(), "\n", " ")
+			fmt.Fprintf(w, "data: [FALLBACK] %s\n\n", fallbackMessage)
+			flusher.Flush()
+		}
+
+		if event.Retry != nil {
+			prefix := "[RETRY]"
+			if event.Retry.DiscardPartial {
+				prefix = "[RETRY-DISCARD]"
+				contentBuffer.Reset()
+				reasoningBuffer.Reset()
 			}
+			retryMessage := strings.ReplaceAll(event.Retry.String(), "\n", " ")
+			fmt.Fprintf(w, "data: %s %s\n\n", prefix, retryMessage)
+			flusher.Flush()
 		}
 	}
 
-done:
+	if err := stream.Err(); err != nil {
+		fmt.Fprintf(w, "data: [ERROR] %s\n\n", err.Error())
+		flusher.Flush()
+		return
+	}
+
+	// Tell the client when the answer is incomplete. It is still saved.
+	finishReason := stream.FinishReason()
+	if finishReason == llm.FinishLength || finishReason == llm.FinishContentFilter {
+		fmt.Fprintf(w, "data: [TRUNCATED] %s\n\n", finishReason)
+		flusher.Flush()
+	}
+
 	// Write reasoning and assistant messages to separate files
 	if reasoningBuffer.Len() > 0 {
 		// Save reasoning to a separate file with RoleAssistantReasoning
@@ -940,12 +992,15 @@ done:
 
 	// Write the assistant message content (without reasoning)
 	if contentBuffer.Len() > 0 {
-		_, err := chat.WriteMessageFile(convDir, chat.RoleAssistant, contentBuffer.String())
+		assistantFile, err := chat.WriteMessageFile(convDir, chat.RoleAssistant, contentBuffer.String())
 		if err != nil {
 			fmt.Fprintf(w, "data: [ERROR] Failed to save message\n\n")
 			flusher.Flush()
 			return
 		}
+		if err := chat.WriteMessageMeta(convDir, assistantFile, chat.MessageMeta{Model: answeredModel, Key: usedKey, Usage: usage, FinishReason: finishReason}); err != nil {
+			log.Printf("Failed to save message metadata: %v\n", err)
+		}
 
 		// Log the assistant message addition
 		title := getConversationTitle(convDir)
@@ -586,6 +586,17 @@ document.addEventListener("DOMContentLoaded", () => {
 			modelEditInput.value = escapeHtml(convModel);
 			modelEditInput.dataset.originalModel = convModel;
 			modelEditInput.disabled = false;
+			// The model that answered last, when a fallback chain was used.
+			const answeredModelSpan = document.getElementById(
+				"conversation-answered-model",
+			);
+			if (
+				answeredModelSpan &&
+				data.answered_model &&
+				data.answered_model !== convModel
+			) {
+				answeredModelSpan.textContent = `answered by ${data.answered_model}`;
+			}
 
 			modelEditInput.addEventListener("blur", async () => {
 				let newModelAttempt = modelEditInput.value.trim(); // Can be empty
@@ -1952,7 +1963,26 @@ document.addEventListener("DOMContentLoaded", () => {
 						if (line.startsWith("data: ")) {
 							const data = line.slice(6); // Remove 'data: ' prefix
 							// Skip the [DONE] token that signals end of stream
-							if (data.trim() && data.trim() !== "[DONE]") {
+							if (data.startsWith("[FALLBACK]")) {
+								console.warn("Assistant generation:", data);
+							} else if (data.startsWith("[TRUNCATED]")) {
+								// The answer ended early, e.g. at the token limit.
+								console.warn("Assistant generation:", data);
+								contentWrapperDiv.dataset.truncated = data.slice(12);
+								contentWrapperDiv.title = `Response truncated (${data.slice(12)})`;
+							} else if (data.startsWith("[RETRY")) {
+								// The server is retrying a failed LLM request. On
+								// [RETRY-DISCARD] the partial output is regenerated.
+								console.warn("Assistant generation:", data);
+								if (data.startsWith("[RETRY-DISCARD]")) {
+									contentWrapperDiv.dataset.rawText = "";
+									contentWrapperDiv.innerHTML = "";
+									if (reasoningContent) {
+										reasoningContent.dataset.rawText = "";
+										reasoningContent.innerHTML = "";
+									}
+								}
+							} else if (data.trim() && data.trim() !== "[DONE]") {
 								// Check if this is reasoning content
 								if (data.startsWith("[REASONING]")) {
 									// Remove [REASONING] prefix and unescape newlines
@@ -0,0 +1,56 @@
+// Package paramflags binds the generation parameter flags shared by the
+// hinata commands to llm.Params.
+package paramflags
+
+import (
+	"github.com/spf13/pflag"
+	"github.com/veilm/hinata/cmd/hnt-llm/pkg/llm"
+)
+
+// ParamFlags holds the values of the flags registered by Add.
+type ParamFlags struct {
+	flags           *pflag.FlagSet
+	temperature     float64
+	maxTokens       int
+	topP            float64
+	stop            []string
+	seed            int
+	reasoningEffort string
+}
+
+// Add registers --temperature, --max-tokens, --top-p, --stop, --seed and
+// --reasoning-effort on flags.
+func Add(flags *pflag.FlagSet) *ParamFlags {
+	f := &ParamFlags{flags: flags}
+	flags.Float64Var(&f.temperature, "temperature", 0, "Sampling temperature")
+	flags.IntVar(&f.maxTokens, "max-tokens", 0, "Maximum number of tokens to generate")
+	flags.Float64Var(&f.topP, "top-p", 0, "Nucleus sampling probability mass")
+	flags.StringArrayVar(&f.stop, "stop", nil, "Stop sequence (repeatable)")
+	flags.IntVar(&f.seed, "seed", 0, "Seed for deterministic sampling, where supported")
+	flags.StringVar(&f.reasoningEffort, "reasoning-effort", "", "Reasoning effort: low, medium or high")
+	return f
+}
+
+// Params returns the parameters given on the command line. Flags that were
+// not passed are left unset, so the result can be merged over saved
+// parameters.
+func (f *ParamFlags) Params() (llm.Params, error) {
+	var p llm.Params
+	if f.flags.Changed("temperature") {
+		p.Temperature = &f.temperature
+	}
+	if f.flags.Changed("max-tokens") {
+		p.MaxTokens = &f.maxTokens
+	}
+	if f.flags.Changed("top-p") {
+		p.TopP = &f.topP
+	}
+	if f.flags.Changed("stop") {
+		p.Stop = f.stop
+	}
+	if f.flags.Changed("seed") {
+		p.Seed = &f.seed
+	}
+	p.ReasoningEffort = f.reasoningEffort
+	return p, p.Validate()
+}